@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selection for scheduled archival sweeps over a large shared tree:
+// -older-than only takes files not modified for a while, runs that are
+// complete, and -skip-done leaves out the files earlier runs already
+// basecalled, by their state dbs, so each sweep only picks up what is new.
+
+// Parse an age like 90d, 12w or 36h
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.ParseFloat(n, 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid age %q, use e.g. 90d, 12w or 36h", s)
+			}
+			return time.Duration(v * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q, use e.g. 90d, 12w or 36h", s)
+	}
+	return d, nil
+}
+
+// Files in the done batches of the earlier outputs matching the comma
+// separated globs of -skip-done, by absolute path
+func loadDone(globs string) (map[string]bool, error) {
+	done := map[string]bool{}
+	for _, glob := range strings.Split(globs, ",") {
+		if glob = strings.TrimSpace(glob); glob == "" {
+			continue
+		}
+		outs, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("error in -skip-done %w", err)
+		}
+		for _, out := range outs {
+			if _, err := os.Stat(statePath(out)); err != nil {
+				continue
+			}
+			state, err := loadRunState(statePath(out))
+			if err != nil {
+				return nil, err
+			}
+			for _, rec := range state.Batches {
+				if !rec.Done {
+					continue
+				}
+				for _, f := range rec.Files {
+					done[f] = true
+				}
+			}
+		}
+	}
+	return done, nil
+}
+
+// Discover the input and apply -older-than, -skip-done and -skip-list to it, indexing it
+// on disk at index past -index-files. The counts are printed only when report
+// is set, not on every rescan.
+func (b *batch) discoverInputs(report bool, index string) (*fileList, error) {
+	list := newFileList(index, b.indexFiles)
+	cutoff := time.Now().Add(-b.olderThan)
+	var found, young, repeats int
+	var skipped []skipRecord
+	if b.skips != nil {
+		skipped = make([]skipRecord, len(b.skips.patterns))
+	}
+	err := walkInputs(b.in, b.exts, func(f pod5) error {
+		found++
+		if b.olderThan > 0 {
+			if info, err := os.Stat(f.path); err != nil || info.ModTime().After(cutoff) {
+				young++
+				return nil
+			}
+		}
+		if len(b.done) > 0 {
+			if abs, err := filepath.Abs(f.path); err == nil && b.done[abs] {
+				repeats++
+				return nil
+			}
+		}
+		if b.skips != nil {
+			abs := absPath(f.path)
+			if i := b.skips.matchFile(abs); i >= 0 {
+				skipped[i].Files = append(skipped[i].Files, abs)
+				return nil
+			}
+		}
+		return list.add(f)
+	})
+	if err == nil {
+		err = list.seal()
+	}
+	if err != nil {
+		list.close()
+		return nil, err
+	}
+	b.skippedFiles = nil
+	for i, rec := range skipped {
+		if len(rec.Files) > 0 {
+			rec.Entry, rec.Reason = b.skips.patterns[i].entry, b.skips.patterns[i].reason
+			b.skippedFiles = append(b.skippedFiles, rec)
+		}
+	}
+	if report {
+		if b.olderThan > 0 {
+			fmt.Printf("%s of %s files last modified before %s, leaving out %s newer ones\n", thousands(int64(found-young)), thousands(int64(found)), displayTime(cutoff), thousands(int64(young)))
+		}
+		if len(b.done) > 0 {
+			fmt.Printf("skipping %s files basecalled by earlier runs\n", thousands(int64(repeats)))
+		}
+		if list.indexed() {
+			fmt.Printf("indexed the paths of %s files in %s, more than -index-files %s\n", thousands(int64(list.len())), index, thousands(int64(b.indexFiles)))
+		}
+	}
+	return list, nil
+}
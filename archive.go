@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Inputs compressed as a whole, reads.pod5.gz or reads.pod5.zst, as some
+// archival policies have it regardless of the format's own compression. They
+// are found like the files they wrap and decompressed into the chunk's
+// working directory, where they last as long as the chunk does.
+var archiveExts = []string{".gz", ".zst"}
+
+// Split the compression off an input name, reads.pod5.gz -> reads.pod5, .gz
+func unwrapName(name string) (string, string) {
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), ext
+		}
+	}
+	return name, ""
+}
+
+// Whether name is an input with one of exts, compressed or not
+func isInput(name string, exts []string) bool {
+	if slices.Contains(exts, filepath.Ext(name)) {
+		return true
+	}
+	inner, codec := unwrapName(name)
+	return codec != "" && slices.Contains(exts, filepath.Ext(inner))
+}
+
+// Decompress src into dst, gzip in process and zstd with the zstd binary
+func unwrap(src, dst, codec string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s %w", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s %w", src, err)
+	}
+	defer out.Close()
+
+	switch codec {
+	case ".gz":
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s %w", src, err)
+		}
+		if _, err := io.Copy(out, gz); err != nil {
+			return fmt.Errorf("error decompressing %s %w", src, err)
+		}
+	case ".zst":
+		zstd := command("zstd", "-dc")
+		zstd.Stdin, zstd.Stdout, zstd.Stderr = in, out, os.Stderr
+		release := slots.hold(1)
+		err := zstd.Run()
+		release()
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: zstd error: %w", src, err)
+		}
+	}
+	return out.Close()
+}
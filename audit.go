@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is an append-only record of every state transition of a run, one
+// JSON object per line. A nil log records nothing.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// audit files are shared between runs when set with -audit, so they are
+// opened once per path
+var (
+	auditMu   sync.Mutex
+	auditLogs = make(map[string]*auditLog)
+)
+
+func auditPath(out string) string {
+	return runFile(out, "audit.log")
+}
+
+func openAudit(path string) (*auditLog, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if a, ok := auditLogs[path]; ok {
+		return a, nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log %w", err)
+	}
+	perms.set(path)
+	a := &auditLog{f: f}
+	auditLogs[path] = a
+	return a, nil
+}
+
+// Open the audit log of a run, by default in its run directory
+func (b *batch) openAudit() error {
+	if b.audit != nil {
+		return nil
+	}
+	if b.auditPath == "" {
+		b.auditPath = auditPath(b.out)
+	}
+	a, err := openAudit(b.auditPath)
+	if err != nil {
+		return err
+	}
+	b.audit = a
+	return nil
+}
+
+// Record an event for the run writing out, with any extra fields
+func (a *auditLog) record(out, event string, fields map[string]any) {
+	if a == nil {
+		return
+	}
+	entry := map[string]any{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = timestampNano(time.Now())
+	entry["event"] = event
+	entry["out"] = out
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Printf("error encoding audit entry %s\n", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		fmt.Printf("error writing audit log %s\n", err)
+		return
+	}
+	// regulated sites need the record on disk before the transition proceeds
+	a.f.Sync()
+}
+
+// flags holding secrets, recorded only as set or not
+var secretFlags = map[string]bool{"in-token": true, "redact-salt": true}
+
+// The effective value of every flag, recorded as the config a run used,
+// without secrets or the credentials of urls
+func flagConfig(fs *flag.FlagSet) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && v != "":
+			v = "<set>"
+		default:
+			v, _ = stripCredentials(v)
+		}
+		config[f.Name] = v
+	})
+	return config
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dbatch audit is the last check of an archive before the raw data behind it
+// is deleted. Without basecalling or writing anything it checks the manifest
+// is complete, decompresses every batch in full checking its records, read
+// count and checksum, and with -in that every read of every pod5 there is in
+// the archive, by its read ID or as the parent of the reads dorado split it
+// into. pod5s are matched to the manifest by path, or by name when the raw
+// data has moved since. Files whose read IDs can't be read are checked by
+// their read counts only.
+func auditMain(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	out := fs.String("out", "", "the archive to audit")
+	in := fs.String("in", "", "directory of the pod5s the archive was basecalled from")
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.PrintDefaults()
+		return
+	}
+	problems, err := auditArchive(*out, *in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if problems > 0 {
+		fmt.Printf("%d problems, don't delete the raw data of %s yet\n", problems, *out)
+		os.Exit(1)
+	}
+}
+
+type auditor struct {
+	problems int
+}
+
+func (a *auditor) problem(format string, args ...any) {
+	a.problems++
+	fmt.Printf("problem: "+format+"\n", args...)
+}
+
+// the pod5s found under -in, by path and by name
+type auditInputs struct {
+	paths  map[string]bool
+	names  map[string][]string
+	listed map[string]bool // named by the manifest
+}
+
+func auditArchive(out, in string) (int, error) {
+	m, err := readManifest(manifestPath(out))
+	if err != nil {
+		return 0, err
+	}
+	var a auditor
+	fmt.Println("=============================================")
+	if in != "" {
+		fmt.Printf("auditing %s, %d batches, against the pod5s in %s\n", out, len(m.Batches), in)
+	} else {
+		fmt.Printf("auditing %s, %d batches\n", out, len(m.Batches))
+	}
+	fmt.Println("=============================================")
+
+	a.auditManifest(m)
+	a.auditLayout(out, m)
+
+	var inputs *auditInputs
+	if in != "" {
+		if inputs, err = findAuditInputs(in); err != nil {
+			return 0, err
+		}
+	}
+	slices.SortFunc(m.Batches, func(x, y manifestEntry) int { return x.Batch - y.Batch })
+	var reads, pod5Reads, covered int64
+	for _, e := range m.Batches {
+		if inputs != nil {
+			for _, file := range e.Files {
+				if path := inputs.find(file); path != "" {
+					inputs.listed[path] = true
+				}
+			}
+		}
+		res := a.auditBatch(out, e, inputs)
+		reads += res.records
+		pod5Reads += res.pod5Reads
+		covered += res.covered
+	}
+
+	var skipped int
+	if inputs != nil {
+		left := map[string]bool{}
+		for _, rec := range m.Skipped {
+			for _, f := range rec.Files {
+				left[f] = true
+			}
+		}
+		var unlisted []string
+		for path := range inputs.paths {
+			switch {
+			case inputs.listed[path]:
+			case left[path]:
+				skipped++
+			default:
+				unlisted = append(unlisted, path)
+			}
+		}
+		slices.Sort(unlisted)
+		for _, path := range unlisted {
+			a.problem("%s isn't in any batch of the archive", path)
+		}
+	}
+
+	fmt.Println("=============================================")
+	fmt.Printf("%s reads in %d batches of %s\n", thousands(reads), len(m.Batches), out)
+	if inputs != nil {
+		fmt.Printf("%s of %s reads of %s pod5s found in the archive\n", thousands(covered), thousands(pod5Reads), thousands(int64(len(inputs.listed))))
+		if skipped > 0 {
+			fmt.Printf("%s pod5s were left out on purpose by -skip-list or -planner and aren't in it\n", thousands(int64(skipped)))
+		}
+	}
+	if a.problems == 0 {
+		fmt.Println("everything checks out")
+	}
+	fmt.Println("=============================================")
+	return a.problems, nil
+}
+
+// every planned batch must be in the archive, and the archive finished
+func (a *auditor) auditManifest(m *manifest) {
+	if m.Journal && !m.Sealed {
+		a.problem("the archive was written with -journal and isn't sealed yet, run dbatch seal")
+	}
+	for _, e := range m.Missing {
+		a.problem("batch %d was skipped after failing, redo it with dbatch redo", e.Batch)
+	}
+	seen := map[int]bool{}
+	for _, e := range m.Batches {
+		if seen[e.Batch] {
+			a.problem("batch %d is in the manifest more than once", e.Batch)
+		}
+		seen[e.Batch] = true
+	}
+	for _, rec := range m.Skipped {
+		if rec.Batch > 0 {
+			seen[rec.Batch] = true
+		}
+	}
+	for _, e := range m.Missing {
+		seen[e.Batch] = true
+	}
+	for i := 1; i <= m.Planned; i++ {
+		if !seen[i] {
+			a.problem("batch %d of %d was planned but isn't in the manifest", i, m.Planned)
+		}
+	}
+}
+
+// The batches of the archive itself must follow each other with nothing in
+// between or after them, those in files of their own must fit in them
+func (a *auditor) auditLayout(out string, m *manifest) {
+	var own []manifestEntry
+	for _, e := range m.Batches {
+		if e.Output != "" && e.Output != out {
+			info, err := os.Stat(e.Output)
+			if err != nil {
+				a.problem("the output of batch %d is gone, %s", e.Batch, err)
+			} else if info.Size() < e.Offset+e.Length {
+				a.problem("%s holds %s, batch %d ends at %s", e.Output, bytesIEC(info.Size()), e.Batch, bytesIEC(e.Offset+e.Length))
+			}
+			continue
+		}
+		own = append(own, e)
+	}
+	if len(own) == 0 {
+		return
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		a.problem("the archive is gone, %s", err)
+		return
+	}
+	slices.SortFunc(own, func(x, y manifestEntry) int { return int(x.Offset - y.Offset) })
+	var end int64
+	for _, e := range own {
+		switch {
+		case e.Offset > end:
+			a.problem("%s before batch %d aren't in the manifest", bytesIEC(e.Offset-end), e.Batch)
+		case e.Offset < end:
+			a.problem("batch %d overlaps the batch before it", e.Batch)
+		}
+		end = max(end, e.Offset+e.Length)
+	}
+	switch {
+	case info.Size() > end:
+		a.problem("%s after the last batch aren't in the manifest, an interrupted batch or another writer", bytesIEC(info.Size()-end))
+	case info.Size() < end:
+		a.problem("the archive holds %s but its batches end at %s, it is truncated", bytesIEC(info.Size()), bytesIEC(end))
+	}
+}
+
+func findAuditInputs(in string) (*auditInputs, error) {
+	inputs := &auditInputs{paths: map[string]bool{}, names: map[string][]string{}, listed: map[string]bool{}}
+	err := walkInputs(in, []string{".pod5"}, func(f pod5) error {
+		path := absPath(f.path)
+		inputs.paths[path] = true
+		inputs.names[f.name] = append(inputs.names[f.name], path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error finding pod5s %w", err)
+	}
+	if len(inputs.paths) == 0 {
+		return nil, fmt.Errorf("no pod5s found in %s", in)
+	}
+	return inputs, nil
+}
+
+// the pod5 under -in a file of the manifest is, by path or by a unique name
+func (i *auditInputs) find(file string) string {
+	if i.paths[file] {
+		return file
+	}
+	if same := i.names[filepath.Base(file)]; len(same) == 1 {
+		return same[0]
+	}
+	return ""
+}
+
+type auditResult struct {
+	records   int64
+	pod5Reads int64
+	covered   int64
+}
+
+// Decompress a batch in full, checking its records and checksum, and which
+// reads of its pod5s it holds
+func (a *auditor) auditBatch(out string, e manifestEntry, inputs *auditInputs) auditResult {
+	var res auditResult
+	before := a.problems
+	source := out
+	if e.Output != "" {
+		source = e.Output
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		a.problem("batch %d: error opening output %s", e.Batch, err)
+		return res
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	zstd := command("zstd", "-dc")
+	zstd.Stdin = io.TeeReader(io.NewSectionReader(f, e.Offset, e.Length), sum)
+	zstd.Stderr = os.Stderr
+	fastq, err := zstd.StdoutPipe()
+	if err != nil {
+		a.problem("batch %d: could not get zstd stdout %s", e.Batch, err)
+		return res
+	}
+	if err := zstd.Start(); err != nil {
+		a.problem("batch %d: failed to start zstd %s", e.Batch, err)
+		return res
+	}
+	headers := &provWriter{}
+	_, records, checkErr := checkRecords(io.TeeReader(fastq, headers), 1)
+	io.Copy(io.Discard, fastq)
+	res.records = records
+	switch err := zstd.Wait(); {
+	case err != nil:
+		a.problem("batch %d doesn't decompress, %s", e.Batch, err)
+		return res
+	case checkErr != nil:
+		a.problem("batch %d: %s", e.Batch, strings.TrimPrefix(checkErr.Error(), "spot check: "))
+		return res
+	}
+	if e.SHA256 != "" && hex.EncodeToString(sum.Sum(nil)) != e.SHA256 {
+		a.problem("batch %d doesn't match its checksum in the manifest", e.Batch)
+	}
+	if e.Reads != 0 && records != e.Reads {
+		a.problem("batch %d holds %s reads, the manifest %s", e.Batch, thousands(records), thousands(e.Reads))
+	}
+
+	var byCount []string
+	if inputs != nil {
+		byCount = a.auditCoverage(e, inputs, headers.pending, &res)
+	}
+	note := ""
+	if len(byCount) > 0 {
+		note = fmt.Sprintf(", %d pod5s by their read counts only", len(byCount))
+	}
+	if a.problems == before {
+		fmt.Printf("batch %d: %s reads from %d files%s, ok\n", e.Batch, thousands(records), len(e.Files), note)
+	}
+	return res
+}
+
+// Check every read of the batch's pod5s is among its records, returning the
+// files that could only be checked by their counts
+func (a *auditor) auditCoverage(e manifestEntry, inputs *auditInputs, headers []provRead, res *auditResult) []string {
+	owner := map[string]int{} // read ID to the file holding it
+	var files []string
+	var counted int64
+	var byCount []string
+	for _, file := range e.Files {
+		path := inputs.find(file)
+		if path == "" {
+			a.problem("batch %d: %s isn't under -in, its reads can't be checked", e.Batch, file)
+			continue
+		}
+		ids, err := pod5ReadIDs(path)
+		if err != nil {
+			n, countErr := pod5ReadCount(path)
+			if countErr != nil {
+				a.problem("batch %d: error reading %s", e.Batch, countErr)
+				continue
+			}
+			counted += n
+			res.pod5Reads += n
+			byCount = append(byCount, path)
+			continue
+		}
+		for _, id := range ids {
+			owner[uuidString(id)] = len(files)
+		}
+		files = append(files, path)
+		res.pod5Reads += int64(len(ids))
+	}
+
+	found := map[string]bool{}
+	var foreign int64
+	for _, h := range headers {
+		// duplex reads are named after both their parents
+		names := strings.Split(string(h.id), ";")
+		if len(h.parent) > 0 {
+			names = append(names, string(h.parent))
+		}
+		mine := false
+		for _, name := range names {
+			if _, ok := owner[name]; ok {
+				found[name], mine = true, true
+			}
+		}
+		if !mine {
+			foreign++
+		}
+	}
+	res.covered += int64(len(found))
+
+	missing := make([]int, len(files))
+	for id, i := range owner {
+		if !found[id] {
+			missing[i]++
+		}
+	}
+	for i, n := range missing {
+		if n > 0 {
+			a.problem("batch %d: %s reads of %s aren't in the archive", e.Batch, thousands(int64(n)), files[i])
+		}
+	}
+	// without their IDs the reads of the other files can only be counted
+	if len(byCount) > 0 {
+		if foreign < counted {
+			a.problem("batch %d holds %s reads besides those of its pod5s with read IDs, the footers of the rest count %s", e.Batch, thousands(foreign), thousands(counted))
+		} else {
+			res.covered += counted
+		}
+	} else if foreign > 0 {
+		a.problem("batch %d holds %s reads that aren't from its pod5s", e.Batch, thousands(foreign))
+	}
+	return byCount
+}
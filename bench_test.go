@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"testing"
+)
+
+// The paths of dbatch bench-pipe on the same synthetic fastq, in process and
+// without a compressor, so go test -bench measures the transfer code alone
+
+const benchBytes = 64 << 20
+
+// an os pipe the synthetic fastq is written into, like dorado's stdout
+func benchSource(b *testing.B) *os.File {
+	b.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		emitFastq(w, benchBytes)
+		w.Close()
+	}()
+	return r
+}
+
+func BenchmarkDirectPipe(b *testing.B) {
+	b.SetBytes(benchBytes)
+	for range b.N {
+		r := benchSource(b)
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkMonitoredCopy(b *testing.B) {
+	b.SetBytes(benchBytes)
+	for range b.N {
+		r := benchSource(b)
+		totals := make(chan pipeTotals, 1)
+		go chanMonitor(r, io.Discard, "", totals)
+		if t := <-totals; t.err != nil {
+			b.Fatal(t.err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkRingBuffer(b *testing.B) {
+	b.SetBytes(benchBytes)
+	for range b.N {
+		r := benchSource(b)
+		if _, err := ringCopy(io.Discard, r, 16); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
+
+func BenchmarkInProcessCompress(b *testing.B) {
+	b.SetBytes(benchBytes)
+	for range b.N {
+		r := benchSource(b)
+		w := bufio.NewWriterSize(io.Discard, zstdBlockSize)
+		if err := zstdStore(w, r); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dbatch bench-pipe measures the ways dorado's output can reach the compressor
+// and the output file on synthetic fastq, so changes to the transfer code are
+// measured rather than guessed:
+//
+//	direct      dorado | zstd, an os pipe between the two
+//	monitor     dorado | dbatch | zstd, the timed copy of -monitor-pressure and qc
+//	ring        dorado | dbatch | zstd, reads and writes decoupled by buffers
+//	in-process  dorado | dbatch, stored zstd frames written by dbatch itself
+//
+// A child of dbatch stands in for dorado, writing as fast as the pipe takes it.
+func benchPipeMain(args []string) {
+	fs := flag.NewFlagSet("bench-pipe", flag.ExitOnError)
+	size := fs.Float64("size-MB", 1024, "synthetic fastq pushed through each path")
+	runs := fs.Int("runs", 3, "runs of each path, the fastest counts")
+	paths := fs.String("paths", "direct,monitor,ring,in-process", "comma separated paths to measure")
+	compressor := fs.String("compressor", strings.Join(compressors[0], " "), "compressor command line, as -compress-level would run it")
+	ring := fs.Int("ring-buffers", 16, "buffers of 128kiB in the ring")
+	dir := fs.String("dir", os.TempDir(), "directory the outputs are written to and removed from, on the storage to measure")
+	emit := fs.Int64("emit", 0, "internal: write this many bytes of synthetic fastq to stdout")
+	fs.Parse(args)
+
+	if *emit > 0 {
+		if err := emitFastq(os.Stdout, *emit); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	bytes := int64(*size * (1 << 20))
+	zstd := strings.Fields(*compressor)
+	if len(zstd) == 0 {
+		log.Fatal("-compressor is empty")
+	}
+
+	fmt.Println("=============================================")
+	fmt.Printf("pushing %s of synthetic fastq through each path %d times, compressing with %s, to %s\n", bytesIEC(bytes), *runs, commandLine(command(zstd[0], zstd[1:]...)), *dir)
+	fmt.Println("=============================================")
+	fmt.Printf("%-12s %10s %10s %12s %12s %8s\n", "path", "time", "MiB/s", "read wait", "write wait", "ratio")
+	for _, path := range strings.Split(*paths, ",") {
+		path = strings.TrimSpace(path)
+		var best *benchResult
+		for range max(*runs, 1) {
+			r, err := benchPath(path, bytes, zstd, *ring, *dir)
+			if err != nil {
+				log.Fatalf("%s: %s", path, err)
+			}
+			if best == nil || r.took < best.took {
+				best = r
+			}
+		}
+		fmt.Printf("%-12s %10s %10.0f %12s %12s %8.2f\n", path, humanDuration(best.took),
+			float64(bytes)/(1<<20)/best.took.Seconds(), wait(best.totals.readTime), wait(best.totals.writeTime), float64(bytes)/float64(max(best.written, 1)))
+	}
+	fmt.Println("=============================================")
+	fmt.Println("read wait is dbatch waiting on dorado, write wait dbatch blocked on the compressor")
+}
+
+type benchResult struct {
+	took    time.Duration
+	written int64
+	totals  pipeTotals // of the copy through dbatch, none for direct
+}
+
+func wait(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return humanDuration(d)
+}
+
+// Run one path once, from the start of the stand-in dorado to the output
+// being complete
+func benchPath(path string, bytes int64, zstd []string, ring int, dir string) (*benchResult, error) {
+	out, err := os.CreateTemp(dir, "dbatch-bench-*.zst")
+	if err != nil {
+		return nil, fmt.Errorf("error creating output %w", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("error finding dbatch %w", err)
+	}
+	dorado := exec.Command(self, "bench-pipe", "-emit", strconv.FormatInt(bytes, 10))
+	dorado.Stderr = os.Stderr
+	doradoOut, err := dorado.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not get stdout %w", err)
+	}
+
+	var compressor *exec.Cmd
+	var sink io.WriteCloser
+	switch path {
+	case "direct", "monitor", "ring":
+		compressor = command(zstd[0], zstd[1:]...)
+		compressor.Stdout, compressor.Stderr = out, os.Stderr
+		if path == "direct" {
+			compressor.Stdin = doradoOut
+		} else if sink, err = compressor.StdinPipe(); err != nil {
+			return nil, fmt.Errorf("could not get compressor stdin %w", err)
+		}
+	case "in-process":
+	default:
+		return nil, fmt.Errorf("unknown path, use direct, monitor, ring or in-process")
+	}
+
+	r := &benchResult{}
+	started := time.Now()
+	if err := dorado.Start(); err != nil {
+		return nil, fmt.Errorf("error starting stand-in dorado %w", err)
+	}
+	if compressor != nil {
+		if err := compressor.Start(); err != nil {
+			return nil, fmt.Errorf("error starting compressor %w", err)
+		}
+	}
+	switch path {
+	case "monitor":
+		totals := make(chan pipeTotals, 1)
+		go chanMonitor(doradoOut, sink, "", totals)
+		r.totals = <-totals
+		err = r.totals.err
+		sink.Close()
+	case "ring":
+		r.totals, err = ringCopy(sink, doradoOut, ring)
+		sink.Close()
+	case "in-process":
+		w := bufio.NewWriterSize(out, zstdBlockSize)
+		if err = zstdStore(w, doradoOut); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := dorado.Wait(); err != nil {
+		return nil, fmt.Errorf("stand-in dorado error %w", err)
+	}
+	if compressor != nil {
+		if err := compressor.Wait(); err != nil {
+			return nil, fmt.Errorf("compressor error %w", err)
+		}
+	}
+	r.took = time.Since(started)
+	if info, err := out.Stat(); err == nil {
+		r.written = info.Size()
+	}
+	return r, nil
+}
+
+// Copy r to w through a ring of buffers, reading into the next free one while
+// earlier ones are written, so a slow write doesn't stop the reads until the
+// ring is full. The read and write waits are timed like chanMonitor's.
+func ringCopy(w io.Writer, r io.Reader, buffers int) (pipeTotals, error) {
+	type chunk struct {
+		buf []byte
+		n   int
+	}
+	free := make(chan []byte, buffers)
+	for range buffers {
+		free <- make([]byte, zstdBlockSize)
+	}
+	full := make(chan chunk, buffers)
+	readErr := make(chan error, 1)
+	var totals pipeTotals
+	go func() {
+		defer close(full)
+		for {
+			buf := <-free
+			mark := time.Now()
+			n, err := r.Read(buf)
+			totals.readTime += time.Since(mark)
+			if n > 0 {
+				full <- chunk{buf, n}
+			}
+			if err == io.EOF {
+				readErr <- nil
+				return
+			}
+			if err != nil {
+				readErr <- fmt.Errorf("error reading %w", err)
+				return
+			}
+		}
+	}()
+	var writeErr error
+	for c := range full {
+		if writeErr == nil {
+			mark := time.Now()
+			_, writeErr = w.Write(c.buf[:c.n])
+			totals.writeTime += time.Since(mark)
+			totals.bytes += int64(c.n)
+		}
+		free <- c.buf
+	}
+	if err := <-readErr; err != nil {
+		return totals, err
+	}
+	if writeErr != nil {
+		return totals, fmt.Errorf("error writing %w", writeErr)
+	}
+	return totals, nil
+}
+
+// Write n bytes of simulated reads, a block of them made once and repeated so
+// making them never holds up the pipe
+func emitFastq(w io.Writer, n int64) error {
+	var block strings.Builder
+	bw := bufio.NewWriter(&block)
+	rng := rand.New(rand.NewPCG(1, 1))
+	for block.Len()+bw.Buffered() < 16<<20 {
+		writeSimulatedRead(bw, rng, 2000+rng.IntN(12000))
+	}
+	bw.Flush()
+	data := []byte(block.String())
+	for n > 0 {
+		m, err := w.Write(data[:min(int64(len(data)), n)])
+		if err != nil {
+			return err
+		}
+		n -= int64(m)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// descriptors a child process costs dbatch, its pipes and the files around it
+const fdsPerChild = 8
+
+// descriptors kept back for the state db, logs, metrics and the http servers
+const fdReserve = 64
+
+// childBudget caps the child processes running at once across every pipeline,
+// compressor, spot check and hook, so a busy node queues work rather than
+// running past its open file limit. A pipeline asks for all of its processes
+// at once, so two half started pipelines never wait on each other.
+type childBudget struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int // 0 for no limit
+	running int
+	waiting int
+}
+
+// shared by everything in the process, set once the run flags are parsed
+var slots = newChildBudget()
+
+func newChildBudget() *childBudget {
+	c := &childBudget{}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// -max-children, or with 0 as many as the open file limit leaves room for
+func (c *childBudget) setLimit(limit int) {
+	if limit == 0 {
+		if fds := fdLimit(); fds > 0 {
+			limit = int(max(1, (fds-fdReserve)/fdsPerChild))
+		}
+	}
+	c.mu.Lock()
+	c.limit = limit
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// Wait until n more children may run and return the function that gives the
+// slots back. A pipeline larger than the whole budget runs once nothing else does.
+func (c *childBudget) hold(n int) func() {
+	c.mu.Lock()
+	if c.limit > 0 && c.running > 0 && c.running+n > c.limit {
+		fmt.Printf("waiting for %d child process slots, %d of %d in use\n", n, c.running, c.limit)
+		c.waiting++
+		metrics.set("dbatch_children_waiting", float64(c.waiting))
+		for c.running > 0 && c.running+n > c.limit {
+			c.cond.Wait()
+		}
+		c.waiting--
+		metrics.set("dbatch_children_waiting", float64(c.waiting))
+	}
+	c.running += n
+	c.gauge()
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.running -= n
+			c.gauge()
+			c.mu.Unlock()
+			c.cond.Broadcast()
+		})
+	}
+}
+
+// c.mu must be held
+func (c *childBudget) gauge() {
+	metrics.set("dbatch_children_running", float64(c.running))
+	if fds := openFDs(); fds >= 0 {
+		metrics.set("dbatch_open_fds", float64(fds))
+	}
+}
+
+// descriptors open in dbatch, -1 where /proc isn't there to count them
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
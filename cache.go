@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A copy of input files on fast local storage, e.g. NVMe, so retries and runs
+// re-basecalling the same data with another model read it from there rather
+// than from the network share. Files are keyed by path, size and mtime, and
+// the least recently used are evicted to keep the cache under its limit.
+type pod5Cache struct {
+	dir   string
+	limit int64 // bytes, 0 for unlimited
+
+	mu     sync.Mutex
+	hits   int
+	copied int
+	refs   map[string]int // files staged chunks link to, by chunk, never evicted
+}
+
+const cacheTmp = ".partial"
+
+func newPod5Cache(dir string, limitGB float64) (*pod5Cache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("error making cache directory %w", err)
+	}
+	return &pod5Cache{dir: dir, limit: int64(limitGB * (1 << 30)), refs: map[string]int{}}, nil
+}
+
+// Path of the cached copy of path, copied in first if it isn't cached yet. It
+// is held for the chunk until release.
+func (c *pod5Cache) get(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s %w", path, err)
+	}
+	sum := sha256.Sum256([]byte(path + "\x00" + strconv.FormatInt(info.Size(), 10) + "\x00" + info.ModTime().UTC().String()))
+	cached := filepath.Join(c.dir, hex.EncodeToString(sum[:8])+"-"+filepath.Base(path))
+	if err := c.fill(cached, func() error { return copyFile(path, cached) }); err != nil {
+		return "", err
+	}
+	return cached, nil
+}
+
+// Hold cached before looking for it, so another pipeline evicting can't remove
+// it in between, and copy it in with fetch if it isn't there
+func (c *pod5Cache) fill(cached string, fetch func() error) error {
+	c.mu.Lock()
+	c.refs[cached]++
+	c.mu.Unlock()
+
+	now := time.Now()
+	if os.Chtimes(cached, now, now) == nil {
+		c.mu.Lock()
+		c.hits++
+		c.mu.Unlock()
+		return nil
+	}
+	if err := fetch(); err != nil {
+		c.release([]string{cached})
+		return err
+	}
+	c.mu.Lock()
+	c.copied++
+	c.mu.Unlock()
+	return nil
+}
+
+// Let the chunk's files go once it is done with them
+func (c *pod5Cache) release(cached []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, path := range cached {
+		if c.refs[path]--; c.refs[path] <= 0 {
+			delete(c.refs, path)
+		}
+	}
+}
+
+// copy through a partial file so a copy cut short is never mistaken for a hit
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s %w", src, err)
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*"+cacheTmp)
+	if err != nil {
+		return fmt.Errorf("error creating cache file %w", err)
+	}
+	tmp.Chmod(0644)
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error caching %s %w", src, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error caching %s %w", src, err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error caching %s %w", src, err)
+	}
+	return nil
+}
+
+// Remove the least recently used files until the cache fits its limit. Files
+// a chunk of any pipeline is staged from are never evicted.
+func (c *pod5Cache) evict() {
+	if c.limit <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		fmt.Printf("error reading cache directory %s\n", err)
+		return
+	}
+	type cachedFile struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []cachedFile
+	var total int64
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasSuffix(e.Name(), cacheTmp) {
+			continue
+		}
+		files = append(files, cachedFile{filepath.Join(c.dir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	slices.SortFunc(files, func(a, b cachedFile) int { return a.used.Compare(b.used) })
+
+	for _, f := range files {
+		if total <= c.limit {
+			return
+		}
+		if c.refs[f.path] > 0 {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			fmt.Printf("error evicting %s\n", err)
+			continue
+		}
+		total -= f.size
+	}
+	if total > c.limit {
+		fmt.Printf("warning: pod5 cache holds %s, over its limit, the chunks staged don't fit\n", bytesIEC(total))
+	}
+}
+
+func (c *pod5Cache) print() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Printf("pod5 cache %s: %d files read from the cache, %d copied in\n", c.dir, c.hits, c.copied)
+}
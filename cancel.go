@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errCanceled = errors.New("canceled")
+
+const jobCanceled = "canceled"
+
+// POST /runs/{id}/cancel drops a queued run from the queue. A running or
+// preempted one stops at its next batch boundary, keeping what it basecalled
+// and writing its manifest and report, and the gpu goes to the next run.
+// Other runs in the queue keep their place.
+func (d *daemon) cancel(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var j *job
+	for _, found := range d.jobs {
+		if found.ID == r.PathValue("id") {
+			j = found
+		}
+	}
+	switch {
+	case j == nil:
+		http.Error(w, "no run "+r.PathValue("id"), http.StatusNotFound)
+		return
+	case !j.active():
+		http.Error(w, fmt.Sprintf("%s is already %s", j.ID, j.Status), http.StatusConflict)
+		return
+	case j.Status == jobQueued:
+		j.Status = jobCanceled
+		fmt.Printf("canceled %s before it started\n", j.ID)
+	default:
+		j.Canceled = true
+		// a preempted run wakes up to stop
+		d.cond.Broadcast()
+		fmt.Printf("canceling %s at its next batch boundary\n", j.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// whether the run of j was asked to stop
+func (d *daemon) canceled(j *job) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return j.Canceled
+}
+
+// Stop at a batch boundary if the run was canceled, the error says where
+func (b *batch) checkCanceled() error {
+	if b.canceled == nil || !b.canceled() {
+		return nil
+	}
+	return fmt.Errorf("%w after %d of %d files", errCanceled, b.next, b.pod5s.len())
+}
+
+// dbatch cancel run-3 cancels a run queued on or running in a daemon
+func cancelMain(args []string) {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	server := fs.String("server", os.Getenv("DBATCH_SERVER"), "daemon to talk to, e.g. http://gpu1:8080, default $DBATCH_SERVER")
+	token := fs.String("token", os.Getenv("DBATCH_TOKEN"), "bearer token of the daemon, default $DBATCH_TOKEN")
+	fs.Parse(args)
+
+	if *server == "" || fs.NArg() != 1 {
+		fmt.Println("usage: dbatch cancel -server http://host:8080 run-3")
+		fs.PrintDefaults()
+		return
+	}
+	c := &remoteClient{server: strings.TrimSuffix(*server, "/"), token: *token}
+	if err := c.cancel(fs.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *remoteClient) cancel(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dbatch remote cancel run-1")
+	}
+	var j job
+	if err := c.do("POST", "/runs/"+args[0]+"/cancel", nil, &j); err != nil {
+		return err
+	}
+	if j.Status == jobCanceled {
+		fmt.Printf("%s canceled\n", j.ID)
+	} else {
+		fmt.Printf("%s stops at its next batch boundary\n", j.ID)
+	}
+	return nil
+}
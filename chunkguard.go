@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// A -chunk far too small for the model spends most of every batch loading
+// the model and staging. Once a few batches are done their timings show it:
+// the run warns with the share of the time lost and the -chunk that would
+// bring it down, and with -coalesce-chunks plans the rest at that size.
+const (
+	chunkGuardBatches = 2   // batches done before judging
+	tinyChunkOverhead = 0.5 // share of a batch spent on overhead that is too much
+	coalescedOverhead = 0.1 // share coalesced chunks aim for
+)
+
+// Judge -chunk once, from the batches basecalled so far
+func (b *batch) checkChunkSize() {
+	if b.chunkChecked {
+		return
+	}
+	var overhead, basecall float64
+	var files, n int
+	for _, rec := range b.state.Batches {
+		if !rec.Done || rec.Timings == nil || rec.Reused {
+			continue
+		}
+		overhead += rec.Timings.Staging + rec.Timings.Startup + rec.Timings.Tail
+		basecall += rec.Timings.Basecall
+		files += len(rec.Files)
+		n++
+	}
+	if n < chunkGuardBatches {
+		return
+	}
+	b.chunkChecked = true
+	share := overhead / (overhead + basecall)
+	if share < tinyChunkOverhead || basecall <= 0 {
+		return
+	}
+	// fixed overhead per batch against basecalling time per file
+	perBatch, perFile := overhead/float64(n), basecall/float64(files)
+	suggested := int(math.Ceil(perBatch / perFile * (1 - coalescedOverhead) / coalescedOverhead))
+	// no bigger than the whole input
+	suggested = min(suggested, b.pod5s.len())
+	if suggested <= b.chunk {
+		return
+	}
+	fmt.Printf("warning: batches spend %.0f%% of their time on model load, staging and tail (%s of %s each), -chunk %d would bring it to about %.0f%%\n",
+		100*share, seconds(perBatch), seconds(perBatch+perFile*float64(files)/float64(n)), suggested, 100*perBatch/(perBatch+perFile*float64(suggested)))
+	b.audit.record(b.out, "chunk_too_small", map[string]any{"chunk": b.chunk, "overhead": share, "suggested": suggested})
+	if !b.coalesce {
+		return
+	}
+	// shards and debugging runs keep their plan, priority chunks stay apart
+	if b.shards > 1 || b.pinned() || b.next < b.priorityFiles || b.next >= b.pod5s.len() {
+		return
+	}
+	left := len(b.plan) - b.nextChunk
+	b.chunk = suggested
+	b.replanChunks()
+	fmt.Printf("coalesced the %s files left from %d batches into %d of up to %d files\n",
+		thousands(int64(b.pod5s.len()-b.next)), left, len(b.plan)-b.nextChunk, b.chunk)
+	b.audit.record(b.out, "chunk_coalesced", map[string]any{"chunk": b.chunk, "batches": len(b.plan) - b.nextChunk})
+}
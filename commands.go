@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// words that read the same unquoted in a shell
+var plainWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// The command lines of a batch's children as they run, dorado first, in the
+// state db and the manifest so a batch can be reproduced outside dbatch. The
+// values of -env and the credentials of urls are left out, to be given again.
+func (b *batch) commandLines(dorado *exec.Cmd, dc *decontamStage, zstd *exec.Cmd) []string {
+	cmds := []string{commandLine(dorado)}
+	if dc != nil {
+		cmds = append(cmds, commandLine(dc.minimap2))
+		if dc.host != nil {
+			cmds = append(cmds, commandLine(dc.host))
+		}
+	}
+	if zstd != nil {
+		cmds = append(cmds, commandLine(zstd))
+	}
+	// -per-batch compresses the spooled batch once it is done
+	if b.pool != nil && b.format != formatBAM {
+		cmds = append(cmds, commandLine(command(compressors[0][0], compressors[0][1:]...)))
+	}
+	return cmds
+}
+
+// cmd as a shell command line, with the names of the -env overrides in front
+func commandLine(cmd *exec.Cmd) string {
+	words := make([]string, 0, len(childEnv)+len(cmd.Args))
+	for _, kv := range childEnv {
+		k, _, _ := strings.Cut(kv, "=")
+		words = append(words, k+"=<set>")
+	}
+	words = append(words, quoteWord(cmd.Path))
+	for _, arg := range cmd.Args[1:] {
+		words = append(words, quoteWord(withoutCredentials(arg)))
+	}
+	return strings.Join(words, " ")
+}
+
+// an argument with the credentials of a url in it, or of one after name=, removed
+func withoutCredentials(arg string) string {
+	if s, ok := stripCredentials(arg); ok {
+		return s
+	}
+	if k, v, ok := strings.Cut(arg, "="); ok {
+		if s, ok := stripCredentials(v); ok {
+			return k + "=" + s
+		}
+	}
+	return arg
+}
+
+func quoteWord(s string) string {
+	if plainWord.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Compressor settings from cheapest to fastest. A run starts on the first
+// entry and moves down the list while compression is holding dorado up.
+var compressors = [][]string{
+	{"zstd"},
+	{"zstd", "-1", "-T0"},
+	{"pzstd", "-1"},
+}
+
+// Decide from a measured batch whether compression is the bottleneck. If the
+// monitor spent longer blocked writing to the compressor than waiting on dorado,
+// dorado was stalled on a full pipe and the GPU sat idle.
+func (b *batch) adjustCompressor(t pipeTotals) {
+	if t.writeTime <= t.readTime {
+		b.compressSettled = true
+		return
+	}
+
+	fmt.Printf("compression is the bottleneck: %s blocked writing to %s vs %s waiting on dorado\n",
+		humanDuration(t.writeTime), strings.Join(compressors[b.compressLevel], " "), humanDuration(t.readTime))
+
+	for next := b.compressLevel + 1; next < len(compressors); next++ {
+		if _, err := exec.LookPath(compressors[next][0]); err != nil {
+			continue
+		}
+		b.compressLevel = next
+		fmt.Printf("escalating compressor to %s\n", strings.Join(compressors[next], " "))
+		return
+	}
+
+	fmt.Println("warning: no faster compressor available, dorado will be GPU-starved for the rest of the run")
+	b.compressSettled = true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A config file holds run flags as a flat yaml subset, one "flag: value" per
+// line, with the environment for child processes in an env section:
+//
+//	model: sup
+//	chunk: 100
+//	env:
+//	  CUDA_VISIBLE_DEVICES: 0,1
+//	  OMP_NUM_THREADS: 8
+//
+// Repeatable flags such as label can be given more than once.
+type configEntry struct {
+	key, value string
+	line       int
+}
+
+func readConfig(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config %w", err)
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	section := ""
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.Index(text, " #"); i >= 0 {
+			text = text[:i]
+		}
+		if t := strings.TrimSpace(text); t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		indented := text[0] == ' ' || text[0] == '\t'
+		key, value, ok := strings.Cut(strings.TrimSpace(text), ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key: value", path, line)
+		}
+		key, value = strings.TrimSpace(key), unquote(strings.TrimSpace(value))
+
+		switch {
+		case !indented && value == "":
+			section = key
+			if section != "env" {
+				return nil, fmt.Errorf("%s:%d: unknown section %s", path, line, key)
+			}
+		case indented && section == "env":
+			entries = append(entries, configEntry{"env", key + "=" + value, line})
+		case indented:
+			return nil, fmt.Errorf("%s:%d: indented line outside a section", path, line)
+		default:
+			section = ""
+			entries = append(entries, configEntry{key, value, line})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading config %w", err)
+	}
+	return entries, nil
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// flag values holding key=value pairs, like -label and -env
+type keyedFlag interface {
+	has(key string) bool
+}
+
+// Set the flags of fs from a config file, leaving those given on the command
+// line alone
+func applyConfig(fs *flag.FlagSet, path string) error {
+	entries, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, e := range entries {
+		if e.key == "config" {
+			return fmt.Errorf("%s:%d: config files can't include others", path, e.line)
+		}
+		if fs.Lookup(e.key) == nil {
+			return fmt.Errorf("%s:%d: unknown flag %s", path, e.line, e.key)
+		}
+		// repeatable flags merge, keeping the keys given on the command line
+		if m, ok := fs.Lookup(e.key).Value.(keyedFlag); ok {
+			key, _, _ := strings.Cut(e.value, "=")
+			if m.has(key) {
+				continue
+			}
+		} else if given[e.key] {
+			continue
+		}
+		if err := fs.Set(e.key, e.value); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, e.line, err)
+		}
+	}
+	return nil
+}
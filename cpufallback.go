@@ -0,0 +1,78 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"time"
+)
+
+// -cpu-fallback keeps an overnight run going when its GPU is gone or keeps
+// failing. Once -device-failures attempts in a row fail with GPU errors the
+// rest of the plan is basecalled with -x cpu, many times slower but still
+// making progress, rather than the run aborting. With -devices only the last
+// healthy device falls back, the others hand their chunks over as usual.
+type cpuFallback struct {
+	enabled  bool
+	failures int // attempts in a row that failed with gpu errors
+	// files per second through dorado on the gpu, and whether the cpu rate
+	// was reported yet
+	gpuRate float64
+	rated   bool
+}
+
+// Count an attempt that failed, returning whether it should be retried
+// without counting against -retries: on the gpu again, or now on the cpu
+func (b *batch) gpuAttemptFailed(index int, err error) bool {
+	if !b.cpu.enabled || b.device == "cpu" || len(b.devices) > 1 || !deviceErrorPattern.MatchString(b.lastStderr) {
+		return false
+	}
+	b.cpu.failures++
+	if b.cpu.failures < b.deviceFailures {
+		fmt.Printf("batch %d failed with a gpu error, %d of %d before falling back to the cpu: %s\n", index, b.cpu.failures, b.deviceFailures, err)
+		return true
+	}
+	b.fallBackToCPU(err)
+	return true
+}
+
+// Basecall everything from here on with -x cpu
+func (b *batch) fallBackToCPU(err error) {
+	// dorado's default
+	gpu := cmp.Or(b.device, "cuda:all")
+	var files int
+	var seconds float64
+	for _, rec := range b.state.Batches {
+		if rec.Done && rec.Timings != nil {
+			files += len(rec.Files)
+			seconds += rec.Timings.took()
+		}
+	}
+	if seconds > 0 {
+		b.cpu.gpuRate = float64(files) / seconds
+	}
+	b.device = "cpu"
+	b.cpu.failures = 0
+
+	fmt.Println("=============================================")
+	fmt.Printf("warning: %s keeps failing, basecalling the rest of the run on the cpu: %s\n", gpu, err)
+	fmt.Println("expect a small fraction of gpu throughput, the rate is reported after the first cpu batch")
+	fmt.Println("=============================================")
+	metrics.set("dbatch_cpu_fallback", 1)
+	b.audit.record(b.out, "cpu_fallback", map[string]any{"device": b.device, "from": gpu, "error": err.Error()})
+}
+
+// Once the first batch is done on the cpu, say how fast it goes and what
+// that means for the rest of the run
+func (b *batch) reportCPURate(rec *batchRecord, filesLeft int) {
+	if b.device != "cpu" || !b.cpu.enabled || b.cpu.rated || rec == nil || rec.Timings == nil || rec.Timings.took() <= 0 {
+		return
+	}
+	b.cpu.rated = true
+	rate := float64(len(rec.Files)) / rec.Timings.took()
+	msg := fmt.Sprintf("cpu basecalling runs at %.2f files/s", rate)
+	if b.cpu.gpuRate > 0 {
+		msg += fmt.Sprintf(", %.0fx slower than the gpu's %.2f", b.cpu.gpuRate/rate, b.cpu.gpuRate)
+	}
+	left := time.Duration(float64(filesLeft) / rate * float64(time.Second))
+	fmt.Printf("%s, about %s for the %s files left\n", msg, humanDuration(left), thousands(int64(filesLeft)))
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A run submitted to the daemon
+type job struct {
+	ID        string    `json:"id"`
+	In        string    `json:"in"`
+	Out       string    `json:"out"`
+	Profile   string    `json:"profile,omitempty"`
+	Labels    labels    `json:"labels,omitempty"`
+	User      string    `json:"user,omitempty"`     // who submitted it, set by dbatch remote
+	Priority  bool      `json:"priority,omitempty"` // preempts the running job at its next batch boundary
+	Weight    int       `json:"weight,omitempty"`   // batches per turn with -schedule fair, default 1
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	// asked to stop at its next batch boundary, see cancel.go
+	Canceled bool `json:"cancel_requested,omitempty"`
+	// rolling estimate from the reads streaming out of dorado, with -live-qc
+	Live *liveSummary `json:"live_qc,omitempty"`
+
+	turnBatches int // batches basecalled since it last got the gpu
+	live        *liveQC
+}
+
+// jobRequest is what a client submits, the rest of a job is the daemon's
+type jobRequest struct {
+	In       string `json:"in"`
+	Out      string `json:"out"`
+	Profile  string `json:"profile,omitempty"`
+	Labels   labels `json:"labels,omitempty"`
+	User     string `json:"user,omitempty"`
+	Priority bool   `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+}
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobPaused  = "preempted"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+const (
+	scheduleFIFO = "fifo"
+	scheduleFair = "fair"
+)
+
+// The daemon basecalls one job at a time. Every started job runs in its own
+// goroutine and waits at batch boundaries until the scheduler hands it the
+// gpu, in submission order or taking turns with -schedule fair. Priority jobs
+// go first either way.
+type daemon struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	jobs     []*job
+	seq      int
+	turn     *job // job allowed to basecall
+	last     *job // job that had the last turn, fair scheduling carries on after it
+	schedule string
+	build    func() (*batch, error)
+	profile  labels // profile name -> dorado model
+	token    string
+}
+
+// dbatch daemon listens for runs posted by e.g. a LIMS when sequencing finishes
+func daemonMain(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "address to accept runs on, e.g. :8080 for every interface, with -token")
+	token := fs.String("token", "", "require this bearer token on every request")
+	profiles := labels{}
+	fs.Var(profiles, "profile", "name=model, a profile runs can select, can be repeated. Without profiles a run's profile is used as the model")
+	metricsPath := fs.String("metrics", "", "write prometheus metrics to this file")
+	schedule := fs.String("schedule", scheduleFIFO, "fifo runs jobs in submission order, fair alternates batches between queued jobs")
+	build := runFlags(fs)
+	fs.Parse(args)
+
+	if _, err := build(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *schedule != scheduleFIFO && *schedule != scheduleFair {
+		log.Fatalf("unknown schedule %s, use fifo or fair", *schedule)
+	}
+
+	d := &daemon{build: build, profile: profiles, token: *token, schedule: *schedule}
+	d.cond = sync.NewCond(&d.mu)
+
+	metrics.start(*metricsPath, 10*time.Second)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /runs", d.guard(d.submit))
+	mux.HandleFunc("GET /runs", d.guard(d.list))
+	mux.HandleFunc("GET /runs/{id}", d.guard(d.status))
+	mux.HandleFunc("GET /runs/{id}/report", d.guard(d.report))
+	mux.HandleFunc("POST /runs/{id}/cancel", d.guard(d.cancel))
+
+	fmt.Printf("accepting runs on %s\n", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
+
+// whether the request carries the -token, if one is required
+func (d *daemon) authorized(r *http.Request) bool {
+	return d.token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+d.token)) == 1
+}
+
+// every route lists or changes runs, their paths and errors, so all need the token
+func (d *daemon) guard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// POST /runs {"in": "...", "out": "...", "profile": "sup", "priority": true}
+func (d *daemon) submit(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad run description: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	j := &job{In: req.In, Out: req.Out, Profile: req.Profile, Labels: req.Labels, User: req.User, Priority: req.Priority, Weight: req.Weight}
+	if j.In == "" || j.Out == "" {
+		http.Error(w, "in and out are required", http.StatusBadRequest)
+		return
+	}
+	// url inputs are listed when the run starts
+	if _, err := os.Stat(j.In); err != nil && !isURL(j.In) {
+		http.Error(w, "input not accessible: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := d.profile[j.Profile]; j.Profile != "" && len(d.profile) > 0 && !ok {
+		http.Error(w, "unknown profile "+j.Profile, http.StatusBadRequest)
+		return
+	}
+	if j.Weight < 0 {
+		http.Error(w, "weight must be positive", http.StatusBadRequest)
+		return
+	}
+	for k := range j.Labels {
+		if !labelKey.MatchString(k) {
+			http.Error(w, "bad label key "+k, http.StatusBadRequest)
+			return
+		}
+	}
+
+	d.mu.Lock()
+	d.seq++
+	j.ID = "run-" + strconv.Itoa(d.seq)
+	j.Status = jobQueued
+	j.Submitted = time.Now().UTC()
+	d.jobs = append(d.jobs, j)
+	if d.turn == nil {
+		d.next()
+	}
+	d.mu.Unlock()
+
+	if j.Priority {
+		fmt.Printf("queued %s with priority: %s -> %s\n", j.ID, j.In, j.Out)
+	} else {
+		fmt.Printf("queued %s: %s -> %s\n", j.ID, j.In, j.Out)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	json.NewEncoder(w).Encode(j)
+}
+
+// GET /runs
+func (d *daemon) list(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.jobs)
+}
+
+func (d *daemon) find(id string) (job, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, j := range d.jobs {
+		if j.ID == id {
+			found := *j
+			if j.live != nil && j.active() {
+				s := j.live.summary()
+				found.Live = &s
+			}
+			return found, true
+		}
+	}
+	return job{}, false
+}
+
+// GET /runs/{id}
+func (d *daemon) status(w http.ResponseWriter, r *http.Request) {
+	j, ok := d.find(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no run "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+}
+
+// what GET /runs/{id}/report returns, read from the run's state db and qc report
+type runReport struct {
+	Run     job       `json:"run"`
+	Batches int       `json:"batches"`
+	Done    int       `json:"done"`
+	Failed  []int     `json:"failed,omitempty"`
+	Notes   []note    `json:"notes,omitempty"`
+	QC      *qcReport `json:"qc,omitempty"`
+}
+
+// GET /runs/{id}/report
+func (d *daemon) report(w http.ResponseWriter, r *http.Request) {
+	j, ok := d.find(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no run "+r.PathValue("id"), http.StatusNotFound)
+		return
+	}
+	rep := runReport{Run: j}
+	// nothing to read yet for a queued run
+	if state, err := loadRunState(statePath(j.Out)); err == nil {
+		rep.Batches = len(state.Batches)
+		rep.Notes = state.Notes
+		for _, rec := range state.Batches {
+			switch {
+			case rec.Done:
+				rep.Done++
+			case rec.Error != "":
+				rep.Failed = append(rep.Failed, rec.Index)
+			}
+		}
+	}
+	if data, err := os.ReadFile(qcPath(j.Out)); err == nil {
+		qc := new(qcReport)
+		if json.Unmarshal(data, qc) == nil {
+			rep.QC = qc
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+func (d *daemon) start(j *job) {
+	err := d.runJob(j)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j.Status = jobDone
+	if errors.Is(err, errCanceled) {
+		j.Status = jobCanceled
+		fmt.Printf("%s canceled: %s\n", j.ID, err)
+	} else if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+		fmt.Printf("%s failed: %s\n", j.ID, err)
+	}
+	if d.turn == j {
+		d.turn = nil
+	}
+	d.next()
+}
+
+// Hand the gpu to whichever job should basecall next, starting it if it
+// hasn't run yet. d.mu must be held.
+func (d *daemon) next() {
+	j := d.pick()
+	if j == d.turn {
+		return
+	}
+	if d.turn != nil {
+		d.last = d.turn
+	}
+	d.turn = j
+	if j == nil {
+		return
+	}
+	j.turnBatches = 0
+	if j.Status == jobQueued {
+		j.Status = jobRunning
+		go d.start(j)
+	}
+	d.cond.Broadcast()
+}
+
+func (j *job) active() bool {
+	return j.Status == jobQueued || j.Status == jobRunning || j.Status == jobPaused
+}
+
+// the job that should have the gpu, d.mu must be held
+func (d *daemon) pick() *job {
+	var first *job
+	for _, j := range d.jobs {
+		if !j.active() {
+			continue
+		}
+		// priority jobs are taken in submission order and aren't preempted
+		if j.Priority {
+			return j
+		}
+		if first == nil {
+			first = j
+		}
+	}
+	if first == nil || d.schedule == scheduleFIFO {
+		return first
+	}
+
+	cur := d.turn
+	if cur == nil {
+		cur = d.last
+	}
+	if cur == nil {
+		return first
+	}
+	if cur.active() && cur.turnBatches < max(cur.Weight, 1) {
+		return cur
+	}
+	// round robin: the next active job after cur, wrapping around
+	i := slices.Index(d.jobs, cur)
+	for k := 1; k <= len(d.jobs); k++ {
+		if j := d.jobs[(i+k)%len(d.jobs)]; j.active() {
+			return j
+		}
+	}
+	return first
+}
+
+// Called by a running job between batches. If the scheduler gives the gpu
+// to another job, wait until it's this job's turn again and carry on with
+// the plan.
+func (d *daemon) yield(j *job, b *batch) {
+	d.mu.Lock()
+	if j.Canceled {
+		d.mu.Unlock()
+		return
+	}
+	j.turnBatches++
+	d.next()
+	if d.turn == j {
+		d.mu.Unlock()
+		return
+	}
+	by := d.turn
+	j.Status = jobPaused
+	fmt.Printf("%s paused for %s\n", j.ID, by.ID)
+	b.audit.record(b.out, "run_preempted", map[string]any{"by": by.ID})
+	for d.turn != j && !j.Canceled {
+		d.cond.Wait()
+	}
+	j.Status = jobRunning
+	if j.Canceled {
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+
+	fmt.Printf("resuming %s\n", j.ID)
+	b.audit.record(b.out, "run_resumed", nil)
+	metrics.setLabels(b.redact.labelSet(b.labels))
+}
+
+func (d *daemon) runJob(j *job) error {
+	// build applies the flags, config and env to the state the flags share,
+	// one job at a time
+	d.mu.Lock()
+	b, err := d.build()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	b.in, b.out = j.In, j.Out
+	if j.Profile != "" {
+		b.model = j.Profile
+		if model, ok := d.profile[j.Profile]; ok {
+			b.model = model
+		}
+	}
+	for k, v := range j.Labels {
+		b.labels[k] = v
+	}
+	if b.dpath == "" {
+		return fmt.Errorf("no dorado configured, start the daemon with -dorado")
+	}
+	// a paused job keeps its working directory while others run, in its own
+	// run directory unless -tmp is shared
+	if b.tmp != "" {
+		b.tmp += "-" + j.ID
+	}
+	b.yield = func() { d.yield(j, b) }
+	b.canceled = func() bool { return d.canceled(j) }
+	if b.qc != nil && b.qc.live != nil {
+		d.mu.Lock()
+		j.live = b.qc.live
+		d.mu.Unlock()
+	}
+
+	fmt.Printf("starting %s\n", j.ID)
+	return b.run()
+}
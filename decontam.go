@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// decontam aligns reads against a host/contaminant reference with minimap2 and
+// removes matching reads from the stream before it reaches the archive
+type decontam struct {
+	ref     string
+	threads int
+	keep    string // host reads are appended here, compressed, instead of being dropped
+
+	removed int64
+}
+
+// decontamStage is one batch worth of minimap2 in front of the archive
+type decontamStage struct {
+	d        *decontam
+	minimap2 *exec.Cmd
+	in       io.WriteCloser
+	done     chan error
+	removed  int64 // by the filter, added to the run's once it is done
+
+	host     *exec.Cmd
+	hostIn   io.WriteCloser
+	hostFile *os.File
+	hostFrom int64 // where the batch's host reads start in hostFile
+}
+
+// Start minimap2 for a batch. Fastq written to the stage is aligned and reads
+// without a primary alignment are written on to w as fastq.
+func (d *decontam) start(w io.Writer) (*decontamStage, error) {
+	s := &decontamStage{d: d, done: make(chan error, 1)}
+
+	// -y carries the fastq comment through as SAM tags so headers survive
+	s.minimap2 = command("minimap2", "-a", "-y", "-x", "map-ont", "--secondary=no",
+		"-t", strconv.Itoa(d.threads), d.ref, "-")
+	s.minimap2.Stderr = os.Stderr
+
+	var err error
+	s.in, err = s.minimap2.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not get minimap2 stdin %w", err)
+	}
+	sam, err := s.minimap2.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not get minimap2 stdout %w", err)
+	}
+
+	var host io.Writer = io.Discard
+	if d.keep != "" {
+		if host, err = s.startHost(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.minimap2.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start minimap2: %w", err)
+	}
+
+	go func() {
+		err := s.filter(sam, w, host)
+		if err != nil {
+			// minimap2 would block on a full pipe and never exit
+			io.Copy(io.Discard, sam)
+		}
+		s.done <- err
+	}()
+	return s, nil
+}
+
+// compress host reads into their own output
+func (s *decontamStage) startHost() (io.Writer, error) {
+	var err error
+	s.hostFile, err = os.OpenFile(s.d.keep, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening host read file %w", err)
+	}
+	if info, err := s.hostFile.Stat(); err == nil {
+		s.hostFrom = info.Size()
+	}
+	perms.set(s.d.keep)
+	s.host = command(compressors[0][0], compressors[0][1:]...)
+	s.host.Stdout = s.hostFile
+	s.host.Stderr = os.Stderr
+	s.hostIn, err = s.host.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not get host compressor stdin %w", err)
+	}
+	if err := s.host.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start host compressor: %w", err)
+	}
+	return s.hostIn, nil
+}
+
+func (s *decontamStage) Write(p []byte) (int, error) {
+	return s.in.Write(p)
+}
+
+// Close the input and wait for every filtered read to be written on. The host
+// compressor is waited for even when minimap2 failed, so none is left behind.
+func (s *decontamStage) Close() error {
+	s.in.Close()
+	filterErr := <-s.done
+	var errs []error
+	if err := s.minimap2.Wait(); err != nil {
+		errs = append(errs, fmt.Errorf("minimap2 error: %w", err))
+	}
+	errs = append(errs, filterErr)
+	if s.host != nil {
+		s.hostIn.Close()
+		if err := s.host.Wait(); err != nil {
+			errs = append(errs, fmt.Errorf("host compressor error: %w", err))
+		}
+		if errors.Join(errs...) != nil {
+			// the batch is basecalled again, and its host reads with it
+			s.hostFile.Truncate(s.hostFrom)
+		}
+		if err := s.hostFile.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing host read file %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	s.d.removed += s.removed
+	return nil
+}
+
+// Convert SAM records back to fastq, unaligned reads go to keep and aligned to host
+func (s *decontamStage) filter(sam io.Reader, keep, host io.Writer) error {
+	sc := bufio.NewScanner(sam)
+	sc.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	kw, hw := bufio.NewWriter(keep), bufio.NewWriter(host)
+
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 || line[0] == '@' {
+			continue
+		}
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) < 11 {
+			return fmt.Errorf("malformed minimap2 output line %q", line)
+		}
+		flag, err := strconv.Atoi(string(fields[1]))
+		if err != nil {
+			return fmt.Errorf("malformed minimap2 flag %q", fields[1])
+		}
+		// secondary and supplementary
+		if flag&0x900 != 0 {
+			continue
+		}
+
+		w := kw
+		if flag&0x4 == 0 {
+			w = hw
+			s.removed++
+		}
+		seq, qual := fields[9], fields[10]
+		if flag&0x10 != 0 {
+			seq, qual = reverseComplement(seq), reverse(qual)
+		}
+
+		w.WriteByte('@')
+		w.Write(fields[0])
+		for _, tag := range fields[11:] {
+			w.WriteByte('\t')
+			w.Write(tag)
+		}
+		w.WriteByte('\n')
+		w.Write(seq)
+		w.WriteString("\n+\n")
+		w.Write(qual)
+		w.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("error reading minimap2 output %w", err)
+	}
+	if err := kw.Flush(); err != nil {
+		return fmt.Errorf("error writing filtered reads %w", err)
+	}
+	if err := hw.Flush(); err != nil {
+		return fmt.Errorf("error writing host reads %w", err)
+	}
+	return nil
+}
+
+var complement = [256]byte{'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A', 'N': 'N', 'a': 't', 'c': 'g', 'g': 'c', 't': 'a', 'n': 'n'}
+
+func reverseComplement(seq []byte) []byte {
+	rc := make([]byte, len(seq))
+	for i, c := range seq {
+		r := complement[c]
+		if r == 0 {
+			r = 'N'
+		}
+		rc[len(seq)-1-i] = r
+	}
+	return rc
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Reads of a washed and reloaded flowcell can turn up again in a later run's
+// pod5s. dupIndex remembers every read ID written by this invocation, across
+// batches and device pipelines, and records the ones seen before. IDs are kept
+// as 64 bit hashes, 8 bytes a read plus map overhead.
+type dupIndex struct {
+	mu   sync.Mutex
+	seen map[uint64]int // read ID hash -> batch it was first written in
+	dups []duplicate
+}
+
+type duplicate struct {
+	id    string
+	first int // batch
+	batch int
+}
+
+func newDupIndex() *dupIndex {
+	return &dupIndex{seen: make(map[uint64]int)}
+}
+
+// dupWriter collects the read IDs of the batch a pipeline is writing. They
+// only reach the index once the batch is kept, so a retried attempt doesn't
+// report its own reads as duplicates.
+type dupWriter struct {
+	index   *dupIndex
+	pending [][]byte
+	line    int
+	partial []byte
+}
+
+func (d *dupIndex) writer() *dupWriter {
+	return &dupWriter{index: d}
+}
+
+func (w *dupWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			break
+		}
+		if w.line%4 == 0 {
+			line := p[:i]
+			if len(w.partial) > 0 {
+				line = append(w.partial, line...)
+			}
+			if len(line) > 1 && line[0] == '@' {
+				id, _, _ := bytes.Cut(line[1:], []byte{'\t'})
+				id, _, _ = bytes.Cut(id, []byte{' '})
+				w.pending = append(w.pending, bytes.Clone(id))
+			}
+		}
+		w.partial = w.partial[:0]
+		w.line++
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// forget the batch, after a failed attempt
+func (w *dupWriter) drop() {
+	w.pending, w.partial, w.line = nil, nil, 0
+}
+
+// add the batch's IDs to the index, returning how many were seen before
+func (w *dupWriter) commit(batch int) int {
+	d := w.index
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	found := 0
+	for _, id := range w.pending {
+		h := fnv.New64a()
+		h.Write(id)
+		key := h.Sum64()
+		if first, ok := d.seen[key]; ok {
+			d.dups = append(d.dups, duplicate{string(id), first, batch})
+			found++
+			continue
+		}
+		d.seen[key] = batch
+	}
+	w.drop()
+	return found
+}
+
+func dupPath(out string) string {
+	return runFile(out, "duplicates.tsv")
+}
+
+// Print how many reads repeat and between which batches, and list them all
+// in a tsv next to the output
+func (d *dupIndex) report(out string) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Println("=============================================")
+	if len(d.dups) == 0 {
+		fmt.Printf("no duplicate read IDs among %s reads\n", thousands(int64(len(d.seen))))
+		return 0
+	}
+
+	type pair struct{ first, batch int }
+	pairs := map[pair]int{}
+	for _, dup := range d.dups {
+		pairs[pair{dup.first, dup.batch}]++
+	}
+	keys := make([]pair, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b pair) int { return pairs[b] - pairs[a] })
+
+	fmt.Printf("%d read IDs appear more than once, e.g. from a reloaded flowcell:\n", len(d.dups))
+	for i, k := range keys {
+		if i == 10 {
+			fmt.Printf("  and %d more batch pairs\n", len(keys)-i)
+			break
+		}
+		fmt.Printf("  %s reads of batch %d already in batch %d\n", thousands(int64(pairs[k])), k.batch, k.first)
+	}
+
+	if err := writeDuplicates(dupPath(out), d.dups); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("duplicate IDs listed in %s\n", dupPath(out))
+	}
+	return int64(len(d.dups))
+}
+
+func writeDuplicates(path string, dups []duplicate) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error writing duplicates %w", err)
+	}
+	perms.set(path)
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "read_id\tfirst_batch\tbatch")
+	for _, dup := range dups {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", dup.id, dup.first, dup.batch)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing duplicates %w", err)
+	}
+	return f.Close()
+}
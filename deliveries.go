@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Events published to -publish and alerts posted to -alert-webhook that
+// couldn't be delivered are kept in the state db, payload and all, so once
+// the broker or endpoint is back dbatch deliveries retry sends exactly those
+// again instead of someone reconstructing them by hand.
+type delivery struct {
+	Kind   string `json:"kind"`   // nats or webhook
+	Target string `json:"target"` // without credentials
+	// the target had credentials, which a retry needs given again
+	Auth     bool            `json:"auth,omitempty"`
+	Event    string          `json:"event"`
+	Batch    int             `json:"batch,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Time     string          `json:"time"`
+}
+
+// Keep a delivery that failed in the state db. Alerts fail on their own
+// goroutine, the db is saved right away either way.
+func (b *batch) failedDelivery(d delivery) {
+	s := b.state
+	if s == nil {
+		return
+	}
+	d.Attempts, d.Time = 1, timestamp(time.Now())
+	s.mu.Lock()
+	s.Deliveries = append(s.Deliveries, d)
+	s.mu.Unlock()
+	if err := s.save(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// a url as kept in the state db, and whether it carried credentials
+func stripCredentials(target string) (string, bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.User == nil {
+		return target, false
+	}
+	u.User = nil
+	return u.String(), true
+}
+
+func postWebhook(client *http.Client, target string, body []byte) error {
+	resp, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+// dbatch deliveries lists the failed deliveries of a run, or retries them
+func deliveriesMain(args []string) {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "retry") {
+		fmt.Println("usage: dbatch deliveries list|retry -out run.fastq.zst")
+		return
+	}
+	fs := flag.NewFlagSet("deliveries "+args[0], flag.ExitOnError)
+	out := fs.String("out", "", "Output file path of the run")
+	publish := fs.String("publish", "", "nats url to publish to instead of the run's, needed when it had credentials")
+	webhook := fs.String("alert-webhook", "", "url to post alerts to instead of the run's, needed when it had credentials")
+	localTimes := fs.Bool("local-time", false, "print times in the local zone")
+	fs.Parse(args[1:])
+	setLocalTime(*localTimes)
+	if *out == "" {
+		fs.PrintDefaults()
+		return
+	}
+
+	if err := migrateRunDir(*out); err != nil {
+		log.Fatal(err)
+	}
+	state, err := loadRunState(statePath(*out))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(state.Deliveries) == 0 {
+		fmt.Printf("no failed deliveries in %s\n", state.path)
+		return
+	}
+	if args[0] == "list" {
+		for _, d := range state.Deliveries {
+			fmt.Printf("%s %-7s %-24s %s, %d attempts: %s\n", displayStamp(d.Time), d.Kind, d.what(), d.Target, d.Attempts, d.Error)
+		}
+		return
+	}
+
+	audit, err := openAudit(auditPath(*out))
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	publishers := map[string]*publisher{}
+	var left []delivery
+	for _, d := range state.Deliveries {
+		err := d.retry(*publish, *webhook, client, publishers)
+		if err != nil {
+			d.Attempts++
+			d.Error = err.Error()
+			left = append(left, d)
+			fmt.Printf("%s %s still failing: %s\n", d.Kind, d.what(), err)
+			continue
+		}
+		fmt.Printf("delivered %s %s to %s\n", d.Kind, d.what(), d.Target)
+		audit.record(*out, "delivery_retried", map[string]any{"kind": d.Kind, "event": d.Event, "batch": d.Batch, "target": d.Target})
+	}
+	for _, p := range publishers {
+		p.close()
+	}
+
+	total := len(state.Deliveries)
+	state.Deliveries = left
+	if err := state.save(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d of %d deliveries sent\n", total-len(left), total)
+	if len(left) > 0 {
+		os.Exit(1)
+	}
+}
+
+// the event, with its batch if it has one
+func (d delivery) what() string {
+	if d.Batch > 0 {
+		return fmt.Sprintf("%s of batch %d", d.Event, d.Batch)
+	}
+	return d.Event
+}
+
+// Send a delivery again, to override if given instead of its own target
+func (d delivery) retry(publish, webhook string, client *http.Client, publishers map[string]*publisher) error {
+	// the state db indents the payload along with everything else
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, d.Payload); err != nil {
+		return fmt.Errorf("error reading payload %w", err)
+	}
+	switch d.Kind {
+	case "nats":
+		target := d.Target
+		if publish != "" {
+			target = publish
+		} else if d.Auth {
+			return fmt.Errorf("%s needs credentials, give them with -publish", d.Target)
+		}
+		p, ok := publishers[target]
+		if !ok {
+			var err error
+			if p, err = newPublisher(target); err != nil {
+				return err
+			}
+			publishers[target] = p
+		}
+		return p.publishData(payload.Bytes())
+	case "webhook":
+		target := d.Target
+		if webhook != "" {
+			target = webhook
+		} else if d.Auth {
+			return fmt.Errorf("%s needs credentials, give them with -alert-webhook", d.Target)
+		}
+		return postWebhook(client, target, payload.Bytes())
+	}
+	return fmt.Errorf("unknown delivery %s", d.Kind)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// What dbatch demux has split so far, kept in the output directory so an
+// interrupted demux picks up where it stopped
+type demuxManifest struct {
+	Source   string                     `json:"source"`
+	Kit      string                     `json:"kit"`
+	Batches  []int                      `json:"batches"` // source batches demultiplexed
+	Barcodes map[string]*barcodeOutputs `json:"barcodes"`
+
+	path string
+}
+
+// a barcode's output file and the range each source batch appended to it
+type barcodeOutputs struct {
+	Output  string          `json:"output"`
+	Reads   int64           `json:"reads"`
+	Bases   int64           `json:"bases"`
+	Batches []manifestEntry `json:"batches"`
+}
+
+// dbatch demux splits an existing output by barcode after the fact. The
+// batches of the manifest are demultiplexed one at a time so only a single
+// batch is ever held uncompressed, each barcode getting its own compressed file.
+func demuxMain(args []string) {
+	fs := flag.NewFlagSet("demux", flag.ExitOnError)
+	out := fs.String("out", "", "Output file path of the original run")
+	kit := fs.String("kit", "", "barcoding kit passed to dorado demux, e.g. SQK-RBK114-24")
+	dpath := fs.String("dorado", "", "Path to dorado, default is the dorado of the original run")
+	dir := fs.String("o", "", "directory for the per barcode outputs, default <out>.demux")
+	tmp := fs.String("tmp", "", "working directory for the batch being demultiplexed, default <out>.dbatch/tmp-demux")
+	fs.Parse(args)
+
+	if *out == "" || *kit == "" {
+		fs.PrintDefaults()
+		return
+	}
+	d, err := runDemux(*out, *kit, *dpath, *dir, *tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.print()
+}
+
+// Demultiplex the batches of out not split yet. dpath, dir and tmp default
+// as in dbatch demux when empty.
+func runDemux(out, kit, dpath, dir, tmp string) (*demuxManifest, error) {
+	if err := migrateRunDir(out); err != nil {
+		return nil, err
+	}
+	if tmp == "" {
+		tmp = runFile(out, "tmp-demux")
+	}
+	m, err := readManifest(manifestPath(out))
+	if err != nil {
+		return nil, err
+	}
+	if dpath == "" {
+		state, err := loadRunState(statePath(out))
+		if err != nil {
+			return nil, fmt.Errorf("no -dorado given and %w", err)
+		}
+		dpath = state.Dorado
+		if dpath == simulatedDorado {
+			return nil, fmt.Errorf("the original run was simulated, give the dorado to demultiplex with -dorado")
+		}
+	}
+	if dir == "" {
+		dir = out + ".demux"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error making demux directory %w", err)
+	}
+
+	d, err := loadDemuxManifest(filepath.Join(dir, "demux.json"), out, kit)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.truncate(); err != nil {
+		return nil, err
+	}
+
+	audit, err := openAudit(auditPath(out))
+	if err != nil {
+		return nil, err
+	}
+	audit.record(out, "demux_started", map[string]any{"kit": kit, "dir": dir})
+
+	for _, e := range m.Batches {
+		if slices.Contains(d.Batches, e.Batch) {
+			continue
+		}
+		source := e.Output
+		if source == "" {
+			source = m.Output
+		}
+
+		fmt.Println("=============================================")
+		fmt.Printf("demultiplexing batch %d of %d\n", e.Batch, len(m.Batches))
+		fmt.Println("=============================================")
+
+		if err := d.batch(dpath, tmp, dir, source, e); err != nil {
+			os.RemoveAll(tmp)
+			audit.record(out, "demux_failed", map[string]any{"batch": e.Batch, "error": err.Error()})
+			return nil, fmt.Errorf("error demultiplexing batch %d %w", e.Batch, err)
+		}
+		os.RemoveAll(tmp)
+		if err := d.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	audit.record(out, "demux_finished", map[string]any{"kit": kit, "barcodes": len(d.Barcodes)})
+	return d, nil
+}
+
+func loadDemuxManifest(path, source, kit string) (*demuxManifest, error) {
+	d := &demuxManifest{Source: source, Kit: kit, Barcodes: map[string]*barcodeOutputs{}, path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading demux manifest %w", err)
+	}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, fmt.Errorf("error parsing demux manifest %s: %w", path, err)
+	}
+	if kit != "" && d.Kit != kit {
+		return nil, fmt.Errorf("%s was demultiplexed with kit %s, not %s", path, d.Kit, kit)
+	}
+	d.path = path
+	return d, nil
+}
+
+func (d *demuxManifest) save() error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding demux manifest %w", err)
+	}
+	tmp := d.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing demux manifest %w", err)
+	}
+	perms.set(tmp)
+	if err := os.Rename(tmp, d.path); err != nil {
+		return fmt.Errorf("error writing demux manifest %w", err)
+	}
+	return nil
+}
+
+// cut whatever an interrupted batch appended after the last recorded one
+func (d *demuxManifest) truncate() error {
+	for _, bc := range d.Barcodes {
+		var end int64
+		if n := len(bc.Batches); n > 0 {
+			end = bc.Batches[n-1].Offset + bc.Batches[n-1].Length
+		}
+		err := os.Truncate(bc.Output, end)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("error truncating %s %w", bc.Output, err)
+		}
+	}
+	return nil
+}
+
+// Extract one batch of the source, demultiplex it and append every barcode
+// to its output
+func (d *demuxManifest) batch(dpath, tmp, dir, source string, e manifestEntry) error {
+	split := filepath.Join(tmp, "demux")
+	if err := os.MkdirAll(split, 0750); err != nil {
+		return fmt.Errorf("error making tmpdir %w", err)
+	}
+	// batches of a bam run are files of their own that dorado reads directly
+	input := source
+	if !strings.HasSuffix(source, ".bam") {
+		input = filepath.Join(tmp, fmt.Sprintf("batch_%05d.fastq", e.Batch))
+		if err := extractBatch(source, e.Offset, e.Length, input); err != nil {
+			return err
+		}
+	}
+
+	dorado := command(dpath, "demux", "--kit-name", d.Kit, "--emit-fastq", "--output-dir", split, input)
+	dorado.Stdout = os.Stdout
+	dorado.Stderr = os.Stderr
+	if err := dorado.Run(); err != nil {
+		return fmt.Errorf("dorado demux error: %w", err)
+	}
+
+	var parts []string
+	filepath.WalkDir(split, func(path string, di fs.DirEntry, err error) error {
+		if di != nil && !di.IsDir() && strings.HasSuffix(di.Name(), ".fastq") {
+			parts = append(parts, path)
+		}
+		return nil
+	})
+	slices.Sort(parts)
+
+	for _, part := range parts {
+		name := barcodeName(part)
+		bc, ok := d.Barcodes[name]
+		if !ok {
+			bc = &barcodeOutputs{Output: filepath.Join(dir, name+".fastq.zst")}
+			d.Barcodes[name] = bc
+		}
+		entry, err := appendCompressed(part, bc.Output)
+		if err != nil {
+			return err
+		}
+		entry.Batch = e.Batch
+		bc.Batches = append(bc.Batches, entry)
+		bc.Reads += entry.Reads
+		bc.Bases += entry.Bases
+	}
+	d.Batches = append(d.Batches, e.Batch)
+	return nil
+}
+
+// decompress the range of a batch into path
+func extractBatch(source string, offset, length int64, path string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening output %w", err)
+	}
+	defer f.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating batch fastq %w", err)
+	}
+	defer dst.Close()
+
+	zstd := command("zstd", "-dc")
+	zstd.Stdin = io.NewSectionReader(f, offset, length)
+	zstd.Stdout = dst
+	zstd.Stderr = os.Stderr
+	if err := zstd.Run(); err != nil {
+		return fmt.Errorf("zstd error: %w", err)
+	}
+	return nil
+}
+
+// compress a fastq onto the end of out as a new frame, counting its reads
+func appendCompressed(path, out string) (manifestEntry, error) {
+	var e manifestEntry
+	in, err := os.Open(path)
+	if err != nil {
+		return e, fmt.Errorf("error opening demux output %w", err)
+	}
+	defer in.Close()
+	dst, err := os.OpenFile(out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return e, fmt.Errorf("error opening file %w", err)
+	}
+	perms.set(out)
+	defer dst.Close()
+	if info, err := dst.Stat(); err == nil {
+		e.Offset = info.Size()
+	}
+
+	counts := newQCWriter(0)
+	zstd := command(compressors[0][0], compressors[0][1:]...)
+	zstd.Stdin = io.TeeReader(in, counts)
+	zstd.Stdout = dst
+	zstd.Stderr = os.Stderr
+	if err := zstd.Run(); err != nil {
+		return e, fmt.Errorf("zstd error: %w", err)
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return e, fmt.Errorf("error writing %s %w", out, err)
+	}
+	e.Length = info.Size() - e.Offset
+	e.Reads, e.Bases = counts.batchReads, counts.batchBases
+	return e, nil
+}
+
+// dorado names its outputs after the kit and barcode, e.g.
+// SQK-RBK114-24_barcode01.fastq, or unclassified.fastq
+func barcodeName(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), ".fastq")
+	if i := strings.LastIndex(name, "_barcode"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+func (d *demuxManifest) print() {
+	var total int64
+	names := make([]string, 0, len(d.Barcodes))
+	for name, bc := range d.Barcodes {
+		names = append(names, name)
+		total += bc.Reads
+	}
+	slices.Sort(names)
+
+	fmt.Println("=============================================")
+	fmt.Printf("demultiplexed %d batches into %d barcodes\n", len(d.Batches), len(names))
+	for _, name := range names {
+		bc := d.Barcodes[name]
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(bc.Reads) / float64(total)
+		}
+		fmt.Printf("  %-14s reads %s (%.1f%%), bases %s, %s\n", name, thousands(bc.Reads), share, baseCount(bc.Bases), bc.Output)
+	}
+	fmt.Println("=============================================")
+}
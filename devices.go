@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// dorado stderr patterns that point at the GPU rather than the input
+var deviceErrorPattern = regexp.MustCompile(`(?i)cuda[^\n]*(error|fail)|cudaError|no cuda devices|device-side assert|cublas|out of memory`)
+
+// chunkQueue hands chunks of the plan to the device pipelines
+type chunkQueue struct {
+	mu       sync.Mutex
+	changed  *sync.Cond // a chunk was handed back or done, or the queue stopped
+	pending  []int      // chunk numbers counted from 0
+	inFlight int        // taken and not yet done or handed back
+	handed   map[int]map[string]bool
+	stopped  bool
+	// with -cpu-fallback chunks every gpu failed stay for the cpu, and down
+	// counts the devices that stopped taking chunks
+	cpu  bool
+	down int
+}
+
+func newChunkQueue(cpu bool) *chunkQueue {
+	q := &chunkQueue{handed: make(map[int]map[string]bool), cpu: cpu}
+	q.changed = sync.NewCond(&q.mu)
+	return q
+}
+
+// Take the next chunk for dev, skipping chunks dev already handed back. With
+// nothing dev can take it waits for the chunks other devices are working on,
+// which they may hand back, and only gives up once none are left.
+func (q *chunkQueue) take(dev string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.stopped {
+		for i, c := range q.pending {
+			if !q.handed[c][dev] {
+				q.pending = slices.Delete(q.pending, i, i+1)
+				q.inFlight++
+				return c, true
+			}
+		}
+		if q.inFlight == 0 {
+			break
+		}
+		q.changed.Wait()
+	}
+	return 0, false
+}
+
+// A chunk taken is done with, basecalled, skipped or failed for good
+func (q *chunkQueue) done() {
+	q.mu.Lock()
+	q.inFlight--
+	q.changed.Broadcast()
+	q.mu.Unlock()
+}
+
+// Give a chunk back for another device. Returns false once the chunk has been
+// handed back by every device, at which point it is the chunk that is bad.
+func (q *chunkQueue) requeue(c int, dev string, devices int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight--
+	defer q.changed.Broadcast()
+	if q.handed[c] == nil {
+		q.handed[c] = make(map[string]bool)
+	}
+	q.handed[c][dev] = true
+	if len(q.handed[c]) >= devices && !q.cpu {
+		return false
+	}
+	q.pending = append([]int{c}, q.pending...)
+	return true
+}
+
+// Count a device out, unless it is the last one and falls back to the cpu
+// instead, which it is told by the result
+func (q *chunkQueue) giveUp(devices int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cpu && q.down == devices-1 {
+		return true
+	}
+	q.down++
+	return false
+}
+
+// stop handing out chunks, e.g. after an unrecoverable failure
+func (q *chunkQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.changed.Broadcast()
+	q.mu.Unlock()
+}
+
+func (q *chunkQueue) left() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.pending)
+}
+
+// Basecall the plan on several devices at once. Each device runs its own
+// pipeline into its own shard of the output, taking chunks from a shared queue.
+// A device that keeps failing with GPU errors is marked unhealthy and its chunk
+// is handed to the remaining devices.
+func (b *batch) runDevices() error {
+	q := newChunkQueue(b.cpu.enabled)
+	for c := range b.plan {
+		if !b.skipsBatch(c) {
+			q.pending = append(q.pending, c)
+		}
+	}
+
+	// the run's own db only holds notes until the device pipelines are folded in
+	b.state = newRunState(b)
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+
+	metrics.describe("dbatch_devices_healthy", "gauge", "Devices still taking chunks")
+	metrics.set("dbatch_devices_healthy", float64(len(b.devices)))
+
+	pipes := make([]*batch, len(b.devices))
+	errs := make([]error, len(b.devices))
+	var wg sync.WaitGroup
+	for i, dev := range b.devices {
+		pipes[i] = b.forDevice(i, dev)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = pipes[i].runDevice(q)
+			pipes[i].stopWarm()
+			if errs[i] != nil {
+				q.stop()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// fold the device pipelines back into the run
+	b.state = newRunState(b)
+	var missing []batchRecord
+	var unhealthy []string
+	for _, p := range pipes {
+		b.state.Batches = append(b.state.Batches, p.state.Batches...)
+		b.state.Deliveries = append(b.state.Deliveries, p.state.Deliveries...)
+		missing = append(missing, p.state.missing()...)
+		if p.unhealthy {
+			unhealthy = append(unhealthy, p.device)
+		}
+		if b.qc != nil {
+			b.qc.merge(p.qc)
+		}
+		if b.decontam != nil {
+			b.decontam.removed += p.decontam.removed
+		}
+		if p.quarantine != nil {
+			if b.quarantine == nil {
+				b.quarantine = &quarantine{Out: b.out}
+			}
+			b.quarantine.Files = append(b.quarantine.Files, p.quarantine.Files...)
+		}
+	}
+	if b.quarantine != nil {
+		if err := b.quarantine.write(quarantinePath(b.out)); err != nil {
+			fmt.Println(err)
+		}
+	}
+	for _, c := range q.left() {
+		rec := batchRecord{Index: c + 1, Error: "no healthy device left"}
+		b.pod5s.each(b.plan[c].start, b.plan[c].end, func(_ int, f pod5) error {
+			rec.Files = append(rec.Files, f.path)
+			return nil
+		})
+		b.state.Batches = append(b.state.Batches, rec)
+		missing = append(missing, rec)
+	}
+	byIndex := func(x, y batchRecord) int { return x.Index - y.Index }
+	slices.SortFunc(b.state.Batches, byIndex)
+	slices.SortFunc(missing, byIndex)
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+
+	var runErr error
+	for _, err := range errs {
+		if err != nil {
+			runErr = err
+			break
+		}
+	}
+	if len(unhealthy) > 0 {
+		fmt.Println("=============================================")
+		fmt.Printf("degraded run: %s marked unhealthy, %d of %d devices finished the plan\n",
+			strings.Join(unhealthy, ", "), len(b.devices)-len(unhealthy), len(b.devices))
+	}
+	return b.report(missing, runErr)
+}
+
+// A pipeline for one device, writing its own shard of the output
+func (b *batch) forDevice(i int, dev string) *batch {
+	p := *b
+	p.device = dev
+	p.warm = nil // each device loads the model once for itself
+	p.shard, p.shards = i+1, len(b.devices)
+	p.sharedOut = b.out
+	label := strings.NewReplacer(":", "", "/", "", ",", "").Replace(dev)
+	p.out = labeledPath(b.out, label)
+	p.tmp = b.tmp + "-" + label
+	if b.spool != "" {
+		p.spool = filepath.Join(b.spool, label)
+	}
+	if b.qc != nil {
+		p.qc = newQCWriter(b.qc.rejectLen)
+		p.qc.live = b.qc.live
+	}
+	if b.decontam != nil {
+		d := *b.decontam
+		d.removed = 0
+		p.decontam = &d
+	}
+	if b.dups != nil {
+		p.dupWriter = b.dups.writer()
+	}
+	if b.prov != nil {
+		p.provWriter = b.prov.writer()
+	}
+	return &p
+}
+
+func (p *batch) runDevice(q *chunkQueue) error {
+	p.state = newRunState(p)
+	if err := makeRunDir(p.out); err != nil {
+		return err
+	}
+	if err := os.Mkdir(p.tmp, 0750); err != nil {
+		return fmt.Errorf("error making -tmp %s", p.tmp)
+	}
+	defer os.RemoveAll(p.tmp)
+
+	if err := p.startPool(); err != nil {
+		return err
+	}
+	p.startVerifier()
+	defer func() {
+		p.collectCompressed(true)
+		p.collectVerified(true)
+		if p.tracer != nil {
+			p.tracer.flush(p.state)
+		}
+		if err := newManifest(p.state).write(p.manifestPath()); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	failures := 0
+	for {
+		if aborting.Load() {
+			return errAborted
+		}
+		if err := p.checkCanceled(); err != nil {
+			return err
+		}
+		c, ok := q.take(p.device)
+		if !ok {
+			// what is left failed on this gpu, it's the cpu's if no other takes it
+			if p.cpu.enabled && p.device != "cpu" && len(q.left()) > 0 && q.giveUp(len(p.devices)) {
+				p.fallBackToCPU(fmt.Errorf("%d chunks failed on every gpu", len(q.left())))
+				failures = 0
+				continue
+			}
+			return nil
+		}
+		files, err := p.pod5s.files(p.plan[c].start, p.plan[c].end)
+		if err != nil {
+			q.done()
+			return err
+		}
+		fmt.Printf("%s: basecalling batch %d (%d files)\n", p.device, c+1, len(files))
+
+		rec, err := p.process(c+1, files)
+		if p.tracer != nil {
+			p.tracer.flush(p.state)
+		}
+		if err == nil {
+			q.done()
+			failures = 0
+			if p.device == "cpu" {
+				left := 0
+				for _, c := range q.left() {
+					left += p.plan[c].end - p.plan[c].start
+				}
+				p.reportCPURate(rec, left)
+			}
+			continue
+		}
+		if rec == nil {
+			q.done()
+			return fmt.Errorf("%s batch %d: %w", p.device, c+1, err)
+		}
+
+		if deviceErrorPattern.MatchString(p.lastStderr) && p.device != "cpu" {
+			failures++
+			if q.requeue(c, p.device, len(p.devices)) {
+				// handed over, so this shard no longer accounts for the chunk
+				p.state.drop(rec.Index)
+				p.audit.record(p.out, "batch_requeued", map[string]any{"batch": rec.Index, "device": p.device, "error": err.Error()})
+				if failures >= p.deviceFailures {
+					if q.giveUp(len(p.devices)) {
+						// the last healthy device carries on with the cpu
+						p.fallBackToCPU(err)
+						failures = 0
+						continue
+					}
+					p.markUnhealthy(err)
+					return nil
+				}
+				continue
+			}
+			// the chunk is bad, requeue counted it done
+		} else {
+			q.done()
+		}
+
+		if !p.continueOnError {
+			return fmt.Errorf("%s batch %d: %w", p.device, c+1, err)
+		}
+		p.skip(rec, err)
+	}
+}
+
+func (p *batch) markUnhealthy(err error) {
+	p.unhealthy = true
+	fmt.Printf("%s: %d consecutive GPU failures, marking device unhealthy: %s\n", p.device, p.deviceFailures, err)
+	metrics.add("dbatch_devices_healthy", -1)
+	p.audit.record(p.out, "device_unhealthy", map[string]any{"device": p.device, "error": err.Error()})
+}
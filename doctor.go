@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// what dbatch doctor found of one tool
+type probe struct {
+	name    string
+	path    string
+	version string // first line of its version output
+	lines   int
+	err     error
+}
+
+// a feature of dbatch and whether it works on this host
+type capability struct {
+	feature string
+	ok      bool
+	why     string
+}
+
+// dbatch doctor probes the tools and endpoints dbatch can use and prints which
+// of its features will work on this host, and why the others won't
+func doctorMain(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	dpath := fs.String("dorado", "dorado", "dorado to probe")
+	otel := fs.String("otel-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "opentelemetry collector to probe, default $OTEL_EXPORTER_OTLP_ENDPOINT")
+	server := fs.String("server", os.Getenv("DBATCH_SERVER"), "dbatch daemon to probe, default $DBATCH_SERVER")
+	fs.Parse(args)
+
+	tools := map[string]probe{}
+	for _, p := range []probe{
+		probeTool(*dpath, "--version"),
+		probeTool("zstd", "-V"),
+		probeTool("pzstd", "-V"),
+		probeTool("nvidia-smi", "--query-gpu=name,memory.total", "--format=csv,noheader"),
+		probeTool("blue-crab", "--version"),
+		probeTool("pod5", "--version"),
+		probeTool("minimap2", "--version"),
+	} {
+		tools[p.name] = p
+	}
+	tools["dorado"] = tools[*dpath]
+
+	fmt.Println("=============================================")
+	fmt.Printf("%-12s %-40s %s\n", "tool", "path", "version")
+	for _, name := range []string{*dpath, "zstd", "pzstd", "nvidia-smi", "blue-crab", "pod5", "minimap2"} {
+		p := tools[name]
+		if p.err != nil {
+			fmt.Printf("%-12s %-40s %s\n", filepath.Base(name), "-", p.err)
+			continue
+		}
+		fmt.Printf("%-12s %-40s %s\n", filepath.Base(name), p.path, p.version)
+	}
+	fmt.Println("=============================================")
+
+	// nvidia-smi lists one gpu per line
+	gpus := tools["nvidia-smi"].lines
+
+	caps := []capability{
+		needs("basecalling", tools["dorado"], "dorado"),
+		needs("dbatch demux", tools["dorado"], "dorado"),
+		needs("-input-format bam", tools["dorado"], "dorado"),
+		needs("-input-format blow5", tools["blue-crab"], "blue-crab, or an -ext-hook .blow5 converter"),
+		needs(".fast5 inputs by pod5 convert hook", tools["pod5"], "the pod5 tools"),
+		needs("-decontam-ref", tools["minimap2"], "minimap2"),
+		needs("-auto-compress up to pzstd", tools["pzstd"], "pzstd, zstd -T0 is the fastest setting left"),
+		{"-simulate", true, "built in"},
+	}
+	if tools["zstd"].err == nil {
+		caps = append(caps, capability{"zstd compressed output", true, ""})
+	} else {
+		caps = append(caps, capability{"zstd compressed output", false, "no zstd, the built-in fallback writes uncompressed zstd frames"})
+	}
+	switch {
+	case tools["nvidia-smi"].err != nil:
+		caps = append(caps, capability{"GPU basecalling", false, "no nvidia-smi, no NVIDIA GPU visible, dorado will run on the CPU or Apple silicon"})
+	case gpus >= 2:
+		caps = append(caps, capability{"GPU basecalling", true, fmt.Sprintf("%d GPUs", gpus)})
+		caps = append(caps, capability{"-devices, one pipeline per GPU", true, fmt.Sprintf("%d GPUs", gpus)})
+	default:
+		caps = append(caps, capability{"GPU basecalling", gpus == 1, fmt.Sprintf("%d GPUs", gpus)})
+		caps = append(caps, capability{"-devices, one pipeline per GPU", false, fmt.Sprintf("only %d GPU", gpus)})
+	}
+	caps = append(caps, probeLinks())
+	caps = append(caps, probeEndpoint("-otel-endpoint tracing", *otel, "/v1/traces"))
+	caps = append(caps, probeEndpoint("dbatch remote", *server, "/runs"))
+
+	fmt.Printf("%-40s %-4s %s\n", "feature", "", "detail")
+	for _, c := range caps {
+		state := "ok"
+		if !c.ok {
+			state = "no"
+		}
+		fmt.Printf("%-40s %-4s %s\n", c.feature, state, c.why)
+	}
+	fmt.Println("=============================================")
+}
+
+// Find a tool and run it for its version, allowing it a few seconds
+func probeTool(name string, args ...string) probe {
+	p := probe{name: name}
+	p.path, p.err = exec.LookPath(name)
+	if p.err != nil {
+		p.err = fmt.Errorf("not found")
+		return p
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// dorado prints its version to stderr
+	out, err := exec.CommandContext(ctx, p.path, args...).CombinedOutput()
+	if err != nil && len(out) == 0 {
+		p.err = fmt.Errorf("found but doesn't run: %w", err)
+		return p
+	}
+	text := strings.TrimSpace(string(out))
+	p.version, _, _ = strings.Cut(text, "\n")
+	if text != "" {
+		p.lines = strings.Count(text, "\n") + 1
+	}
+	return p
+}
+
+func needs(feature string, p probe, what string) capability {
+	if p.err != nil {
+		return capability{feature, false, "needs " + what + ", " + p.err.Error()}
+	}
+	return capability{feature, true, p.path}
+}
+
+// staging symlinks the inputs into the working directory, e.g. Windows without
+// developer mode falls back to hard links or copies
+func probeLinks() capability {
+	c := capability{feature: "staging by symlink"}
+	dir, err := os.MkdirTemp(".", ".dbatch-doctor-")
+	if err != nil {
+		c.why = fmt.Sprintf("can't write to the working directory: %s", err)
+		return c
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, nil, 0644); err != nil {
+		c.why = err.Error()
+		return c
+	}
+	if err := os.Symlink("target", filepath.Join(dir, "link")); err != nil {
+		c.why = "symlinks not allowed here, staging falls back to hard links or copies"
+		return c
+	}
+	c.ok = true
+	return c
+}
+
+// An endpoint counts as reachable if it answers http at all, whatever the status
+func probeEndpoint(feature, endpoint, path string) capability {
+	c := capability{feature: feature}
+	if endpoint == "" {
+		c.why = "no endpoint configured"
+		return c
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(strings.TrimSuffix(endpoint, "/") + path)
+	if err != nil {
+		c.why = fmt.Sprintf("%s unreachable: %s", endpoint, err)
+		return c
+	}
+	resp.Body.Close()
+	c.ok = true
+	c.why = fmt.Sprintf("%s answered %s", endpoint, resp.Status)
+	return c
+}
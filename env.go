@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// envVars are set on the child processes (dorado, compressors, minimap2 and
+// hooks) on top of dbatch's own environment, e.g. CUDA_VISIBLE_DEVICES
+type envVars map[string]string
+
+// String and Set implement flag.Value so -env can be repeated
+func (e envVars) String() string {
+	return strings.Join(e.list(), ",")
+}
+
+func (e envVars) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("environment variable %q is not KEY=VALUE", s)
+	}
+	e[k] = v
+	return nil
+}
+
+func (e envVars) has(key string) bool {
+	_, ok := e[key]
+	return ok
+}
+
+func (e envVars) list() []string {
+	vars := make([]string, 0, len(e))
+	for k, v := range e {
+		vars = append(vars, k+"="+v)
+	}
+	slices.Sort(vars)
+	return vars
+}
+
+// environment added to every child process, set once the run flags are parsed
+var childEnv []string
+
+// cancelled to kill every child when dbatch is forced to exit
+var children, killChildren = context.WithCancel(context.Background())
+
+// exec.Command with childEnv applied, in its own process group. zstd falls
+// back to the built-in one when it isn't installed.
+func command(name string, args ...string) *exec.Cmd {
+	if name == "zstd" && !haveZstd() {
+		self, err := os.Executable()
+		if err != nil {
+			self = os.Args[0]
+		}
+		name, args = self, append([]string{"builtin-zstd"}, args...)
+	}
+	cmd := exec.CommandContext(children, name, args...)
+	detach(cmd)
+	if len(childEnv) > 0 {
+		cmd.Env = append(os.Environ(), childEnv...)
+	}
+	return cmd
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// dbatch export lays a finished output out the way MinKNOW delivers runs, so
+// EPI2ME and the wf-* workflows take it as it is: fastq_pass/ and fastq_fail/
+// split at the model's qscore threshold, a barcodeXX/ directory per barcode
+// when the run was demultiplexed, gzipped fastq named like MinKNOW's and a
+// sequencing summary next to them.
+//
+//	run.epi2me/
+//	  fastq_pass/barcode01/run_pass_barcode01_1.fastq.gz
+//	  fastq_fail/barcode01/run_fail_barcode01_1.fastq.gz
+//	  sequencing_summary_run.txt
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "", "Output file path of the run")
+	layout := fs.String("layout", "epi2me", "layout to export to, epi2me")
+	dir := fs.String("o", "", "directory to export to, default <out>.epi2me")
+	demux := fs.String("demux", "", "per barcode outputs of dbatch demux to export, default <out>.demux if it holds any")
+	minQ := fs.Float64("min-qscore", -1, "mean qscore reads need for fastq_pass, default that of MinKNOW for the model: 8 fast, 9 hac, 10 sup")
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.PrintDefaults()
+		return
+	}
+	if *layout != "epi2me" {
+		log.Fatalf("unknown layout %s, use epi2me", *layout)
+	}
+	if err := exportEPI2ME(*out, *dir, *demux, *minQ); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// a compressed range to export and the barcode its reads belong to
+type exportSource struct {
+	path    string
+	barcode string // empty when not demultiplexed
+	entry   manifestEntry
+}
+
+func exportEPI2ME(out, dir, demux string, minQ float64) error {
+	if err := migrateRunDir(out); err != nil {
+		return err
+	}
+	m, err := readManifest(manifestPath(out))
+	if err != nil {
+		return err
+	}
+	if minQ < 0 {
+		minQ = passQscore(m.Model)
+	}
+	if dir == "" {
+		dir = out + ".epi2me"
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists, remove it or export with -o elsewhere", dir)
+	}
+
+	sources, err := exportSources(out, m, demux)
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(out)
+	if i := strings.Index(prefix, "."); i > 0 {
+		prefix = prefix[:i]
+	}
+
+	batches, barcodes := map[int]bool{}, map[string]bool{}
+	for _, s := range sources {
+		batches[s.entry.Batch], barcodes[s.barcode] = true, true
+	}
+	fmt.Println("=============================================")
+	if barcodes[""] {
+		fmt.Printf("exporting %d batches of %s to %s, fastq_pass at mean qscore %g\n", len(batches), out, dir, minQ)
+	} else {
+		fmt.Printf("exporting %d batches of %s in %d barcodes to %s, fastq_pass at mean qscore %g\n", len(batches), out, len(barcodes), dir, minQ)
+	}
+	fmt.Println("=============================================")
+
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("error removing %s %w", tmp, err)
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return fmt.Errorf("error making export directory %w", err)
+	}
+	summaryName := "sequencing_summary_" + prefix + ".txt"
+	f, err := os.Create(filepath.Join(tmp, summaryName))
+	if err != nil {
+		return fmt.Errorf("error creating sequencing summary %w", err)
+	}
+	perms.set(filepath.Join(tmp, summaryName))
+	defer f.Close()
+	summary := bufio.NewWriter(f)
+	fmt.Fprintln(summary, "filename_fastq\tread_id\tbarcode_arrangement\tpasses_filtering\tsequence_length_template\tmean_qscore_template")
+
+	var pass, fail int64
+	for _, s := range sources {
+		p, f, err := exportBatch(tmp, prefix, s, minQ, summary)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("error exporting batch %d %w", s.entry.Batch, err)
+		}
+		pass += p
+		fail += f
+	}
+	if err := summary.Flush(); err != nil {
+		return fmt.Errorf("error writing sequencing summary %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing sequencing summary %w", err)
+	}
+	// only a complete export appears under its name
+	if err := os.Rename(tmp, dir); err != nil {
+		return fmt.Errorf("error moving export into place %w", err)
+	}
+
+	if audit, err := openAudit(auditPath(out)); err == nil {
+		audit.record(out, "exported", map[string]any{"layout": "epi2me", "dir": dir, "pass": pass, "fail": fail, "min_qscore": minQ})
+	}
+	fmt.Printf("exported %s reads to %s/fastq_pass and %s to %s/fastq_fail, summary in %s\n", thousands(pass), dir, thousands(fail), dir, summaryName)
+	return nil
+}
+
+// MinKNOW's pass threshold for a model, by its speed
+func passQscore(model string) float64 {
+	switch {
+	case strings.Contains(model, "sup"):
+		return 10
+	case strings.Contains(model, "fast"):
+		return 8
+	}
+	return 9
+}
+
+// The barcode outputs of demux if there are any, else the batches of the run
+func exportSources(out string, m *manifest, demux string) ([]exportSource, error) {
+	explicit := demux != ""
+	if !explicit {
+		demux = out + ".demux"
+	}
+	d, err := loadDemuxManifest(filepath.Join(demux, "demux.json"), out, "")
+	if err != nil {
+		return nil, err
+	}
+	if explicit && len(d.Barcodes) == 0 {
+		return nil, fmt.Errorf("%s holds no demultiplexed batches", demux)
+	}
+
+	var sources []exportSource
+	if len(d.Barcodes) > 0 {
+		if len(d.Batches) < len(m.Batches) {
+			fmt.Printf("warning: only %d of %d batches are demultiplexed, exporting those\n", len(d.Batches), len(m.Batches))
+		}
+		for name, bc := range d.Barcodes {
+			for _, e := range bc.Batches {
+				sources = append(sources, exportSource{path: bc.Output, barcode: name, entry: e})
+			}
+		}
+	} else {
+		for _, e := range m.Batches {
+			path := cmp.Or(e.Output, m.Output)
+			if strings.HasSuffix(path, ".bam") {
+				return nil, fmt.Errorf("%s is a bam run, the epi2me layout takes fastq", out)
+			}
+			sources = append(sources, exportSource{path: path, entry: e})
+		}
+	}
+	slices.SortFunc(sources, func(a, b exportSource) int {
+		if a.barcode != b.barcode {
+			return strings.Compare(a.barcode, b.barcode)
+		}
+		return a.entry.Batch - b.entry.Batch
+	})
+	return sources, nil
+}
+
+// Split one range into gzipped pass and fail files, adding its reads to the summary
+func exportBatch(dir, prefix string, s exportSource, minQ float64, summary io.Writer) (pass, fail int64, err error) {
+	src, err := os.Open(s.path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error opening output %w", err)
+	}
+	defer src.Close()
+	zstd := command("zstd", "-dc")
+	zstd.Stdin = io.NewSectionReader(src, s.entry.Offset, s.entry.Length)
+	zstd.Stderr = os.Stderr
+	stdout, err := zstd.StdoutPipe()
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not get zstd stdout %w", err)
+	}
+	if err := zstd.Start(); err != nil {
+		return 0, 0, fmt.Errorf("error starting zstd %w", err)
+	}
+
+	outs := map[bool]*exportFile{}
+	defer func() {
+		for _, f := range outs {
+			f.abort()
+		}
+		if err != nil {
+			zstd.Process.Kill()
+			zstd.Wait()
+		}
+	}()
+	barcode := cmp.Or(s.barcode, "none")
+	rd := bufio.NewReaderSize(stdout, 1<<20)
+	var rec [4][]byte
+	for {
+		more, err := readRecord(rd, &rec)
+		if err != nil {
+			return 0, 0, fmt.Errorf("error reading %s %w", s.path, err)
+		}
+		if !more {
+			break
+		}
+		q := meanQscore(rec[3])
+		ok := q >= minQ
+		f, exists := outs[ok]
+		if !exists {
+			if f, err = createExportFile(dir, prefix, s, ok); err != nil {
+				return 0, 0, err
+			}
+			outs[ok] = f
+		}
+		for _, line := range rec {
+			f.zw.Write(line)
+			if _, err := f.zw.Write([]byte{'\n'}); err != nil {
+				return 0, 0, fmt.Errorf("error writing %s %w", f.name, err)
+			}
+		}
+		id, _, _ := bytes.Cut(rec[0][1:], []byte{' '})
+		id, _, _ = bytes.Cut(id, []byte{'\t'})
+		fmt.Fprintf(summary, "%s\t%s\t%s\t%s\t%d\t%.2f\n", f.name, id, barcode, summaryBool(ok), len(rec[1]), q)
+		if ok {
+			pass++
+		} else {
+			fail++
+		}
+	}
+	if err = zstd.Wait(); err != nil {
+		return 0, 0, fmt.Errorf("zstd error: %w", err)
+	}
+	for ok, f := range outs {
+		if err = f.close(); err != nil {
+			return 0, 0, err
+		}
+		delete(outs, ok)
+	}
+	return pass, fail, nil
+}
+
+// Read the four lines of the next fastq record, without their line ends, and
+// whether there was one
+func readRecord(rd *bufio.Reader, rec *[4][]byte) (bool, error) {
+	for i := range rec {
+		line, err := rd.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 {
+			if i == 0 {
+				return false, nil
+			}
+			return false, fmt.Errorf("last record is truncated")
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		rec[i] = bytes.TrimRight(line, "\r\n")
+	}
+	if len(rec[0]) == 0 || rec[0][0] != '@' {
+		return false, fmt.Errorf("not fastq")
+	}
+	return true, nil
+}
+
+// the mean qscore of a read as dorado and MinKNOW compute it, from the mean
+// error probability of its bases
+func meanQscore(qual []byte) float64 {
+	if len(qual) == 0 {
+		return 0
+	}
+	var errSum float64
+	for _, c := range qual {
+		errSum += qualErr[c]
+	}
+	return -10 * math.Log10(errSum/float64(len(qual)))
+}
+
+// passes_filtering as MinKNOW writes it
+func summaryBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+type exportFile struct {
+	name string
+	f    *os.File
+	zw   *gzip.Writer
+}
+
+// fastq_pass/barcode01/run_pass_barcode01_3.fastq.gz, or without barcodes
+// fastq_pass/run_pass_3.fastq.gz
+func createExportFile(dir, prefix string, s exportSource, pass bool) (*exportFile, error) {
+	kind := "fail"
+	if pass {
+		kind = "pass"
+	}
+	sub := filepath.Join(dir, "fastq_"+kind)
+	name := fmt.Sprintf("%s_%s_%d.fastq.gz", prefix, kind, s.entry.Batch)
+	if s.barcode != "" {
+		sub = filepath.Join(sub, s.barcode)
+		name = fmt.Sprintf("%s_%s_%s_%d.fastq.gz", prefix, kind, s.barcode, s.entry.Batch)
+	}
+	if err := os.MkdirAll(sub, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("error making %s %w", sub, err)
+	}
+	f, err := os.Create(filepath.Join(sub, name))
+	if err != nil {
+		return nil, fmt.Errorf("error creating %s %w", name, err)
+	}
+	perms.set(filepath.Join(sub, name))
+	return &exportFile{name: name, f: f, zw: gzip.NewWriter(f)}, nil
+}
+
+func (e *exportFile) close() error {
+	if err := e.zw.Close(); err != nil {
+		e.f.Close()
+		return fmt.Errorf("error writing %s %w", e.name, err)
+	}
+	if err := e.f.Close(); err != nil {
+		return fmt.Errorf("error writing %s %w", e.name, err)
+	}
+	return nil
+}
+
+func (e *exportFile) abort() {
+	e.f.Close()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// extHooks map an input extension to the command converting such a file into
+// something dorado reads, e.g. .blow5 to pod5. {in} is replaced with the input
+// file and {out} with the pod5 to write in the staging directory. A hook using
+// {dir} instead runs once per chunk, with all its files of that extension as
+// {in} and the staging directory as {dir}. {scratch} is a directory for
+// intermediate files, removed with the chunk.
+type extHooks map[string]string
+
+// String and Set implement flag.Value so -ext-hook can be repeated
+func (h extHooks) String() string {
+	exts := make([]string, 0, len(h))
+	for ext := range h {
+		exts = append(exts, ext)
+	}
+	slices.Sort(exts)
+	pairs := make([]string, len(exts))
+	for i, ext := range exts {
+		pairs[i] = ext + "=" + h[ext]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h extHooks) Set(s string) error {
+	ext, cmd, ok := strings.Cut(s, "=")
+	if !ok || !strings.HasPrefix(ext, ".") || cmd == "" {
+		return fmt.Errorf("extension hook %q is not .ext=command", s)
+	}
+	h[ext] = cmd
+	return nil
+}
+
+func (h extHooks) has(ext string) bool {
+	_, ok := h[ext]
+	return ok
+}
+
+// Parse -ext, a comma separated list of extensions to discover
+func parseExts(s string) ([]string, error) {
+	var exts []string
+	for _, ext := range strings.Split(s, ",") {
+		ext = strings.TrimSpace(ext)
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts = append(exts, ext)
+	}
+	if len(exts) == 0 {
+		return nil, fmt.Errorf("-ext needs at least one extension")
+	}
+	return exts, nil
+}
+
+// Put a batch in the staging directory. Files with a hook are converted into
+// it, everything else is symlinked for dorado to read directly, from the
+// cache if there is one, where the files are held until the chunk is done.
+// Remote inputs are downloaded and compressed ones decompressed first.
+func stage(w *workDir, files []pod5, hooks extHooks, cache *pod5Cache, payload hookPayload) error {
+	payload.Stage, payload.Scratch = w.stage, w.scratch
+	perChunk := map[string][]string{}
+	perChunkPaths := map[string][]string{}
+	scratch := shellQuote(w.scratch)
+	for _, f := range files {
+		remote := isURL(f.path)
+		if remote {
+			local, err := fetchInput(f, w.scratch, cache)
+			if err != nil {
+				return err
+			}
+			f.path = local
+			if cache != nil {
+				w.cached = append(w.cached, local)
+			}
+		}
+		inner, codec := unwrapName(f.name)
+		ext := filepath.Ext(inner)
+		hook, ok := hooks[ext]
+		if codec != "" {
+			// decompressed into the stage, or into scratch for the hook
+			src := f.path
+			if cache != nil && !remote {
+				abs, err := filepath.Abs(src)
+				if err != nil {
+					return fmt.Errorf("error resolving %s %w", src, err)
+				}
+				if src, err = cache.get(abs); err != nil {
+					return err
+				}
+				w.cached = append(w.cached, src)
+			}
+			dst := filepath.Join(w.stage, inner)
+			if ok {
+				dst = filepath.Join(w.scratch, inner)
+			}
+			if err := unwrap(src, dst, codec); err != nil {
+				return err
+			}
+			f.path, f.name = dst, inner
+			if !ok {
+				continue
+			}
+		}
+		if !ok {
+			// relative targets would resolve against the staging directory
+			target, err := filepath.Abs(f.path)
+			if err != nil {
+				return fmt.Errorf("error resolving %s %w", f.path, err)
+			}
+			if cache != nil && !remote {
+				if target, err = cache.get(target); err != nil {
+					return err
+				}
+				w.cached = append(w.cached, target)
+			}
+			if err := link(target, filepath.Join(w.stage, f.name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.Contains(hook, "{dir}") {
+			perChunk[ext] = append(perChunk[ext], shellQuote(f.path))
+			perChunkPaths[ext] = append(perChunkPaths[ext], f.path)
+			continue
+		}
+
+		out := filepath.Join(w.stage, strings.TrimSuffix(f.name, ext)+".pod5")
+		payload.Inputs, payload.Output = []string{f.path}, out
+		if err := runHook(hook, payload, "{in}", shellQuote(f.path), "{out}", shellQuote(out), "{scratch}", scratch); err != nil {
+			return fmt.Errorf("error converting %s %w", f.path, err)
+		}
+	}
+
+	for ext, paths := range perChunk {
+		payload.Inputs, payload.Output = perChunkPaths[ext], ""
+		if err := runHook(hooks[ext], payload, "{in}", strings.Join(paths, " "), "{dir}", shellQuote(w.stage), "{scratch}", scratch); err != nil {
+			return fmt.Errorf("error converting %d %s files %w", len(paths), ext, err)
+		}
+	}
+	if cache != nil {
+		cache.evict()
+	}
+	return nil
+}
+
+// Symlink target into the staging directory. Where symlinks need privileges,
+// as on Windows without developer mode, fall back to a hard link and, across
+// volumes, a copy.
+func link(target, path string) error {
+	err := os.Symlink(target, path)
+	if err == nil {
+		return nil
+	}
+	if os.Link(target, path) == nil {
+		return nil
+	}
+	src, oerr := os.Open(target)
+	if oerr != nil {
+		return fmt.Errorf("error creating symbolic link %w", err)
+	}
+	defer src.Close()
+	dst, cerr := os.Create(path)
+	if cerr != nil {
+		return fmt.Errorf("error creating symbolic link %w", err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("error copying %s into staging %w", target, err)
+	}
+	return dst.Close()
+}
+
+// run a hook through the shell with its placeholders replaced and the
+// payload on stdin
+func runHook(hook string, payload hookPayload, replace ...string) error {
+	cmd := strings.NewReplacer(replace...).Replace(hook)
+	convert := shellCommand(cmd)
+	convert.Stdout = os.Stderr
+	convert.Stderr = os.Stderr
+	done, err := payload.attach(convert)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer slots.hold(1)()
+	if err := convert.Run(); err != nil {
+		return fmt.Errorf("with %q: %w", cmd, err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+// Input formats. A bam run re-processes existing uBAMs (keeping their move
+// tables) instead of pod5s, e.g. to add a new modified bases model. dorado
+// writes bam for those, which can't be concatenated or parsed as fastq, so
+// every batch goes to its own file and the fastq stages are left out.
+//
+// blow5 inputs are converted chunk by chunk while staging, by default with
+// blue-crab into pod5, dorado no longer reads the fast5 slow5tools makes.
+const (
+	formatPod5  = "pod5"
+	formatBAM   = "bam"
+	formatBlow5 = "blow5"
+)
+
+const blow5Converter = "blue-crab s2p {in} -d {dir}"
+
+// extension of the input files discovered for a format
+func inputExt(format string) string {
+	switch format {
+	case formatBAM:
+		return ".bam"
+	case formatBlow5:
+		return ".blow5"
+	}
+	return ".pod5"
+}
+
+func (b *batch) checkFormat() error {
+	switch b.format {
+	case formatPod5:
+		return nil
+	case formatBlow5:
+		// -ext-hook .blow5=... swaps in another converter
+		if _, ok := b.hooks[".blow5"]; !ok {
+			b.hooks[".blow5"] = blow5Converter
+		}
+		return nil
+	case formatBAM:
+	default:
+		return fmt.Errorf("-input-format must be pod5, blow5 or bam")
+	}
+	if b.simulated {
+		return fmt.Errorf("-simulate writes fastq and can't be used with -input-format bam")
+	}
+	if b.decontam != nil || b.spotCheck > 0 || b.dups != nil || b.recal != nil || b.prov != nil {
+		return fmt.Errorf("-decontam-ref, -spot-check, -dedup-report, -read-provenance and -qscore-recal read fastq and can't be used with -input-format bam")
+	}
+	b.perBatch = true
+	b.qc = nil
+	b.autoCompress = false
+	b.countReads, b.balance = false, false
+	return nil
+}
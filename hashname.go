@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// With -hash-names every per-batch output is named after a short hash of its
+// inputs and the settings that shape the reads, batch_<hash>.fastq.zst, so an
+// output says what it holds and a run finding the file already there, from an
+// earlier run or another machine, reuses it instead of basecalling again.
+func (b *batch) contentHash(files []pod5) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "model %s\nformat %s\ndorado %s %s\n", b.model, b.format, filepath.Base(b.dpath), b.doradoVersion)
+	if b.recal != nil {
+		fmt.Fprintf(h, "recal %s %s\n", b.recal, b.recal.SHA256)
+	}
+	if b.decontam != nil {
+		fmt.Fprintf(h, "decontam %s\n", filepath.Base(b.decontam.ref))
+	}
+	for _, ext := range slices.Sorted(maps.Keys(b.hooks)) {
+		fmt.Fprintf(h, "hook %s %s\n", ext, b.hooks[ext])
+	}
+	// inputs by what they hold, their paths differ between machines
+	inputs := make([]string, 0, len(files))
+	for _, f := range files {
+		inputs = append(inputs, fmt.Sprintf("%s %s", f.name, inputIdentity(f.path)))
+	}
+	slices.Sort(inputs)
+	fmt.Fprintln(h, strings.Join(inputs, "\n"))
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// tailSpan is how much of the end of an input other than a pod5 is hashed,
+// where the footer or index of most formats sits
+const tailSpan = 1 << 20
+
+// Its size with the file identifier of a pod5, or a hash of the end of any
+// other file. A url is taken as it is, which the server names the same file by.
+func inputIdentity(path string) string {
+	if isURL(path) {
+		return path
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "unreadable"
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "unreadable"
+	}
+	if id, err := pod5FileID(path); err == nil {
+		return fmt.Sprintf("%d %s", info.Size(), id)
+	}
+	h := sha256.New()
+	start := max(info.Size()-tailSpan, 0)
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, info.Size()-start)); err != nil {
+		return "unreadable"
+	}
+	return fmt.Sprintf("%d %x", info.Size(), h.Sum(nil)[:16])
+}
+
+// The version dorado prints, which goes into the hash and the state db, as
+// the same path may hold another dorado on the next run
+func (b *batch) probeDoradoVersion() (string, error) {
+	if b.simulated {
+		return simulatedDorado, nil
+	}
+	p := probeTool(b.dpath, "--version")
+	if p.err != nil {
+		return "", fmt.Errorf("error getting the version of %s %w", b.dpath, p.err)
+	}
+	return p.version, nil
+}
+
+// Take over the output of an identical batch if one is already in the output
+// directory. Its reads go through the qc, the duplicate index and the read
+// provenance on the way, as those of a batch basecalled again would.
+func (b *batch) reuseBatch(index int, files []pod5, hash string) (*batchRecord, bool) {
+	path := b.pool.outputPath(index, hash)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false
+	}
+	var snap *qcWriter
+	sinks := []io.Writer{io.Discard}
+	if b.qc != nil {
+		snap = b.qc.snapshot()
+		sinks = append(sinks, b.qc)
+	}
+	if b.dupWriter != nil {
+		sinks = append(sinks, b.dupWriter)
+	}
+	if b.provWriter != nil {
+		sinks = append(sinks, b.provWriter)
+	}
+	sum := sha256.New()
+	if err := decompressInto(path, sum, io.MultiWriter(sinks...)); err != nil {
+		fmt.Printf("can't reuse %s, basecalling batch %d again: %s\n", path, index, err)
+		if snap != nil {
+			b.qc.restore(snap)
+		}
+		if b.dupWriter != nil {
+			b.dupWriter.drop()
+		}
+		if b.provWriter != nil {
+			b.provWriter.drop()
+		}
+		return nil, false
+	}
+	var reads, bases int64
+	if b.qc != nil {
+		reads, bases = b.qc.batchReads, b.qc.batchBases
+		b.qc.batchReads, b.qc.batchBases = 0, 0
+	}
+
+	rec := b.state.addBatch(index, files)
+	rec.Hash, rec.Output, rec.Length = hash, path, info.Size()
+	rec.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	rec.Reads, rec.Bases = reads, bases
+	rec.Reused = true
+	rec.Done = true
+	fmt.Printf("batch %d: reusing %s\n", index, path)
+	if b.dupWriter != nil {
+		if n := b.dupWriter.commit(rec.Index); n > 0 {
+			fmt.Printf("batch %d: %d read IDs already written by earlier batches\n", rec.Index, n)
+		}
+	}
+	if b.provWriter != nil {
+		if err := b.provWriter.commit(rec.Index, rec.Files); err != nil {
+			fmt.Println(err)
+		}
+	}
+	metrics.add("dbatch_batches_done_total", 1)
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+	b.audit.record(b.out, "batch_reused", map[string]any{"batch": index, "output": path, "hash": hash})
+	b.publishBatch(rec)
+	if err := newManifest(b.state).write(b.manifestPath()); err != nil {
+		fmt.Println(err)
+	}
+	return rec, true
+}
+
+// decompress path into w, summing the compressed bytes into sum
+func decompressInto(path string, sum io.Writer, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s %w", path, err)
+	}
+	defer f.Close()
+	zstd := command("zstd", "-dc")
+	zstd.Stdin = io.TeeReader(f, sum)
+	zstd.Stdout = w
+	zstd.Stderr = os.Stderr
+	defer slots.hold(1)()
+	if err := zstd.Run(); err != nil {
+		return fmt.Errorf("zstd error: %w", err)
+	}
+	return nil
+}
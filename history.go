@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every done batch of every run is appended to a history shared across runs,
+// by default ~/.dbatch/history.jsonl or $DBATCH_HISTORY, one json line per
+// batch with where it ran and how long each stage took. dbatch history shows
+// the trend of those per host, gpu and model over the weeks, where a slowly
+// degrading GPU or storage shows long before any run fails.
+type historyEntry struct {
+	Time   string     `json:"time"`
+	Host   string     `json:"host"`
+	Device string     `json:"device,omitempty"`
+	GPU    string     `json:"gpu,omitempty"`
+	Model  string     `json:"model"`
+	Out    string     `json:"out"`
+	Batch  int        `json:"batch"`
+	Files  int        `json:"files"`
+	Reads  int64      `json:"reads"`
+	Bases  int64      `json:"bases"`
+	Times  stageTimes `json:"timings"`
+	Labels labels     `json:"labels,omitempty"`
+}
+
+func defaultHistory() string {
+	if path := os.Getenv("DBATCH_HISTORY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".dbatch", "history.jsonl")
+}
+
+// Append a done batch to -history. Reused batches didn't run and aren't recorded.
+func (b *batch) recordHistory(rec *batchRecord) {
+	if b.history == "" || rec.Reused || rec.Timings == nil {
+		return
+	}
+	if b.gpu == nil {
+		gpu := gpuName(b.device)
+		b.gpu = &gpu
+	}
+	host, _ := os.Hostname()
+	e := historyEntry{
+		Time: timestamp(time.Now()), Host: host, Device: b.device, GPU: *b.gpu,
+		Model: b.model, Out: b.outName(), Batch: rec.Index, Files: len(rec.Files),
+		Reads: rec.Reads, Bases: rec.Bases, Times: *rec.Timings, Labels: b.labels,
+	}
+	if err := appendHistory(b.history, e); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func appendHistory(path string, e historyEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding history %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error making history directory %w", err)
+	}
+	// runs on other hosts may append to a shared history at the same time
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening history %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing history %w", err)
+	}
+	return nil
+}
+
+// The name of the gpu dorado runs on, from nvidia-smi, empty without one.
+// cuda:1 is the second gpu, anything else the first.
+func gpuName(device string) string {
+	index := 0
+	if n, ok := strings.CutPrefix(device, "cuda:"); ok {
+		if i, err := strconv.Atoi(n); err == nil {
+			index = i
+		}
+	}
+	out, err := command("nvidia-smi", "--query-gpu=name", "--format=csv,noheader").Output()
+	if err != nil {
+		return ""
+	}
+	gpus := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if index >= len(gpus) {
+		return ""
+	}
+	return strings.TrimSpace(gpus[index])
+}
+
+// one bucket of a trend, the medians of the batches in it
+type historyPoint struct {
+	Group          string  `json:"group"`
+	Period         string  `json:"period"`
+	Batches        int     `json:"batches"`
+	BasesPerSecond float64 `json:"bases_per_second"`
+	Staging        float64 `json:"staging_seconds"`
+	Startup        float64 `json:"startup_seconds"`
+	Tail           float64 `json:"tail_seconds"`
+}
+
+// throughput below this share of the first period of a group is flagged
+const historyDrop = 0.85
+
+// dbatch history summarises the batch history per host, gpu and model by week
+func historyMain(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	path := fs.String("history", defaultHistory(), "batch history to read, default $DBATCH_HISTORY or ~/.dbatch/history.jsonl")
+	since := fs.String("since", "12w", "only batches done in this long, e.g. 12w or 30d")
+	by := fs.String("by", "host,gpu,model", "comma separated fields to group by: host, device, gpu, model and out")
+	day := fs.Bool("daily", false, "one period per day instead of per week")
+	asJSON := fs.Bool("json", false, "print the trend points as json, e.g. for a dashboard")
+	localTimes := fs.Bool("local-time", false, "print times in the local zone")
+	fs.Parse(args)
+	setLocalTime(*localTimes)
+
+	age, err := parseAge(*since)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readHistory(*path, time.Now().Add(-age))
+	if err != nil {
+		log.Fatal(err)
+	}
+	points, err := historyTrend(entries, strings.Split(*by, ","), *day)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(points, "", "  ")
+		if err != nil {
+			log.Fatalf("error encoding history %s", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if len(points) == 0 {
+		fmt.Printf("no batches in %s since %s\n", *path, displayTime(time.Now().Add(-age)))
+		return
+	}
+	printHistory(points)
+}
+
+func readHistory(path string, since time.Time) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening history %w", err)
+	}
+	defer f.Close()
+	var entries []historyEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		var e historyEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// a line cut by a crash doesn't spoil the rest
+			fmt.Printf("warning: skipping line %d of %s: %s\n", line, path, err)
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, e.Time); err == nil && t.Before(since) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading history %w", err)
+	}
+	return entries, nil
+}
+
+// Group the entries and bucket them by period, oldest first within a group
+func historyTrend(entries []historyEntry, by []string, daily bool) ([]historyPoint, error) {
+	type key struct{ group, period string }
+	buckets := map[key][]historyEntry{}
+	for _, e := range entries {
+		var parts []string
+		for _, field := range by {
+			switch strings.TrimSpace(field) {
+			case "host":
+				parts = append(parts, e.Host)
+			case "device":
+				parts = append(parts, cmp.Or(e.Device, "default"))
+			case "gpu":
+				parts = append(parts, cmp.Or(e.GPU, "no gpu"))
+			case "model":
+				parts = append(parts, e.Model)
+			case "out":
+				parts = append(parts, e.Out)
+			default:
+				return nil, fmt.Errorf("can't group history by %q, use host, device, gpu, model or out", field)
+			}
+		}
+		t, err := time.Parse(time.RFC3339, e.Time)
+		if err != nil {
+			continue
+		}
+		period := t.Format(time.DateOnly)
+		if !daily {
+			year, week := t.ISOWeek()
+			period = fmt.Sprintf("%d-W%02d", year, week)
+		}
+		k := key{strings.Join(parts, " "), period}
+		buckets[k] = append(buckets[k], e)
+	}
+
+	var points []historyPoint
+	for k, es := range buckets {
+		var rate, staging, startup, tail []float64
+		for _, e := range es {
+			if e.Times.Basecall > 0 {
+				rate = append(rate, float64(e.Bases)/e.Times.Basecall)
+			}
+			staging = append(staging, e.Times.Staging)
+			startup = append(startup, e.Times.Startup)
+			tail = append(tail, e.Times.Tail)
+		}
+		points = append(points, historyPoint{
+			Group: k.group, Period: k.period, Batches: len(es),
+			BasesPerSecond: median(rate), Staging: median(staging), Startup: median(startup), Tail: median(tail),
+		})
+	}
+	slices.SortFunc(points, func(x, y historyPoint) int {
+		return cmp.Or(strings.Compare(x.Group, y.Group), strings.Compare(x.Period, y.Period))
+	})
+	return points, nil
+}
+
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	slices.Sort(v)
+	return v[len(v)/2]
+}
+
+// Print each group's periods and flag a group whose throughput fell well
+// under that of its first period
+func printHistory(points []historyPoint) {
+	fmt.Println("=============================================")
+	for i, p := range points {
+		if i == 0 || points[i-1].Group != p.Group {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Println(p.Group)
+			fmt.Printf("  %-10s %8s %14s %10s %10s %10s\n", "period", "batches", "bases/s", "staging", "startup", "tail")
+		}
+		fmt.Printf("  %-10s %8d %14s %10s %10s %10s\n", p.Period, p.Batches, baseCount(int64(p.BasesPerSecond)), seconds(p.Staging), seconds(p.Startup), seconds(p.Tail))
+		last := i == len(points)-1 || points[i+1].Group != p.Group
+		if !last {
+			continue
+		}
+		first := i
+		for first > 0 && points[first-1].Group == p.Group {
+			first--
+		}
+		if base := points[first].BasesPerSecond; first < i && base > 0 && p.BasesPerSecond < historyDrop*base {
+			fmt.Printf("  warning: throughput down %.0f%% since %s, check the gpu and storage\n", 100*(1-p.BasesPerSecond/base), points[first].Period)
+		}
+	}
+	fmt.Println("=============================================")
+}
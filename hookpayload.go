@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Ext hooks are told about the chunk they run for, so scripts doing more than
+// a plain conversion don't have to work it out from file names: as json on
+// stdin, and the gist of it in DBATCH_* environment variables.
+type hookPayload struct {
+	Batch int    `json:"batch"`
+	Model string `json:"model"`
+	In    string `json:"in"`
+	Out   string `json:"out"`
+	// what the batch is written to, its own file with -per-batch
+	BatchOutput string   `json:"batch_output"`
+	Files       []string `json:"files"` // all inputs of the batch
+	// the inputs of this run of the hook and the pod5 it writes, or with a
+	// {dir} hook the staging directory
+	Inputs  []string  `json:"inputs"`
+	Output  string    `json:"output,omitempty"`
+	Stage   string    `json:"stage"`
+	Scratch string    `json:"scratch"`
+	Stats   hookStats `json:"stats"`
+}
+
+type hookStats struct {
+	// reads in the pod5 footers of the batch, 0 when not counted
+	ExpectedReads int64 `json:"expected_reads"`
+	Batches       int   `json:"batches"` // planned for the whole run
+	// so far by this instance, or with -devices this device's pipeline
+	BatchesDone int   `json:"batches_done"`
+	FilesDone   int   `json:"files_done"`
+	ReadsDone   int64 `json:"reads_done"`
+}
+
+// The payload of the hooks staging batch index
+func (b *batch) hookPayload(index int, files []pod5, hash string) hookPayload {
+	p := hookPayload{
+		Batch: index, Model: b.model, In: b.in, Out: b.out, BatchOutput: b.out,
+		Stats: hookStats{Batches: len(b.plan), FilesDone: b.filesDone, ReadsDone: b.readsDone},
+	}
+	if b.state != nil {
+		for _, rec := range b.state.Batches {
+			if rec.Done {
+				p.Stats.BatchesDone++
+			}
+		}
+	}
+	if b.pool != nil {
+		p.BatchOutput = b.pool.outputPath(index, hash)
+	}
+	for _, f := range files {
+		p.Files = append(p.Files, f.path)
+		p.Stats.ExpectedReads += max(f.reads, 0)
+	}
+	return p
+}
+
+// Hand the payload to a hook about to run, done removes it once it has
+func (p hookPayload) attach(cmd *exec.Cmd) (done func(), err error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding hook payload %w", err)
+	}
+	// a file rather than a pipe, hooks not reading it never block and may seek
+	stdin, err := os.CreateTemp(p.Scratch, "hook-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("error writing hook payload %w", err)
+	}
+	done = func() {
+		stdin.Close()
+		os.Remove(stdin.Name())
+	}
+	if _, err := stdin.Write(data); err != nil {
+		done()
+		return nil, fmt.Errorf("error writing hook payload %w", err)
+	}
+	if _, err := stdin.Seek(0, 0); err != nil {
+		done()
+		return nil, fmt.Errorf("error writing hook payload %w", err)
+	}
+	cmd.Stdin = stdin
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("DBATCH_BATCH=%d", p.Batch),
+		"DBATCH_MODEL="+p.Model,
+		"DBATCH_OUT="+p.Out,
+		"DBATCH_BATCH_OUTPUT="+p.BatchOutput,
+		"DBATCH_STAGE="+p.Stage,
+		"DBATCH_SCRATCH="+p.Scratch,
+		"DBATCH_PAYLOAD="+stdin.Name(),
+	)
+	return done, nil
+}
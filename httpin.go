@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Input from a data portal: with -in https://server/runs/xyz/ the index at the
+// url, a json list or an html directory listing, is read instead of walking a
+// directory, following links to directories below it. The files of a chunk
+// are downloaded into its working directory, or into the cache, while the
+// chunk is staged. Interrupted downloads are resumed with range requests.
+
+// set once the run flags are parsed, like childEnv
+var inputToken string
+
+// attempts at a download, each resuming where the last one stopped
+const fetchAttempts = 5
+
+var inputClient = &http.Client{Transport: &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: time.Minute,
+	IdleConnTimeout:       time.Minute,
+}}
+
+var hrefRe = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'#?]+)`)
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func inputRequest(method, u string) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if inputToken != "" {
+		req.Header.Set("Authorization", "Bearer "+inputToken)
+	}
+	return req, nil
+}
+
+// List the files with one of exts below the index at in, sorted by url
+func listRemote(in string, exts []string) ([]pod5, error) {
+	base, err := url.Parse(in)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -in %w", err)
+	}
+	// links are resolved against a directory
+	if !strings.HasSuffix(base.Path, "/") && path.Ext(base.Path) == "" {
+		base.Path += "/"
+	}
+	var found []pod5
+	seen := map[string]bool{base.String(): true}
+	queue := []*url.URL{base}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		links, err := fetchIndex(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range links {
+			u := dir.ResolveReference(link)
+			u.RawQuery, u.Fragment = "", ""
+			// only what lies below the index, not parent or sibling links
+			if u.Host != base.Host || !strings.HasPrefix(u.Path, base.Path) || seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+			switch name := path.Base(u.Path); {
+			case strings.HasSuffix(u.Path, "/"):
+				queue = append(queue, u)
+			case isInput(name, exts):
+				found = append(found, pod5{path: u.String(), name: name, reads: -1})
+			}
+		}
+	}
+	slices.SortFunc(found, func(a, b pod5) int { return strings.Compare(a.path, b.path) })
+	return found, nil
+}
+
+// The links of one index, from a json list of urls or of objects with a url,
+// href or name, or the hrefs of an html page
+func fetchIndex(dir *url.URL) ([]*url.URL, error) {
+	req, err := inputRequest(http.MethodGet, dir.String())
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s %w", dir, err)
+	}
+	req.Header.Set("Accept", "application/json, text/html;q=0.9")
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s %w", dir, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing %s: %s", dir, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s %w", dir, err)
+	}
+
+	var refs []string
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") || bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(body, &entries); err != nil {
+			return nil, fmt.Errorf("error parsing the listing of %s %w", dir, err)
+		}
+		for _, e := range entries {
+			var s string
+			var obj struct{ URL, Href, Name string }
+			if json.Unmarshal(e, &s) == nil {
+				refs = append(refs, s)
+			} else if json.Unmarshal(e, &obj) == nil {
+				refs = append(refs, cmp.Or(obj.URL, obj.Href, obj.Name))
+			}
+		}
+	} else {
+		for _, m := range hrefRe.FindAllStringSubmatch(string(body), -1) {
+			refs = append(refs, m[1])
+		}
+	}
+	var links []*url.URL
+	for _, ref := range refs {
+		if u, err := url.Parse(strings.TrimSpace(ref)); err == nil && ref != "" {
+			links = append(links, u)
+		}
+	}
+	return links, nil
+}
+
+// Download a remote input to a local file, into the cache when there is one
+// and otherwise the chunk's scratch directory, and return its path
+func fetchInput(f pod5, scratch string, cache *pod5Cache) (string, error) {
+	if cache != nil {
+		return cache.getURL(f.path, f.name)
+	}
+	dst := filepath.Join(scratch, f.name)
+	return dst, fetchURL(f.path, dst)
+}
+
+// Download u to dst through a partial file, resuming it with a range request
+// after an interrupted transfer, also one left by an earlier run
+func fetchURL(u, dst string) error {
+	partial := dst + cacheTmp
+	var err error
+	for attempt := 1; attempt <= fetchAttempts; attempt++ {
+		var done bool
+		if done, err = fetchRange(u, partial); done {
+			return os.Rename(partial, dst)
+		}
+		if attempt < fetchAttempts {
+			fmt.Printf("error downloading %s, retrying: %s\n", u, err)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return fmt.Errorf("error downloading %s %w", u, err)
+}
+
+// One attempt, appending to what partial already holds. done is only true once
+// the whole file is there.
+func fetchRange(u, partial string) (done bool, err error) {
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := inputRequest(http.MethodGet, u)
+	if err != nil {
+		return false, err
+	}
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
+	resp, err := inputClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && have > 0:
+		fmt.Printf("resuming %s at %s\n", path.Base(u), bytesIEC(have))
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && have > 0:
+		// the partial file already holds all of it
+		return true, nil
+	case resp.StatusCode == http.StatusOK:
+		// no range support, or nothing to resume
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("server replied %s", resp.Status)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return false, fmt.Errorf("got %s of %s", bytesIEC(n), bytesIEC(resp.ContentLength))
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Path of the cached download of u, fetched first if it isn't cached yet.
+// Remote files are keyed by url alone, a partial download is resumed.
+func (c *pod5Cache) getURL(u, name string) (string, error) {
+	sum := sha256.Sum256([]byte(u))
+	cached := filepath.Join(c.dir, hex.EncodeToString(sum[:8])+"-"+name)
+	if err := c.fill(cached, func() error { return fetchURL(u, cached) }); err != nil {
+		return "", err
+	}
+	return cached, nil
+}
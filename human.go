@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Formatting for numbers meant to be read by people, used by progress, plans
+// and reports alike. The state db, manifest, metrics and json reports keep the
+// raw values.
+
+// 1234567 -> 1,234,567
+func thousands(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, s = "-", s[1:]
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return sign + s
+}
+
+// sizes in IEC units, 1536 -> 1.5 KiB
+func bytesIEC(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/unit, 0
+	for ; v >= unit && i < 5; i++ {
+		v /= unit
+	}
+	return fmt.Sprintf("%.1f %ciB", v, "KMGTPE"[i])
+}
+
+// bases in SI units as sequencing reports them, 1234567890 -> 1.23 Gb
+func baseCount(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d b", n)
+	}
+	v, i := float64(n)/unit, 0
+	for ; v >= unit && i < 5; i++ {
+		v /= unit
+	}
+	return fmt.Sprintf("%.2f %cb", v, "kMGTPE"[i])
+}
+
+// durations at the precision that matters for their size, 850µs, 12ms, 4.2s,
+// 3m05s, 2h07m
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Millisecond:
+		return d.Round(time.Microsecond).String()
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	case d < time.Hour:
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	d = d.Round(time.Minute)
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
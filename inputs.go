@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"os"
+)
+
+// The inputs of a run in planning order. Up to -index-files of them are kept
+// in memory, past that their paths are spilled to an index in the run
+// directory and only the offset and read count of each, 16 bytes a file, stay
+// behind, so planning a PromethION archive of millions of files doesn't
+// exhaust RAM before the first batch. Batches read their files back from the
+// index as they start.
+type fileList struct {
+	mem   []pod5
+	limit int    // files kept in memory, 0 for all of them
+	path  string // of the index, none keeps everything in memory
+
+	f       *os.File
+	w       *bufio.Writer
+	offsets []int64 // of each file's record in the index, and of the end
+	reads   []int64
+}
+
+func indexPath(out string) string {
+	return runFile(out, "inputs.idx")
+}
+
+// files read back from the index at a time when walking it
+const indexBlock = 4096
+
+func newFileList(path string, limit int) *fileList {
+	return &fileList{path: path, limit: limit}
+}
+
+func memFileList(files []pod5) *fileList {
+	return &fileList{mem: files}
+}
+
+func (l *fileList) indexed() bool {
+	return l.offsets != nil
+}
+
+func (l *fileList) len() int {
+	switch {
+	case l == nil:
+		return 0
+	case l.indexed():
+		return len(l.reads)
+	}
+	return len(l.mem)
+}
+
+func (l *fileList) add(f pod5) error {
+	if !l.indexed() {
+		if l.limit <= 0 || l.path == "" || len(l.mem) < l.limit {
+			l.mem = append(l.mem, f)
+			return nil
+		}
+		if err := l.spill(); err != nil {
+			return err
+		}
+	}
+	// a record is the path and name, each ended by a nul no path holds
+	n, err := fmt.Fprintf(l.w, "%s\x00%s\x00", f.path, f.name)
+	if err != nil {
+		return fmt.Errorf("error writing input index %w", err)
+	}
+	l.offsets = append(l.offsets, l.offsets[len(l.offsets)-1]+int64(n))
+	l.reads = append(l.reads, f.reads)
+	return nil
+}
+
+// Move the files so far into the index, the rest are added to it directly
+func (l *fileList) spill() error {
+	f, err := os.Create(l.path)
+	if err != nil {
+		return fmt.Errorf("error creating input index %w", err)
+	}
+	l.f, l.w, l.offsets = f, bufio.NewWriterSize(f, 1<<20), []int64{0}
+	mem := l.mem
+	l.mem = nil
+	for _, p := range mem {
+		if err := l.add(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish adding, the list is only read from afterwards
+func (l *fileList) seal() error {
+	if l.w == nil {
+		return nil
+	}
+	if err := l.w.Flush(); err != nil {
+		return fmt.Errorf("error writing input index %w", err)
+	}
+	l.w = nil
+	return nil
+}
+
+// Remove the index, once the run is over
+func (l *fileList) close() {
+	if l == nil || l.f == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.path)
+	l.f = nil
+}
+
+// files start to end, read back from the index if spilled. Pipelines of
+// several devices read at the same time, which ReadAt allows.
+func (l *fileList) files(start, end int) ([]pod5, error) {
+	if !l.indexed() {
+		return l.mem[start:end], nil
+	}
+	if l.f == nil {
+		return nil, fmt.Errorf("error reading input index %s, it's closed", l.path)
+	}
+	buf := make([]byte, l.offsets[end]-l.offsets[start])
+	if _, err := l.f.ReadAt(buf, l.offsets[start]); err != nil {
+		return nil, fmt.Errorf("error reading input index %w", err)
+	}
+	files := make([]pod5, 0, end-start)
+	for i := start; i < end; i++ {
+		path, rest, _ := bytes.Cut(buf, []byte{0})
+		name, rest, _ := bytes.Cut(rest, []byte{0})
+		files = append(files, pod5{path: string(path), name: string(name), reads: l.reads[i]})
+		buf = rest
+	}
+	return files, nil
+}
+
+// Call fn with each of the files start to end, in blocks when indexed
+func (l *fileList) each(start, end int, fn func(i int, f pod5) error) error {
+	for from := start; from < end; from += indexBlock {
+		files, err := l.files(from, min(from+indexBlock, end))
+		if err != nil {
+			return err
+		}
+		for i, f := range files {
+			if err := fn(from+i, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *fileList) readCount(i int) int64 {
+	if l.indexed() {
+		return l.reads[i]
+	}
+	return l.mem[i].reads
+}
+
+func (l *fileList) setReads(i int, n int64) {
+	if l.indexed() {
+		l.reads[i] = n
+	} else {
+		l.mem[i].reads = n
+	}
+}
+
+// An empty list to reorder this one into, indexed next to it when it grows as big
+func (l *fileList) derive() *fileList {
+	path := l.path
+	if path != "" {
+		path += ".new"
+	}
+	return newFileList(path, l.limit)
+}
+
+// Take over the files of a list derived from this one
+func (l *fileList) replace(n *fileList) error {
+	if err := n.seal(); err != nil {
+		return err
+	}
+	path := l.path
+	l.close()
+	if n.f != nil {
+		// windows can't rename over an open file
+		n.f.Close()
+		if err := os.Rename(n.path, path); err != nil {
+			return fmt.Errorf("error replacing input index %w", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error opening input index %w", err)
+		}
+		n.f = f
+	}
+	n.path = path
+	*l = *n
+	return nil
+}
+
+// Paths are compared by a 64 bit hash when a rescan looks for files added and
+// removed, so the sets of an archive don't hold every path twice more
+func pathKey(path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return h.Sum64()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// labels are free-form key=value annotations carried through a run, e.g.
+// project, sample owner and billing codes
+type labels map[string]string
+
+// label keys double as prometheus label names so are restricted to match them
+var labelKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// String and Set implement flag.Value so -label can be repeated
+func (l labels) String() string {
+	keys := l.keys()
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l labels) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("label %q is not key=value", s)
+	}
+	if !labelKey.MatchString(k) {
+		return fmt.Errorf("label key %q must be letters, digits and underscores", k)
+	}
+	l[k] = v
+	return nil
+}
+
+func (l labels) has(key string) bool {
+	_, ok := l[key]
+	return ok
+}
+
+func (l labels) keys() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// sampled reads the rolling estimate is taken over
+const liveWindow = 1000
+
+// liveQC keeps a rolling estimate of qscore and read length over the most
+// recent of a sample of the reads, while they stream out of dorado, so a
+// failing flowcell shows in the metrics and the daemon's status long before
+// the qc report at the end of the run. Shared by the device pipelines.
+type liveQC struct {
+	mu    sync.Mutex
+	every int64 // one read in every is sampled
+	seen  int64
+	ring  []liveRead
+	next  int
+
+	minQ float64 // warn below, 0 for never
+	low  bool
+}
+
+type liveRead struct {
+	length  int
+	meanErr float64
+}
+
+// what the status api reports
+type liveSummary struct {
+	Sampled    int     `json:"sampled"`
+	MeanLength float64 `json:"mean_length"`
+	MeanQ      float64 `json:"mean_qscore"`
+}
+
+func newLiveQC(fraction, minQ float64) *liveQC {
+	return &liveQC{every: max(1, int64(math.Round(1/fraction))), minQ: minQ}
+}
+
+func (l *liveQC) add(length int, meanErr float64) {
+	l.mu.Lock()
+	l.seen++
+	if l.seen%l.every != 0 {
+		l.mu.Unlock()
+		return
+	}
+	if len(l.ring) < liveWindow {
+		l.ring = append(l.ring, liveRead{length, meanErr})
+	} else {
+		l.ring[l.next] = liveRead{length, meanErr}
+	}
+	l.next = (l.next + 1) % liveWindow
+	sampled := l.seen / l.every
+	l.mu.Unlock()
+
+	// the metrics are written every few seconds, no need to update them per read
+	if sampled%100 == 0 {
+		s := l.summary()
+		metrics.set("dbatch_live_mean_qscore", s.MeanQ)
+		metrics.set("dbatch_live_mean_read_length", s.MeanLength)
+	}
+}
+
+func (l *liveQC) summary() liveSummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := liveSummary{Sampled: len(l.ring)}
+	if s.Sampled == 0 {
+		return s
+	}
+	var bases int64
+	var errSum float64
+	for _, r := range l.ring {
+		bases += int64(r.length)
+		errSum += r.meanErr
+	}
+	s.MeanLength = float64(bases) / float64(s.Sampled)
+	s.MeanQ = -10 * math.Log10(errSum/float64(s.Sampled))
+	return s
+}
+
+// Print the estimate after a batch, warning once when it falls under
+// -live-qc-min-qscore and again once it recovers
+func (b *batch) checkLiveQC() {
+	l := b.qc.live
+	s := l.summary()
+	if s.Sampled == 0 {
+		return
+	}
+	fmt.Printf("live qc: mean qscore %.1f, mean length %s over the last %s sampled reads\n", s.MeanQ, thousands(int64(s.MeanLength)), thousands(int64(s.Sampled)))
+	metrics.set("dbatch_live_mean_qscore", s.MeanQ)
+	metrics.set("dbatch_live_mean_read_length", s.MeanLength)
+	if l.minQ <= 0 || s.Sampled < liveWindow/10 {
+		return
+	}
+	l.mu.Lock()
+	low := s.MeanQ < l.minQ
+	changed := low != l.low
+	l.low = low
+	l.mu.Unlock()
+	switch {
+	case changed && low:
+		fmt.Printf("warning: live mean qscore %.1f is under %.1f, check the flowcell\n", s.MeanQ, l.minQ)
+		b.audit.record(b.out, "live_qc_low", map[string]any{"batch": b.current, "mean_qscore": s.MeanQ, "mean_length": s.MeanLength})
+	case changed:
+		fmt.Printf("live mean qscore back at %.1f\n", s.MeanQ)
+		b.audit.record(b.out, "live_qc_recovered", map[string]any{"batch": b.current, "mean_qscore": s.MeanQ})
+	}
+}
@@ -1,132 +1,1133 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type batch struct {
-	pod5s []pod5
+	pod5s *fileList // see inputs.go
 	next  int
+	// inputs kept in memory before the rest are indexed on disk
+	indexFiles int
 
-	dpath string
-	in    string
-	out   string
-	chunk int
-	mp    bool
+	// chunks of pod5s to basecall, see plan.go
+	plan       []span
+	nextChunk  int
+	countReads bool
+	balance    bool
+
+	// progress for the eta
+	started       time.Time
+	expectedReads int64
+	expectedFiles int
+	uncounted     bool
+	readsDone     int64
+	filesDone     int
+
+	dpath  string
+	model  string
+	format string // pod5, blow5 or bam, see format.go
+	exts   []string
+	hooks  extHooks
+	in     string
+	out    string
+	chunk  int
+	mp     bool
+
+	// -coalesce-chunks, and whether -chunk was judged yet, see chunkguard.go
+	coalesce     bool
+	chunkChecked bool
+
+	monitorFormat string // csv or csv.gz
+
+	// compressor escalation, see compress.go
+	autoCompress    bool
+	compressLevel   int
+	compressSettled bool
+
+	throttle *throttle
+
+	qc     *qcWriter
+	qcMode string
+
+	decontam *decontam
+	recal    *qscoreRecal
+	cache    *pod5Cache
+
+	// -dedup-report, the index is shared by device pipelines
+	dups      *dupIndex
+	dupWriter *dupWriter
+
+	// -read-provenance, shared by device pipelines like the dup index
+	prov       *provenance
+	provWriter *provWriter
+
+	spotCheck float64
+
+	// -otel-endpoint, a new trace for every run
+	otelEndpoint string
+	redact       redaction // of what metrics, events, alerts and traces carry
+	tracer       *tracer
+
+	// -chunk-sla-factor, nil if off
+	sla *chunkSLA
+
+	// -publish, batch events to a nats subject
+	publisher *publisher
+
+	labels labels
+
+	// -shard k/n, this instance basecalls every n-th chunk into its own
+	// shard of sharedOut
+	shard     int
+	shards    int
+	sharedOut string
+
+	// root of the chunk working directories, and that of the current chunk
+	tmp  string
+	work *workDir
+
+	// -read-only-input, nothing may be written inside b.in
+	readOnlyIn bool
+
+	retries         int
+	continueOnError bool
+	quarantine      *quarantine // files of the batches skipped, see quarantine.go
+
+	rescan bool
+
+	// -older-than and -skip-done select the inputs of a sweep, see age.go
+	olderThan time.Duration
+	done      map[string]bool
+
+	// inputs left out on purpose by -skip-list, see skiplist.go
+	skipListPath   string
+	skips          *skipList
+	skippedFiles   []skipRecord
+	skippedBatches []skipRecord
+
+	// -only-files and -only-batch pin the run to one chunk, see pin.go
+	onlyFiles string
+	onlyBatch int
+
+	// -planner, a command chunking the run in place of -chunk, see planner.go
+	planner string
+
+	// -warm-worker, a command keeping the model loaded across chunks, see warmstart.go
+	warmCmd string
+	warm    *warmWorker
+
+	// -priority-barcodes, the first priorityFiles inputs hold their reads
+	priorityBarcodes []string
+	priorityFrom     string
+	priorityFiles    int
+	priorityOnly     bool
+
+	// -history, see history.go, with the gpu name looked up once
+	history string
+	gpu     *string
+
+	// -devices runs one pipeline per device, see devices.go
+	devices        []string
+	device         string
+	deviceFailures int
+	unhealthy      bool
+	cpu            cpuFallback // see cpufallback.go
+
+	// -per-batch writes every batch to its own file under b.out
+	perBatch        bool
+	journal         bool
+	hashNames       bool
+	doradoVersion   string // probed with -hash-names
+	compressWorkers int
+	spool           string
+	pool            *compressPool
+	verifyWorkers   int
+	verifier        *verifyPool
+	current         int // batch being basecalled
+
+	batchLogs bool
+
+	// -simulate runs dbatch itself as dorado, with these leading arguments
+	simulated  bool
+	doradoArgs []string
+
+	// called between batches, the daemon runs priority jobs from it
+	yield func()
+	// set by the daemon, whether the run was canceled
+	canceled func() bool
+
+	// end of dorado's stderr from the last call
+	lastStderr string
+	// startup, basecall and tail times of the last call
+	lastTimes stageTimes
+
+	audit     *auditLog
+	auditPath string
+	config    map[string]string
+	env       []string // KEY=VALUE for child processes
+
+	// command lines of the children of the last call
+	lastCommands []string
+
+	// byte range of b.out, or of the spooled batch, written by the last call
+	lastPath   string
+	lastOffset int64
+	lastLength int64
+
+	state *runState
 }
 
 type pod5 struct {
-	path string
-	name string
+	path  string
+	name  string
+	reads int64 // from the footer, 0 if not read yet and -1 if unreadable
 }
 
 func main() {
+	setLocalTime(false)
+
+	// subcommands, anything else is a normal run
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "redo":
+			redoMain(os.Args[2:])
+			return
+		case "daemon":
+			daemonMain(os.Args[2:])
+			return
+		case "cancel":
+			cancelMain(os.Args[2:])
+			return
+		case "export":
+			exportMain(os.Args[2:])
+			return
+		case "demux":
+			demuxMain(os.Args[2:])
+			return
+		case "note":
+			noteMain(os.Args[2:])
+			return
+		case "stats":
+			statsMain(os.Args[2:])
+			return
+		case "sweep":
+			sweepMain(os.Args[2:])
+			return
+		case "deliveries":
+			deliveriesMain(os.Args[2:])
+			return
+		case "seal":
+			sealMain(os.Args[2:])
+			return
+		case "history":
+			historyMain(os.Args[2:])
+			return
+		case "triage":
+			triageMain(os.Args[2:])
+			return
+		case "simulate-dorado":
+			simulateMain(os.Args[2:])
+			return
+		case "remote":
+			remoteMain(os.Args[2:])
+			return
+		case "config":
+			configMain(os.Args[2:])
+			return
+		case "doctor":
+			doctorMain(os.Args[2:])
+			return
+		case "version":
+			versionMain(os.Args[2:])
+			return
+		case "self-update":
+			selfUpdateMain(os.Args[2:])
+			return
+		case "audit":
+			auditMain(os.Args[2:])
+			return
+		case "bench-pipe":
+			benchPipeMain(os.Args[2:])
+			return
+		case "builtin-zstd":
+			builtinZstdMain(os.Args[2:])
+			return
+		}
+	}
 
 	// Parse flags and check for required input
-	in := flag.String("in", "", "Path to pod5s")
-	dpath := flag.String("dorado", "", "Path to dorado")
-	out := flag.String("out", "", "Output file path")
-	chunk := flag.Int("chunk", 50, "chunk size, default 50")
-	mp := flag.Bool("monitor-pressure", false, "monitor pipe pressure between dorado and zstd, output to file")
+	build := runFlags(flag.CommandLine)
+	metricsPath := flag.String("metrics", "", "write prometheus metrics to this file")
 	flag.Parse()
 
-	if *in == "" || *out == "" || *dpath == "" {
+	b, err := build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if (b.in == "" && b.onlyFiles == "") || b.out == "" || b.dpath == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	// build batch
-	b := new(batch)
-	b.dpath = *dpath
-	b.in = *in
-	b.out = *out
-	b.chunk = *chunk
-	b.mp = *mp
+	if err := b.prepare(); err != nil {
+		log.Fatal(err)
+	}
+	metrics.start(*metricsPath, 10*time.Second)
+	defer metrics.write()
+	go handleSignals(b)
 
-	filepath.WalkDir(*in, func(path string, di fs.DirEntry, err error) error {
-		if di != nil {
-			name := di.Name()
-			ext := filepath.Ext(name)
-			if ext == ".pod5" {
-				b.pod5s = append(b.pod5s, pod5{path: path, name: di.Name()})
+	if err := b.run(); err != nil {
+		fmt.Println(err)
+		metrics.write()
+		if errors.Is(err, errPartial) {
+			os.Exit(exitPartial)
+		}
+		os.Exit(1)
+	}
+}
+
+// Register the flags describing a run on fs. The returned function builds a
+// new batch from the parsed values and can be called once per run.
+func runFlags(fs *flag.FlagSet) func() (*batch, error) {
+	in := fs.String("in", "", "Path to pod5s, or the url of a json or html listing of them")
+	inToken := fs.String("in-token", os.Getenv("DBATCH_IN_TOKEN"), "bearer token for an -in url, default $DBATCH_IN_TOKEN")
+	dpath := fs.String("dorado", "", "Path to dorado")
+	simulate := fs.Bool("simulate", false, "replace dorado with a synthetic read generator, to try a configuration, storage and hooks without a GPU")
+	simRate := fs.Float64("simulate-rate", 2000, "reads per second written by -simulate, 0 for as fast as possible")
+	simLength := fs.Float64("simulate-length", 8000, "mean read length of -simulate")
+	simLengthSD := fs.Float64("simulate-length-sd", 6000, "standard deviation of the -simulate read lengths")
+	model := fs.String("model", "hac", "dorado model, default hac")
+	format := fs.String("input-format", formatPod5, "pod5, blow5 converted per chunk to pod5 with blue-crab, or bam to re-process existing uBAMs with their move tables, written -per-batch")
+	exts := fs.String("ext", "", "comma separated input extensions to discover, e.g. .pod5,.fast5,.blow5, default that of -input-format")
+	hooks := extHooks{}
+	fs.Var(hooks, "ext-hook", ".ext=command converting such inputs while staging, {in} and {out} are replaced with the paths, or with {dir} it runs once per chunk, can be repeated")
+	out := fs.String("out", "", "Output file path")
+	chunk := fs.Int("chunk", 50, "chunk size, default 50")
+	coalesce := fs.Bool("coalesce-chunks", false, "plan the rest of the run in bigger chunks when the first batches show -chunk spends most of their time loading the model")
+	mp := fs.Bool("monitor-pressure", false, "monitor pipe pressure between dorado and zstd, output to file")
+	batchLogs := fs.Bool("batch-logs", false, "keep dorado's stderr of every batch in <out>.dbatch/logs")
+	fileMode := fs.String("file-mode", "", "octal mode of the files a run writes, e.g. 0640, default what the umask gives")
+	dirMode := fs.String("dir-mode", "", "octal mode of the directories a run makes, e.g. 2770, 2775 with -group")
+	group := fs.String("group", "", "group to give the outputs, e.g. the lab's, with directories made setgid so files in them keep it")
+	keepLogs := fs.Int("keep-logs", 0, "keep only the newest n batch logs and rotated pipe pressure files, 0 keeps all")
+	statsMaxSize := fs.Float64("stats-max-size-MB", 0, "rotate the -monitor-pressure file into a timestamped gzip once it grows past this size, 0 for no limit")
+	monitorFormat := fs.String("monitor-format", "csv", "format of the -monitor-pressure file: csv, or csv.gz for long runs")
+	autoCompress := fs.Bool("auto-compress", true, "measure compression during the first batch and escalate to faster settings if it holds dorado up")
+	maxWrite := fs.Float64("max-write-MBps", 0, "limit the rate output is written to the destination filesystem, 0 for no limit")
+	qc := fs.Bool("qc", true, "collect read statistics from the stream, written to <out>.qc.json")
+	liveQC := fs.Float64("live-qc", 0, "sample this fraction of reads, e.g. 0.01, for a rolling qscore and length estimate in the metrics and daemon status while basecalling")
+	liveMinQ := fs.Float64("live-qc-min-qscore", 0, "warn when the -live-qc mean qscore falls under this")
+	adaptive := fs.String("adaptive-sampling", "auto", "report on-target and rejected reads separately: auto, on or off")
+	rejectLen := fs.Int("reject-length", 1000, "reads shorter than this count as rejected in adaptive sampling runs")
+	decontamRef := fs.String("decontam-ref", "", "minimap2 reference or index of host/contaminant sequences, matching reads are excluded from the output")
+	decontamKeep := fs.String("decontam-keep", "", "write excluded reads to this file instead of dropping them")
+	decontamThreads := fs.Int("decontam-threads", 4, "minimap2 threads for -decontam-ref")
+	cacheDir := fs.String("cache", "", "copy inputs to this local directory, e.g. on NVMe, and basecall them from there, reused by retries and later runs")
+	cacheSize := fs.Float64("cache-size-GB", 0, "evict the least recently used files to keep -cache under this size, 0 for no limit")
+	recal := fs.String("qscore-recal", "", "recalibrate quality strings before writing, by an offset such as +2 or a table of \"observed corrected\" phred scores per line")
+	runLabels := labels{}
+	localTimes := fs.Bool("local-time", false, "print times in the local zone, everything written stays RFC3339 UTC")
+	fs.Var(runLabels, "label", "key=value annotation for the state db, manifest, metrics and reports, can be repeated")
+	otel := fs.String("otel-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export opentelemetry traces of runs, batches and stages to this OTLP/HTTP collector, e.g. http://localhost:4318")
+	slaExpected := fs.Duration("chunk-sla", 0, "expected time to basecall a chunk, 0 to go by the median of the chunks done so far")
+	slaFactor := fs.Float64("chunk-sla-factor", 0, "alert when a chunk runs this many times longer than -chunk-sla, e.g. 2, 0 for no alerts")
+	alertWebhook := fs.String("alert-webhook", "", "post -chunk-sla alerts as json to this url")
+	redact := fs.String("redact", "", "replace file paths, label values or both by salted hashes in metrics, events, alerts and traces: paths, labels or all")
+	redactSalt := fs.String("redact-salt", os.Getenv("DBATCH_REDACT_SALT"), "secret the -redact hashes are salted with, default $DBATCH_REDACT_SALT")
+	publish := fs.String("publish", "", "publish an event with the manifest entry of every done batch to this nats subject, nats://host:4222/subject")
+	readProvenance := fs.Bool("read-provenance", false, "list every read ID with its batch and source pod5 in <out>.dbatch/reads.tsv.gz")
+	dedup := fs.Bool("dedup-report", false, "report read IDs that appear more than once across the inputs, e.g. after a flowcell reload, listed in <out>.duplicates.tsv")
+	spot := fs.Float64("spot-check", 0, "after each batch decompress its output and re-parse this fraction of records, e.g. 0.001")
+	shard := fs.String("shard", "", "k/n, basecall every n-th chunk starting at k into a separate shard, for running n cooperating instances")
+	retries := fs.Int("retries", 0, "retry a failed batch this many times")
+	olderThan := fs.String("older-than", "", "only basecall files not modified for this long, e.g. 90d, 12w or 36h")
+	indexFiles := fs.Int("index-files", 200000, "keep the paths of up to this many inputs in memory, more are indexed on disk in <out>.dbatch, 0 keeps all in memory")
+	skipList := fs.String("skip-list", "", "file of inputs to leave out on purpose, one path, file name glob or 'batch N' per line, recorded as skipped")
+	skipDone := fs.String("skip-done", "", "comma separated globs of earlier outputs whose basecalled files are left out, e.g. '/archive/sweep-*.fastq.zst'")
+	onlyFiles := fs.String("only-files", "", "debug: basecall only the files listed in this file, one per line, as a single chunk")
+	onlyBatch := fs.Int("only-batch", 0, "debug: basecall only batch n of the plan")
+	continueOnError := fs.Bool("continue-on-error", false, "skip batches that still fail after retries and finish the run over the rest")
+	rescan := fs.Bool("rescan", false, "re-scan the input between batches, basecalling files that appear and dropping ones that disappear")
+	priorityBarcodes := fs.String("priority-barcodes", "", "comma separated barcodes to basecall first, e.g. barcode01,barcode05, located by the demux of -priority-from")
+	priorityOnly := fs.Bool("priority-only", false, "basecall only the files holding reads of -priority-barcodes, leaving out the rest")
+	priorityFrom := fs.String("priority-from", "", "output of an earlier fast model run over the same input, split with dbatch demux")
+	history := fs.String("history", defaultHistory(), "append every done batch to this history shared across runs, see dbatch history, empty for none")
+	devices := fs.String("devices", "", "comma separated dorado devices, e.g. cuda:0,cuda:1, to basecall on in parallel")
+	deviceFailures := fs.Int("device-failures", 2, "consecutive GPU errors before a device is marked unhealthy and its chunks go to the others, or to the cpu with -cpu-fallback")
+	fallback := fs.Bool("cpu-fallback", false, "basecall the rest of the run with -x cpu once the gpu keeps failing, instead of aborting")
+	hashNames := fs.Bool("hash-names", false, "name -per-batch outputs by a hash of their inputs and settings, reusing outputs already there")
+	journal := fs.Bool("journal", false, "with -shard, write every batch to a part file of this shard's own, joined into -out by dbatch seal")
+	perBatch := fs.Bool("per-batch", false, "write each batch to its own file in the -out directory, compressed in the background")
+	compressWorkers := fs.Int("compress-workers", 2, "parallel compressors for -per-batch")
+	verifyWorkers := fs.Int("verify-workers", 0, "run -spot-check in this many background workers so it doesn't hold up the next batch, batches are done once verified")
+	maxChildren := fs.Int("max-children", 0, "child processes running at once across pipelines, compressors, spot checks and hooks, 0 for as many as the open file limit allows")
+	spool := fs.String("spool", "", "local directory for uncompressed batches waiting for -per-batch compression, default <tmp>-spool")
+	tmp := fs.String("tmp", "", "working directory for the chunks being basecalled, made and removed by the run, default <out>.dbatch/tmp")
+	readOnly := fs.Bool("read-only-input", false, "the input is a read-only archive: refuse any output, log or state file that would be written inside -in")
+	countReads := fs.Bool("count-reads", true, "read the read counts from the pod5 footers while planning, for the expected total and eta")
+	planner := fs.String("planner", "", "command planning the chunks, given the inputs as json on stdin and printing the chunks as json, for site-specific batching")
+	warmWorker := fs.String("warm-worker", "", "command keeping the model loaded that basecalls every chunk, given them as json lines on stdin, in place of starting dorado for each")
+	balance := fs.Bool("balance", false, "cut chunks at equal read counts instead of equal file counts, needs -count-reads")
+	env := envVars{}
+	fs.Var(env, "env", "KEY=VALUE set in the environment of dorado and the compressors, can be repeated")
+	config := fs.String("config", "", "file of flag: value lines, with an env: section, applied under the flags given on the command line")
+	audit := fs.String("audit", "", "append-only audit log of run state transitions, default <out>.dbatch/audit.log")
+
+	return func() (*batch, error) {
+		if *config != "" {
+			if err := applyConfig(fs, *config); err != nil {
+				return nil, err
 			}
 		}
+		switch *adaptive {
+		case "auto", "on", "off":
+		default:
+			return nil, fmt.Errorf("-adaptive-sampling must be auto, on or off")
+		}
 
-		return nil
-	})
+		b := new(batch)
+		b.tmp = *tmp
+		b.readOnlyIn = *readOnly
+		b.dpath = *dpath
+		if *simulate {
+			b.useSimulator(*simRate, *simLength, *simLengthSD)
+		}
+		b.model = *model
+		b.format = *format
+		b.in = *in
+		inputToken = *inToken
+		b.indexFiles = *indexFiles
+		if *olderThan != "" {
+			if isURL(b.in) {
+				return nil, fmt.Errorf("-older-than needs a local -in, a listing has no modification times")
+			}
+			var err error
+			if b.olderThan, err = parseAge(*olderThan); err != nil {
+				return nil, err
+			}
+		}
+		if *skipDone != "" {
+			var err error
+			if b.done, err = loadDone(*skipDone); err != nil {
+				return nil, err
+			}
+		}
+		if *skipList != "" {
+			var err error
+			b.skipListPath = *skipList
+			if b.skips, err = loadSkipList(*skipList); err != nil {
+				return nil, err
+			}
+		}
+		b.out = *out
+		b.chunk = *chunk
+		b.coalesce = *coalesce
+		b.mp = *mp
+		b.monitorFormat = *monitorFormat
+		if b.monitorFormat != "csv" && b.monitorFormat != "csv.gz" {
+			return nil, fmt.Errorf("-monitor-format must be csv or csv.gz")
+		}
+		b.autoCompress = *autoCompress
+		if *maxWrite > 0 {
+			b.throttle = newThrottle(*maxWrite)
+		}
+		if *qc {
+			b.qc = newQCWriter(*rejectLen)
+			b.qcMode = *adaptive
+			if *liveQC > 0 {
+				b.qc.live = newLiveQC(*liveQC, *liveMinQ)
+			}
+		} else if *liveQC > 0 {
+			return nil, fmt.Errorf("-live-qc needs -qc")
+		}
+		if *decontamRef != "" {
+			b.decontam = &decontam{ref: *decontamRef, keep: *decontamKeep, threads: *decontamThreads}
+		}
+		if *cacheDir != "" {
+			c, err := newPod5Cache(*cacheDir, *cacheSize)
+			if err != nil {
+				return nil, err
+			}
+			b.cache = c
+		}
+		if *recal != "" {
+			r, err := parseQscoreRecal(*recal)
+			if err != nil {
+				return nil, err
+			}
+			b.recal = r
+		}
+		if *shard != "" {
+			if _, err := fmt.Sscanf(*shard, "%d/%d", &b.shard, &b.shards); err != nil || b.shard < 1 || b.shard > b.shards {
+				return nil, fmt.Errorf("-shard must be k/n with 1 <= k <= n")
+			}
+		}
+		if *priorityBarcodes != "" {
+			if *priorityFrom == "" {
+				return nil, fmt.Errorf("-priority-barcodes needs -priority-from")
+			}
+			for _, bc := range strings.Split(*priorityBarcodes, ",") {
+				b.priorityBarcodes = append(b.priorityBarcodes, strings.TrimSpace(bc))
+			}
+			b.priorityFrom = *priorityFrom
+		}
+		if *priorityOnly {
+			if *priorityBarcodes == "" || *rescan {
+				return nil, fmt.Errorf("-priority-only needs -priority-barcodes and can't be combined with -rescan")
+			}
+			b.priorityOnly = true
+		}
+		b.spotCheck = *spot
+		b.otelEndpoint = *otel
+		r, err := parseRedaction(*redact, *redactSalt)
+		if err != nil {
+			return nil, err
+		}
+		b.redact = r
+		if *slaFactor > 0 {
+			b.sla = newChunkSLA(*slaExpected, *slaFactor, *alertWebhook)
+		}
+		if *publish != "" {
+			p, err := newPublisher(*publish)
+			if err != nil {
+				return nil, err
+			}
+			b.publisher = p
+		}
+		if *readProvenance {
+			b.prov = new(provenance)
+			b.provWriter = b.prov.writer()
+		}
+		if *dedup {
+			b.dups = newDupIndex()
+			b.dupWriter = b.dups.writer()
+		}
+		b.retries = *retries
+		b.rescan = *rescan
+		if *planner != "" {
+			if *rescan || *coalesce || *balance || *priorityBarcodes != "" {
+				return nil, fmt.Errorf("-planner can't be combined with -rescan, -coalesce-chunks, -balance or -priority-barcodes, it plans the whole run")
+			}
+			b.planner = *planner
+		}
+		if *warmWorker != "" {
+			if b.format == formatBAM {
+				return nil, fmt.Errorf("-warm-worker reads fastq, it can't be combined with bam output")
+			}
+			b.warmCmd = *warmWorker
+		}
+		if b.rescan && b.shards > 1 {
+			return nil, fmt.Errorf("-rescan can't be combined with -shard, shards need a fixed plan")
+		}
+		b.continueOnError = *continueOnError
+		b.history = *history
+		if *devices != "" {
+			b.devices = strings.Split(*devices, ",")
+		}
+		b.deviceFailures = max(*deviceFailures, 1)
+		b.cpu = cpuFallback{enabled: *fallback}
+		b.perBatch = *perBatch
+		b.hashNames = *hashNames
+		if b.hashNames && !b.perBatch {
+			return nil, fmt.Errorf("-hash-names needs -per-batch")
+		}
+		if b.hashNames {
+			var err error
+			if b.doradoVersion, err = b.probeDoradoVersion(); err != nil {
+				return nil, err
+			}
+		}
+		b.compressWorkers = max(*compressWorkers, 1)
+		b.spool = *spool
+		b.verifyWorkers = *verifyWorkers
+		if len(b.devices) == 1 {
+			b.device, b.devices = b.devices[0], nil
+		}
+		if len(b.devices) > 1 && (b.shards > 1 || b.rescan) {
+			return nil, fmt.Errorf("-devices can't be combined with -shard or -rescan")
+		}
+		b.countReads = *countReads
+		b.balance = *balance && b.countReads
+		b.hooks = maps.Clone(hooks)
+		if err := b.checkFormat(); err != nil {
+			return nil, err
+		}
+		if *journal {
+			switch {
+			case b.shards <= 1:
+				return nil, fmt.Errorf("-journal needs -shard k/n")
+			case b.format == formatBAM:
+				return nil, fmt.Errorf("-journal joins fastq parts, bam batches can't be concatenated")
+			}
+			b.journal, b.perBatch = true, true
+		}
+		b.exts = []string{inputExt(b.format)}
+		if *exts != "" {
+			var err error
+			if b.exts, err = parseExts(*exts); err != nil {
+				return nil, err
+			}
+		}
+		b.labels = maps.Clone(runLabels)
+		b.env = env.list()
+		childEnv = b.env
+		setLocalTime(*localTimes)
+		b.batchLogs = *batchLogs
+		slots.setLimit(*maxChildren)
+		retain = retention{keepLogs: *keepLogs, statsMaxSize: int64(*statsMaxSize * (1 << 20))}
+		p, err := parsePermissions(*fileMode, *dirMode, *group)
+		if err != nil {
+			return nil, err
+		}
+		perms = p
+		if !haveZstd() {
+			fmt.Println("zstd not found, writing uncompressed zstd frames with the built-in compressor")
+		}
+		b.onlyFiles, b.onlyBatch = *onlyFiles, *onlyBatch
+		if err := b.checkPinned(); err != nil {
+			return nil, err
+		}
+		b.auditPath = *audit
+		b.config = flagConfig(fs)
+		return b, nil
+	}
+}
+
+// Settle where the run writes, check it and open the run directory. Safe to
+// call again, run does for the daemon and sweeps.
+func (b *batch) prepare() error {
+	b.shardOutput()
+	if b.tmp == "" {
+		b.tmp = runFile(b.out, "tmp")
+	}
+	if err := b.checkPaths(); err != nil {
+		return err
+	}
+	if b.journal {
+		if m, err := readManifest(b.manifestPath()); err == nil && m.Sealed {
+			return fmt.Errorf("%s is sealed, its output is complete", b.sharedOut)
+		}
+	}
+	if err := makeRunDir(b.out); err != nil {
+		return err
+	}
+	return b.openAudit()
+}
+
+// Discover the input, basecall it batch by batch and write the reports
+func (b *batch) run() error {
+	if err := b.prepare(); err != nil {
+		return err
+	}
+	b.audit.record(b.out, "run_started", map[string]any{"in": b.in, "model": b.model, "labels": b.labels, "config": b.config})
+	if b.otelEndpoint != "" {
+		b.tracer = newTracer(b.otelEndpoint)
+		b.tracer.redact = b.redactText
+	}
+
+	runErr := b.runBatches()
+	b.stopWarm()
+	// logs, stats and reports made along the way
+	perms.tree(b.out)
+	perms.tree(runDir(b.out))
+	if b.tracer != nil {
+		b.tracer.finish(b, runErr)
+	}
+	if b.publisher != nil {
+		var done, failed int
+		if b.state != nil {
+			done, failed = len(newManifest(b.state).Batches), len(b.state.missing())
+		}
+		b.publishFinished(done, failed, runErr)
+		b.publisher.close()
+	}
+	if b.state != nil && len(b.state.Deliveries) > 0 {
+		fmt.Printf("%d events or alerts couldn't be delivered, send them again with dbatch deliveries retry -out %s\n", len(b.state.Deliveries), b.out)
+	}
+	if errors.Is(runErr, errAborted) {
+		b.audit.record(b.out, "run_aborted", map[string]any{"error": runErr.Error()})
+	} else if errors.Is(runErr, errCanceled) {
+		b.audit.record(b.out, "run_canceled", map[string]any{"error": runErr.Error()})
+	} else if errors.Is(runErr, errPartial) {
+		b.audit.record(b.out, "run_partial", map[string]any{"error": runErr.Error()})
+	} else if runErr != nil {
+		b.audit.record(b.out, "run_failed", map[string]any{"error": runErr.Error()})
+	} else {
+		b.audit.record(b.out, "run_finished", map[string]any{"batches": len(b.state.Batches)})
+	}
+	return runErr
+}
 
-	if len(b.pod5s) == 0 {
-		log.Fatalf("no files found with .pod5 extension")
+func (b *batch) runBatches() error {
+	metrics.setLabels(b.redact.labelSet(b.labels))
+	metrics.describe("dbatch_output_size_bytes", "gauge", "Size of the output file")
+	metrics.describe("dbatch_batches_done_total", "counter", "Batches basecalled")
+	metrics.describe("dbatch_batches_failed_total", "counter", "Batches skipped after failing all retries")
+	metrics.describe("dbatch_batch_retries_total", "counter", "Failed batch attempts that were retried")
+	if b.cpu.enabled {
+		metrics.describe("dbatch_cpu_fallback", "gauge", "1 once the run fell back to basecalling on the cpu")
+		metrics.set("dbatch_cpu_fallback", 0)
+	}
+	if b.warmCmd != "" {
+		metrics.describe("dbatch_startup_saved_seconds_total", "counter", "Model loading the -warm-worker spared the batches")
+	}
+	if b.decontam != nil {
+		metrics.describe("dbatch_host_reads_removed_total", "counter", "Reads excluded by host decontamination")
+	}
+	if b.qc != nil && b.qc.live != nil {
+		metrics.describe("dbatch_live_mean_qscore", "gauge", "Mean qscore of the most recent sampled reads")
+		metrics.describe("dbatch_live_mean_read_length", "gauge", "Mean length of the most recent sampled reads")
+	}
+	if b.countReads && b.qc != nil {
+		metrics.describe("dbatch_reads_missing_total", "counter", "Reads in the pod5 metadata that dorado didn't emit")
+	}
+	if b.sla != nil {
+		metrics.describe("dbatch_sla_breaches_total", "counter", "Batches that ran past their -chunk-sla")
+	}
+	metrics.describe("dbatch_children_running", "gauge", "Child processes running under the -max-children budget")
+	metrics.describe("dbatch_children_waiting", "gauge", "Pipelines and workers waiting for child process slots")
+	metrics.describe("dbatch_open_fds", "gauge", "File descriptors open in dbatch")
+	if b.spotCheck > 0 {
+		metrics.describe("dbatch_spot_check_records_total", "counter", "Records re-parsed from written output")
+	}
+
+	if b.prov != nil {
+		if err := b.prov.start(provenancePath(b.out)); err != nil {
+			return err
+		}
 	}
 
-	// we create symlinks in a tmpdir to avoid the high setup costs in basecalling
-	err := os.Mkdir("tmpdir", 0750)
+	if b.onlyFiles != "" {
+		files, err := readFileList(b.onlyFiles)
+		if err != nil {
+			return err
+		}
+		b.pod5s = memFileList(files)
+		// all of them in one chunk
+		b.chunk, b.balance = len(files), false
+	} else {
+		found, err := b.discoverInputs(true, indexPath(b.out))
+		if err != nil {
+			return err
+		}
+		b.pod5s = found
+	}
+	defer b.pod5s.close()
+
+	if b.pod5s.len() == 0 {
+		return fmt.Errorf("no files found with %s extension", strings.Join(b.exts, ", "))
+	}
+	if len(b.priorityBarcodes) > 0 {
+		if err := b.prioritize(); err != nil {
+			return err
+		}
+	}
+
+	if err := b.planRun(); err != nil {
+		return err
+	}
+	if b.onlyBatch > len(b.plan) {
+		return fmt.Errorf("-only-batch %d is past the last of the %d batches planned", b.onlyBatch, len(b.plan))
+	}
+
+	if len(b.devices) > 1 {
+		return b.runDevices()
+	}
+
+	b.state = newRunState(b)
+
+	// we create symlinks in a tmp directory to avoid the high setup costs in
+	// basecalling, each chunk in its own working directory under it
+	err := os.Mkdir(b.tmp, 0750)
 	if err != nil {
-		log.Fatalf("error making tmpdir")
+		return fmt.Errorf("error making -tmp %s", b.tmp)
 	}
-	defer os.RemoveAll("tmpdir")
+	defer os.RemoveAll(b.tmp)
 
+	if err := b.startPool(); err != nil {
+		return err
+	}
+	b.startVerifier()
+
+	var runErr error
 	for done := false; !done; {
-		done, err = b.batch()
-		if err != nil {
-			fmt.Println(err)
+		if aborting.Load() {
+			runErr = fmt.Errorf("%w after %d of %d files", errAborted, b.next, b.pod5s.len())
+			break
+		}
+		if b.yield != nil && b.next > 0 {
+			b.yield()
+		}
+		if runErr = b.checkCanceled(); runErr != nil {
+			break
+		}
+		if b.rescan && b.next > 0 {
+			b.replan()
+		}
+		done, runErr = b.batch()
+		if b.tracer != nil {
+			b.tracer.flush(b.state)
+		}
+		if runErr != nil {
 			break
 		}
-		clearTmpDir("tmpdir")
+		if !done {
+			b.checkChunkSize()
+		}
+	}
+	b.collectCompressed(true)
+	b.collectVerified(true)
+	if b.tracer != nil {
+		b.tracer.flush(b.state)
+	}
+
+	if err := newManifest(b.state).write(b.manifestPath()); err != nil {
+		fmt.Println(err)
+	} else {
+		b.audit.record(b.out, "manifest_written", map[string]any{"path": b.manifestPath()})
+	}
+
+	return b.report(b.state.missing(), runErr)
+}
+
+// Print what is missing from the output and write the qc report
+func (b *batch) report(missing []batchRecord, runErr error) error {
+	if len(missing) > 0 {
+		fmt.Println("=============================================")
+		fmt.Printf("%d batches are missing from the output:\n", len(missing))
+		for _, rec := range missing {
+			fmt.Printf("  batch %d (%d files): %s\n", rec.Index, len(rec.Files), rec.Error)
+		}
+		fmt.Printf("redo them with dbatch redo -out %s -batch N\n", b.out)
+		b.printQuarantine()
+		if runErr == nil {
+			runErr = fmt.Errorf("%w: %d of %d batches missing", errPartial, len(missing), len(b.state.Batches))
+		}
+	}
+
+	printTimings(b.state.Batches)
+	printShortfalls(b.state.Batches)
+	if b.cache != nil {
+		b.cache.print()
 	}
+	printNotes(b.state.Notes)
+
+	if b.decontam != nil {
+		fmt.Printf("host decontamination excluded %s reads\n", thousands(b.decontam.removed))
+	}
+	var dups int64
+	if b.dups != nil {
+		dups = b.dups.report(b.out)
+	}
+	if b.prov != nil {
+		fmt.Printf("read provenance of %s reads in %s\n", thousands(b.prov.reads), b.prov.path)
+	}
+	if b.qc != nil {
+		r := b.qc.report(b.qcMode)
+		r.Labels = b.labels
+		if b.decontam != nil {
+			r.HostReadsRemoved = b.decontam.removed
+		}
+		r.DuplicateReads = dups
+		printQCReport(r)
+		if err := writeQCReport(qcPath(b.out), r); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return runErr
+}
+
+// Call fn with every input file with one of exts under in, in walk order
+func walkInputs(in string, exts []string, fn func(pod5) error) error {
+	if isURL(in) {
+		found, err := listRemote(in, exts)
+		if err != nil {
+			return err
+		}
+		for _, f := range found {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return filepath.WalkDir(in, func(path string, di fs.DirEntry, err error) error {
+		if di != nil {
+			// the tmp directories of runs writing into the input hold symlinks to it
+			if di.IsDir() && path != in && isRunDir(di.Name()) {
+				return filepath.SkipDir
+			}
+			if isInput(di.Name(), exts) {
+				return fn(pod5{path: path, name: di.Name()})
+			}
+		}
+
+		return nil
+	})
 }
 
 // Process a batch of pod5s from the pool
 func (b *batch) batch() (bool, error) {
 
-	var i, j int
-	for i, j = b.next, 0; i < len(b.pod5s) && j < b.chunk; i, j = i+1, j+1 {
-		err := os.Symlink(b.pod5s[i].path, "tmpdir/"+b.pod5s[i].name)
-		if err != nil {
-			return false, fmt.Errorf("error creating symbolic link %w", err)
+	for !b.owns(b.nextChunk) {
+		b.next = b.plan[b.nextChunk].end
+		b.nextChunk++
+		if b.nextChunk == len(b.plan) {
+			return true, nil
 		}
 	}
 
+	sp := b.plan[b.nextChunk]
+	files, err := b.pod5s.files(sp.start, sp.end)
+	if err != nil {
+		return false, err
+	}
+	index := b.nextChunk + 1
+
 	fmt.Println("=============================================")
-	fmt.Printf("basecalling from %d to %d files of %d\n", b.next, i, len(b.pod5s))
+	fmt.Printf("basecalling batch %d, from %s to %s files of %s\n", index, thousands(int64(sp.start)), thousands(int64(sp.end)), thousands(int64(b.pod5s.len())))
+	if eta := b.eta(); eta != "" {
+		fmt.Println(eta)
+	}
 	fmt.Println("=============================================")
 
-	b.next = i
+	b.next = sp.end
+	b.nextChunk++
+
+	rec, err := b.process(index, files)
+	if err == nil {
+		b.reportCPURate(rec, b.pod5s.len()-b.next)
+	} else {
+		if rec == nil || !b.continueOnError {
+			return false, fmt.Errorf("batch %d: %w", index, err)
+		}
+		b.skip(rec, err)
+	}
+	b.filesDone += len(files)
+	if rec != nil {
+		b.readsDone += rec.Reads
+	}
+
+	return b.nextChunk == len(b.plan), nil
+}
 
-	err := b.call()
+// Stage, basecall and record one chunk of the plan. If basecalling fails the
+// record is returned along with the error for the caller to decide what to do.
+func (b *batch) process(index int, files []pod5) (*batchRecord, error) {
+	var hash string
+	if b.hashNames {
+		hash = b.contentHash(files)
+		if rec, ok := b.reuseBatch(index, files, hash); ok {
+			return rec, nil
+		}
+	}
+	staging := time.Now()
+	w, err := newWorkDir(b.tmp, index)
 	if err != nil {
-		return false, fmt.Errorf("error basecalling: %w", err)
+		return nil, err
+	}
+	defer w.remove()
+	if b.cache != nil {
+		defer func() { b.cache.release(w.cached) }()
+	}
+	b.work = w
+	if b.tracer != nil {
+		b.tracer.batchStarted(index)
+	}
+	if err := stage(w, files, b.hooks, b.cache, b.hookPayload(index, files, hash)); err != nil {
+		return nil, err
 	}
 
-	return i == len(b.pod5s), nil
+	rec := b.state.addBatch(index, files)
+	rec.Hash = hash
+	rec.Timings = &stageTimes{Staging: time.Since(staging).Seconds()}
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+	b.audit.record(b.out, "batch_started", map[string]any{"batch": rec.Index, "files": rec.Files})
+
+	b.current = rec.Index
+	var removed int64
+	if b.decontam != nil {
+		removed = b.decontam.removed
+	}
+	stopSLA := b.watchSLA(rec.Index, len(files))
+	err = b.attempt(rec)
+	rec.Commands = b.lastCommands
+	stopSLA()
+	if err != nil {
+		b.audit.record(b.out, "batch_failed", map[string]any{"batch": rec.Index, "error": err.Error()})
+		return rec, err
+	}
+
+	reads := b.basecalledReads()
+	if b.qc != nil {
+		rec.Reads, rec.Bases = b.qc.batchReads, b.qc.batchBases
+		b.qc.batchReads, b.qc.batchBases = 0, 0
+		if b.decontam != nil {
+			removed = b.decontam.removed - removed
+		}
+		b.crossCheck(rec, files, rec.Reads+removed)
+		if b.qc.live != nil {
+			b.checkLiveQC()
+		}
+	}
+	fmt.Printf("batch %d: %s\n", rec.Index, rec.Timings)
+	if b.pool != nil {
+		// done once the pool has compressed it
+		b.pool.submit(rec.Index, b.lastPath, reads, rec.Hash)
+		if err := b.state.save(); err != nil {
+			fmt.Println(err)
+		}
+		b.collectCompressed(false)
+		return rec, nil
+	}
+	if b.verifier != nil {
+		// done once verified in the background
+		b.verifier.submit(verifyJob{rec.Index, b.lastPath, rec.Offset, rec.Length, reads})
+		if err := b.state.save(); err != nil {
+			fmt.Println(err)
+		}
+		b.collectVerified(false)
+		return rec, nil
+	}
+
+	rec.Done = true
+	metrics.add("dbatch_batches_done_total", 1)
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+	b.audit.record(b.out, "batch_done", map[string]any{"batch": rec.Index, "offset": rec.Offset, "length": rec.Length, "reads": rec.Reads})
+	b.publishBatch(rec)
+	b.recordHistory(rec)
+
+	// keep the manifest current so cooperating shards see each other's progress
+	if err := newManifest(b.state).write(b.manifestPath()); err != nil {
+		fmt.Println(err)
+	}
+	return rec, nil
+}
+
+// record a failed chunk as missing so the run can carry on with the rest
+func (b *batch) skip(rec *batchRecord, err error) {
+	fmt.Printf("batch %d failed, skipping it: %s\n", rec.Index, err)
+	rec.Error = err.Error()
+	metrics.add("dbatch_batches_failed_total", 1)
+	if err := b.state.save(); err != nil {
+		fmt.Println(err)
+	}
+	reason := b.quarantineBatch(rec, err)
+	b.audit.record(b.out, "batch_skipped", map[string]any{"batch": rec.Index, "files": rec.Files, "reason": reason})
 }
 
-// call all pod5s in tmpdir
+// call all pod5s staged for the current chunk
 func (b *batch) call() error {
+	// where this attempt appends, so a failure before anything is written
+	// cuts nothing off the batches before it
+	b.lastPath = b.out
+	if b.pool != nil {
+		b.lastPath = b.pool.spoolPath(b.current)
+	}
+	b.lastOffset, b.lastLength = 0, 0
+	if info, err := os.Stat(b.lastPath); err == nil {
+		b.lastOffset = info.Size()
+	}
 
 	// create commands for dorado and zstd, display stderror
-	dorado := exec.Command(b.dpath, "basecaller", "hac", "-r", "--emit-fastq", "tmpdir/")
-	zstd := exec.Command("zstd")
-	dorado.Stderr = os.Stderr
-	zstd.Stderr = os.Stderr
+	args := []string{"basecaller", b.model, "-r"}
+	if b.format != formatBAM {
+		args = append(args, "--emit-fastq")
+	}
+	if b.device != "" {
+		args = append(args, "-x", b.device)
+	}
+	if b.pinned() {
+		args = append(args, "-vv")
+	}
+	args = append(args, b.work.stage+string(filepath.Separator))
+	dorado := command(b.dpath, append(slices.Clone(b.doradoArgs), args...)...)
+	if b.pinned() {
+		b.printStaged()
+	}
+	stderr := newTailBuffer(16 * 1024)
+	defer func() { b.lastStderr = stderr.String() }()
+	dorado.Stderr = io.MultiWriter(os.Stderr, stderr)
+	var warm *warmWorker
+	if b.warmCmd != "" {
+		var err error
+		if warm, err = b.warmWorker(); err != nil {
+			return err
+		}
+	}
 
-	doradoOut, err := dorado.StdoutPipe()
+	// with -per-batch the batch is spooled uncompressed and the compression
+	// pool picks it up afterwards, so there is no compressor in the pipeline.
+	// bam output is compressed already.
+	raw := b.pool != nil || b.format == formatBAM
+
+	// dorado, the compressor and minimap2 with its host compressor
+	procs := 1
+	if !raw {
+		procs++
+	}
+	if b.decontam != nil {
+		procs++
+		if b.decontam.keep != "" {
+			procs++
+		}
+	}
+	defer slots.hold(procs)()
+	var zstd *exec.Cmd
+	if !raw {
+		zstd = command(compressors[b.compressLevel][0], compressors[b.compressLevel][1:]...)
+		zstd.Stderr = os.Stderr
+	}
+
+	var doradoOut io.ReadCloser
+	var warmWait func() error
+	var err error
+	if warm == nil {
+		if doradoOut, err = dorado.StdoutPipe(); err != nil {
+			return fmt.Errorf("could not get dorado stdout %w", err)
+		}
+	}
+
+	// If monitoring backpressure, measuring the compressor or collecting qc, we
+	// need a writecloser for zstd
+	measure := b.autoCompress && !b.compressSettled && !raw
+	// a warm worker's chunk ends at its status line, which only the monitor reads to
+	monitor := b.mp || measure || b.qc != nil || b.decontam != nil || b.dupWriter != nil || b.provWriter != nil || b.recal != nil || raw || warm != nil
+
+	// zstd >> b.out
+	out, err := os.OpenFile(b.lastPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("could not get dorado stdout %w", err)
+		return fmt.Errorf("error opening file %w", err)
 	}
+	perms.set(b.lastPath)
+	defer out.Close()
 
-	// If monitoring backpressure, we need a writecloser for zstd
 	var zstdIn io.WriteCloser
-	if b.mp {
+	if raw {
+		// dorado | monitor | throttle >> spool
+		zstdIn = out
+	} else if monitor {
 		zstdIn, err = zstd.StdinPipe()
 		if err != nil {
 			return fmt.Errorf("could not get zstd stdin %w", err)
@@ -136,33 +1137,190 @@ func (b *batch) call() error {
 		zstd.Stdin = doradoOut
 	}
 
-	// zstd >> b.out
-	out, err := os.OpenFile(b.out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("error opening file %w", err)
+	b.lastOffset, b.lastLength = 0, 0
+	if info, err := out.Stat(); err == nil {
+		b.lastOffset = info.Size()
+	}
+
+	var logFile *os.File
+	if b.batchLogs && b.current > 0 {
+		logFile, err = b.openBatchLog()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			logFile.Close()
+			prune(filepath.Join(batchLogDir(b.out), "batch_*.log"), retain.keepLogs)
+		}()
+		dorado.Stderr = io.MultiWriter(os.Stderr, stderr, logFile)
 	}
-	defer out.Close()
-	zstd.Stdout = out
 
-	if err := dorado.Start(); err != nil {
+	// zstd | throttle >> b.out
+	var zstdOut io.ReadCloser
+	if !raw {
+		if b.throttle != nil {
+			zstdOut, err = zstd.StdoutPipe()
+			if err != nil {
+				return fmt.Errorf("could not get zstd stdout %w", err)
+			}
+		} else {
+			zstd.Stdout = out
+		}
+	}
+
+	var sink io.Writer = zstdIn
+	if raw && b.throttle != nil {
+		// the spool is under <out>.dbatch unless -spool moves it
+		sink = b.throttle.writer(out)
+	}
+	if b.qc != nil {
+		// dorado | monitor | zstd, qc
+		sink = io.MultiWriter(sink, b.qc)
+	}
+	if b.dupWriter != nil {
+		sink = io.MultiWriter(sink, b.dupWriter)
+	}
+	if b.provWriter != nil {
+		sink = io.MultiWriter(sink, b.provWriter)
+	}
+	if b.recal != nil {
+		// recalibrated before anything sees the qualities
+		sink = b.recal.writer(sink)
+	}
+	var dc *decontamStage
+	if b.decontam != nil {
+		// dorado | monitor | minimap2 | filter | zstd, qc
+		dc, err = b.decontam.start(sink)
+		if err != nil {
+			return err
+		}
+		sink = dc
+	}
+
+	proc := dorado
+	if warm != nil {
+		proc = warm.cmd
+	}
+	b.lastCommands = b.commandLines(proc, dc, zstd)
+	fmt.Printf("running %s\n", strings.Join(b.lastCommands, " | "))
+	if logFile != nil {
+		fmt.Fprintf(logFile, "# %s\n", strings.Join(b.lastCommands, " | "))
+	}
+
+	started := time.Now()
+	if warm != nil {
+		req := warmRequest{Batch: b.current, Stage: b.work.stage + string(filepath.Separator), Model: b.model, Device: b.device, Args: dorado.Args[1:]}
+		if doradoOut, warmWait, err = warm.request(req, dorado.Stderr); err != nil {
+			return err
+		}
+	} else if err := dorado.Start(); err != nil {
 		return fmt.Errorf("failed to start dorado: %w", err)
 	}
-	if err := zstd.Start(); err != nil {
-		return fmt.Errorf("failed to start zstd: %w", err)
+	if zstd != nil {
+		if err := zstd.Start(); err != nil {
+			return fmt.Errorf("failed to start zstd: %w", err)
+		}
+	}
+
+	written := make(chan error, 1)
+	if zstdOut != nil {
+		go func() {
+			_, err := io.Copy(b.throttle.writer(out), zstdOut)
+			written <- err
+		}()
+	}
+
+	// dorado | monitor | zstd
+	var totals chan pipeTotals
+	if monitor {
+		totals = make(chan pipeTotals, 1)
+		record := ""
+		if b.mp {
+			record = b.statsPath()
+		}
+		go chanMonitor(doradoOut, sink, record, totals)
 	}
 
-	if b.mp {
-		// dorado | monitor | zstd
-		go chanMonitor(doradoOut, zstdIn)
+	// all reads from dorado must be done before waiting on it
+	var t pipeTotals
+	var drained time.Time
+	if totals != nil {
+		t = <-totals
+		drained = time.Now()
+		pipeErr := t.err
+		if dc != nil {
+			pipeErr = errors.Join(pipeErr, dc.Close())
+		}
+		if !raw {
+			zstdIn.Close()
+		}
+		if pipeErr != nil {
+			// only this batch fails, its children are waited for
+			if warm != nil {
+				warmWait()
+			} else {
+				dorado.Wait()
+			}
+			if zstd != nil {
+				zstd.Wait()
+			}
+			return pipeErr
+		}
+		if dc != nil {
+			metrics.add("dbatch_host_reads_removed_total", float64(dc.removed))
+		}
 	}
 
-	if err := dorado.Wait(); err != nil {
+	if warm != nil {
+		if err := warmWait(); err != nil {
+			return err
+		}
+	} else if err := dorado.Wait(); err != nil {
 		return fmt.Errorf("dorado error: %w", err)
 	}
 	doradoOut.Close()
+	if drained.IsZero() {
+		drained = time.Now()
+	}
 
-	if err := zstd.Wait(); err != nil {
-		return fmt.Errorf("zstd error: %w", err)
+	if zstdOut != nil {
+		if err := <-written; err != nil {
+			return fmt.Errorf("error writing output %w", err)
+		}
+	}
+
+	if zstd != nil {
+		if err := zstd.Wait(); err != nil {
+			return fmt.Errorf("zstd error: %w", err)
+		}
+	}
+
+	if info, err := out.Stat(); err == nil {
+		b.lastLength = info.Size() - b.lastOffset
+		if !raw {
+			metrics.set("dbatch_output_size_bytes", float64(info.Size()))
+		}
+	}
+
+	// without the monitor there is no first read to split startup from
+	// basecalling
+	b.lastTimes = stageTimes{Basecall: drained.Sub(started).Seconds(), Tail: time.Since(drained).Seconds()}
+	if !t.first.IsZero() {
+		b.lastTimes.Startup = t.first.Sub(started).Seconds()
+		b.lastTimes.Basecall = drained.Sub(t.first).Seconds()
+	}
+	if warm != nil {
+		// the chunk the worker was started for waited for the model
+		if warm.chunks == 1 {
+			b.lastTimes.Startup += warm.load
+		} else {
+			b.lastTimes.Saved = max(warm.load-b.lastTimes.Startup, 0)
+			metrics.add("dbatch_startup_saved_seconds_total", b.lastTimes.Saved)
+		}
+	}
+
+	if measure {
+		b.adjustCompressor(t)
 	}
 
 	return nil
@@ -175,9 +1333,22 @@ type entry struct {
 	size      int
 }
 
-func chanMonitor(rd io.ReadCloser, wr io.WriteCloser) {
+// time spent blocked on either end of the pipe over a whole batch
+type pipeTotals struct {
+	readTime  time.Duration
+	writeTime time.Duration
+	bytes     int64
+	first     time.Time // when the first output arrived
+	err       error     // the copy failing, for the batch to fail with
+}
+
+// Copy dorado to zstd, timing both ends. Per-buffer stats are only kept if
+// record is set, to the format it names. A failed write, e.g. minimap2 dying,
+// drains the rest of dorado's output so it can exit.
+func chanMonitor(rd io.Reader, wr io.Writer, record string, done chan<- pipeTotals) {
 	buf := make([]byte, 128*1024) //zstd max block size 128kiB
 	pipeStats := make([]entry, 0, 10000)
+	var totals pipeTotals
 
 	var readMark, writeMark time.Time
 	var readTime, writeTime time.Duration
@@ -186,54 +1357,72 @@ func chanMonitor(rd io.ReadCloser, wr io.WriteCloser) {
 		nr, err := rd.Read(buf)
 		readTime = time.Since(readMark)
 		if err == io.EOF {
-			writeAnalysis(pipeStats)
-			wr.Close()
+			if record != "" {
+				writeAnalysis(pipeStats, record)
+			}
+			done <- totals
 			break
 		}
 		if err != nil {
-			log.Fatalf("error reading from dorado %s", err)
+			totals.err = fmt.Errorf("error reading from dorado %w", err)
+			done <- totals
+			return
+		}
+		if totals.first.IsZero() {
+			totals.first = time.Now()
 		}
 
 		writeMark = time.Now()
 		nw, err := wr.Write(buf[:nr])
-		if nr != nw {
-			log.Fatal("wrote different number of bytes than read")
+		if err == nil && nr != nw {
+			err = io.ErrShortWrite
 		}
 		if err != nil {
-			log.Fatalf("error writing to zstd %s", err)
+			totals.err = fmt.Errorf("error writing the output of dorado %w", err)
+			io.Copy(io.Discard, rd)
+			done <- totals
+			return
 		}
 		writeTime = time.Since(writeMark)
 
-		newEntry := entry{readTime, writeTime, nw}
-		pipeStats = append(pipeStats, newEntry)
+		totals.readTime += readTime
+		totals.writeTime += writeTime
+		totals.bytes += int64(nw)
+		if record != "" {
+			newEntry := entry{readTime, writeTime, nw}
+			pipeStats = append(pipeStats, newEntry)
+		}
 	}
 }
 
-// Write a csv with pipe pressure data
-func writeAnalysis(data []entry) {
-	stats, err := os.OpenFile("chan_stats.csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// the pipe pressure data of -monitor-pressure
+func (b *batch) statsPath() string {
+	return runFile(b.out, "chan_stats."+b.monitorFormat)
+}
+
+// Write a csv with pipe pressure data. With format csv.gz each batch is
+// appended as its own gzip member, which still reads as one stream.
+func writeAnalysis(data []entry, path string) {
+	rotateStats(path, retain)
+	stats, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Printf("error opening file for chan stats %s\n", err)
 		return
 	}
+	perms.set(path)
 	defer stats.Close()
 
-	stats.Write([]byte("Read Time (ns), Write Time (ns), Buffer Size (bytes)\n"))
-	for i := range data {
-		stats.Write([]byte(strconv.FormatInt(int64(data[i].readTime), 10) + "," + strconv.FormatInt(int64(data[i].writeTime), 10) + "," + strconv.Itoa(data[i].size) + "\n"))
+	var w io.Writer = stats
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(stats)
+		defer gz.Close()
+		w = gz
 	}
-}
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
 
-// Clears the tmpdir without deleting the directory itself
-func clearTmpDir(tmp string) {
-	entries, err := os.ReadDir(tmp)
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, entry := range entries {
-		err := os.RemoveAll(filepath.Join(tmp, entry.Name()))
-		if err != nil {
-			log.Fatal(err)
-		}
+	buf.WriteString("Read Time (ns), Write Time (ns), Buffer Size (bytes)\n")
+	for i := range data {
+		buf.WriteString(strconv.FormatInt(int64(data[i].readTime), 10) + "," + strconv.FormatInt(int64(data[i].writeTime), 10) + "," + strconv.Itoa(data[i].size) + "\n")
 	}
 }
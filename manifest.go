@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The manifest describes what an output contains, batch by batch, for
+// downstream systems picking the archive up
+type manifest struct {
+	Output  string          `json:"output"`
+	Shards  int             `json:"shards,omitempty"`
+	Model   string          `json:"model"`
+	Labels  labels          `json:"labels,omitempty"`
+	RunInfo *runInfo        `json:"run_info,omitempty"`
+	Recal   *qscoreRecal    `json:"qscore_recal,omitempty"`
+	Batches []manifestEntry `json:"batches"`
+	Missing []manifestEntry `json:"missing,omitempty"` // batches skipped with -continue-on-error
+	Skipped []skipRecord    `json:"skipped,omitempty"` // left out on purpose by -skip-list
+
+	// with -journal the batches are parts joined by dbatch seal, see seal.go
+	Journal bool `json:"journal,omitempty"`
+	Planned int  `json:"planned,omitempty"`
+	Sealed  bool `json:"sealed,omitempty"`
+
+	shardOut string // the shard this manifest was built by
+}
+
+type manifestEntry struct {
+	Batch  int      `json:"batch"`
+	Output string   `json:"output,omitempty"` // file holding the batch, if sharded or per-batch
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+	Reads  int64    `json:"reads,omitempty"`
+	Bases  int64    `json:"bases,omitempty"`
+	SHA256 string   `json:"sha256,omitempty"`
+	Hash   string   `json:"hash,omitempty"`
+	Files  []string `json:"files"`
+	// dorado and compressor command lines the batch was written with
+	Commands []string `json:"commands,omitempty"`
+}
+
+func manifestPath(out string) string {
+	return runFile(out, "manifest.json")
+}
+
+// Build the manifest for the completed batches of a run
+func newManifest(s *runState) *manifest {
+	m := &manifest{Output: s.Out, Model: s.Model, Labels: s.Labels, RunInfo: s.RunInfo, Recal: s.Recal, Journal: s.Journal, Planned: s.Planned, Skipped: s.Skipped}
+	var shardOut string
+	if s.Shards > 1 {
+		m.Output, m.Shards, shardOut = s.SharedOut, s.Shards, s.Out
+		m.shardOut = shardOut
+	}
+	for _, rec := range s.missing() {
+		m.Missing = append(m.Missing, manifestEntry{Batch: rec.Index, Output: shardOut, Files: rec.Files})
+	}
+	for _, rec := range s.Batches {
+		if rec.Done {
+			m.Batches = append(m.Batches, s.manifestEntryOf(rec))
+		}
+	}
+	return m
+}
+
+// the manifest entry of a done batch
+func (s *runState) manifestEntryOf(rec batchRecord) manifestEntry {
+	output := rec.Output
+	if output == "" && s.Shards > 1 {
+		output = s.Out
+	}
+	return manifestEntry{
+		Batch:  rec.Index,
+		Output: output,
+		Offset: rec.Offset,
+		Length: rec.Length,
+		Reads:  rec.Reads,
+		Bases:  rec.Bases,
+		SHA256: rec.SHA256,
+		Hash:   rec.Hash,
+		Files:  rec.Files,
+
+		Commands: rec.Commands,
+	}
+}
+
+// Write the manifest to path. The file is locked for the update, and a sharded
+// manifest is merged with what other shards already wrote, replacing only the
+// entries of its own shard, so parallel writers never lose each other's batches.
+func (m *manifest) write(path string) error {
+	// a shard may be the first to write the manifest of the shared output
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error making run directory %w", err)
+	}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	merged := m
+	if m.Shards > 1 {
+		merged, err = m.merge(path)
+		if err != nil {
+			return err
+		}
+	}
+	return merged.save(path)
+}
+
+// write the manifest in place, the caller holds the lock
+func (m *manifest) save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing manifest %w", err)
+	}
+	perms.set(tmp)
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("error writing manifest %w", err)
+	}
+	return nil
+}
+
+// merge the shard entries of m into the manifest at path, the caller holds the lock
+func (m *manifest) merge(path string) (*manifest, error) {
+	existing, err := readManifest(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.Sealed {
+		return nil, fmt.Errorf("manifest %s is sealed, its output is complete", path)
+	}
+	if existing.Shards != m.Shards || existing.Model != m.Model || existing.Planned != m.Planned {
+		return nil, fmt.Errorf("manifest %s belongs to a run with %d shards using %s", path, existing.Shards, existing.Model)
+	}
+
+	// per-batch files of a shard live in the shard's directory
+	mine := func(e manifestEntry) bool {
+		return e.Output == m.shardOut || filepath.Dir(e.Output) == m.shardOut
+	}
+	merged := *m
+	merged.Batches = append(slices.DeleteFunc(existing.Batches, mine), m.Batches...)
+	merged.Missing = append(slices.DeleteFunc(existing.Missing, mine), m.Missing...)
+	byBatch := func(a, b manifestEntry) int { return a.Batch - b.Batch }
+	slices.SortFunc(merged.Batches, byBatch)
+	slices.SortFunc(merged.Missing, byBatch)
+	return &merged, nil
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest %w", err)
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// In a sharded run every shard updates the manifest of the shared output
+func (b *batch) manifestPath() string {
+	if b.shards > 1 {
+		return manifestPath(b.sharedOut)
+	}
+	return manifestPath(b.out)
+}
+
+// Point a sharded run at its own shard, run.fastq.zst -> run.shard2of4.fastq.zst.
+// Everything derived from b.out (the run directory) follows the shard.
+func (b *batch) shardOutput() {
+	if b.shards <= 1 || b.sharedOut != "" {
+		return
+	}
+	label := fmt.Sprintf("shard%dof%d", b.shard, b.shards)
+	b.sharedOut = b.out
+	b.out = labeledPath(b.out, label)
+	if b.journal {
+		// the parts stay out of sight until dbatch seal joins them
+		b.out = runFile(b.sharedOut, filepath.Join("parts", label))
+	}
+	// cooperating instances may share a -tmp
+	if b.tmp != "" {
+		b.tmp += "-" + label
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small metrics registry written in the prometheus text format, suitable for
+// the node_exporter textfile collector
+type metricSet struct {
+	mu     sync.Mutex
+	path   string
+	values map[string]float64
+	desc   map[string]metricDesc
+
+	// constant labels attached to every sample
+	labels string
+}
+
+type metricDesc struct {
+	typ  string
+	help string
+}
+
+var metrics = &metricSet{
+	values: make(map[string]float64),
+	desc:   make(map[string]metricDesc),
+}
+
+func (m *metricSet) describe(name, typ, help string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.desc[name] = metricDesc{typ, help}
+	if _, ok := m.values[name]; !ok {
+		m.values[name] = 0
+	}
+}
+
+func (m *metricSet) set(name string, v float64) {
+	m.mu.Lock()
+	m.values[name] = v
+	m.mu.Unlock()
+}
+
+func (m *metricSet) add(name string, v float64) {
+	m.mu.Lock()
+	m.values[name] += v
+	m.mu.Unlock()
+}
+
+// Attach run labels to every sample
+func (m *metricSet) setLabels(l labels) {
+	pairs := make([]string, 0, len(l))
+	for _, k := range l.keys() {
+		pairs = append(pairs, k+"="+strconv.Quote(l[k]))
+	}
+	m.mu.Lock()
+	m.labels = ""
+	if len(pairs) > 0 {
+		m.labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	m.mu.Unlock()
+}
+
+// Start writing metrics to path every interval, does nothing if path is empty
+func (m *metricSet) start(path string, interval time.Duration) {
+	if path == "" {
+		return
+	}
+	m.path = path
+	go func() {
+		for range time.Tick(interval) {
+			if err := m.write(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+}
+
+// write the current values, renaming into place so scrapers never see a partial file
+func (m *metricSet) write() error {
+	if m.path == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		if d, ok := m.desc[name]; ok {
+			fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", name, d.help, name, d.typ)
+		}
+		fmt.Fprintf(&sb, "%s%s %g\n", name, m.labels, m.values[name])
+	}
+	m.mu.Unlock()
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("error writing metrics %w", err)
+	}
+	perms.set(tmp)
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("error writing metrics %w", err)
+	}
+	return nil
+}
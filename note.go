@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// an operator note on a run, e.g. why it was paused
+type note struct {
+	Time       string `json:"time"`
+	Text       string `json:"text"`
+	AfterBatch int    `json:"after_batch,omitempty"` // last batch done when the note was added
+}
+
+// dbatch note attaches a free-text note to a run, running or finished, so the
+// run record explains gaps and interventions
+func noteMain(args []string) {
+	fs := flag.NewFlagSet("note", flag.ExitOnError)
+	out := fs.String("out", "", "Output file path of the run")
+	fs.Parse(args)
+
+	text := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if *out == "" || text == "" {
+		fmt.Println("usage: dbatch note -out run.fastq.zst \"stopped for instrument maintenance\"")
+		fs.PrintDefaults()
+		return
+	}
+
+	if err := migrateRunDir(*out); err != nil {
+		log.Fatal(err)
+	}
+	n, err := addNote(statePath(*out), text)
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit, err := openAudit(auditPath(*out))
+	if err != nil {
+		log.Fatal(err)
+	}
+	audit.record(*out, "note", map[string]any{"text": n.Text, "after_batch": n.AfterBatch})
+	fmt.Printf("noted after batch %d: %s\n", n.AfterBatch, n.Text)
+}
+
+// Append a note to the state db at path. Only the notes are touched so a run
+// saving its batches at the same time loses nothing.
+func addNote(path, text string) (note, error) {
+	n := note{Time: timestamp(time.Now()), Text: text}
+	unlock, err := lockFile(path)
+	if err != nil {
+		return n, err
+	}
+	defer unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return n, fmt.Errorf("error reading state db %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return n, fmt.Errorf("error parsing state db %s: %w", path, err)
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return n, fmt.Errorf("error parsing state db %s: %w", path, err)
+	}
+	for _, rec := range state.Batches {
+		if rec.Done {
+			n.AfterBatch = max(n.AfterBatch, rec.Index)
+		}
+	}
+
+	notes, err := json.Marshal(append(state.Notes, n))
+	if err != nil {
+		return n, fmt.Errorf("error encoding notes %w", err)
+	}
+	raw["notes"] = notes
+	data, err = json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return n, fmt.Errorf("error encoding state db %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return n, fmt.Errorf("error writing state db %w", err)
+	}
+	perms.set(tmp)
+	if err := os.Rename(tmp, path); err != nil {
+		return n, fmt.Errorf("error writing state db %w", err)
+	}
+	return n, nil
+}
+
+// pick up notes written to the db since it was loaded, the caller holds the
+// lock. A new run over an old output starts without the old run's notes.
+func (s *runState) mergeNotes() {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return
+	}
+	var disk struct {
+		Notes []note `json:"notes"`
+	}
+	if json.Unmarshal(data, &disk) != nil {
+		return
+	}
+	for _, n := range disk.Notes {
+		if n.Time >= s.created && !slices.Contains(s.Notes, n) {
+			s.Notes = append(s.Notes, n)
+		}
+	}
+	slices.SortStableFunc(s.Notes, func(a, b note) int { return strings.Compare(a.Time, b.Time) })
+}
+
+func printNotes(notes []note) {
+	if len(notes) == 0 {
+		return
+	}
+	fmt.Println("=============================================")
+	fmt.Printf("%d operator notes:\n", len(notes))
+	for _, n := range notes {
+		fmt.Printf("  %s after batch %d: %s\n", displayStamp(n.Time), n.AfterBatch, n.Text)
+	}
+}
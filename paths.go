@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Refuse to run when dbatch would find its own files while discovering or
+// rescanning the input: the working directories under tmp hold symlinks named
+// like the inputs, and outputs inside the input are only safe while they don't
+// carry one of the input extensions. Discovery skips run directories, so the
+// default tmp is safe wherever the output is. With -read-only-input nothing at
+// all may be written inside the input.
+func (b *batch) checkPaths() error {
+	in := resolvePath(b.in)
+	own := resolvePath(runDir(b.out))
+	spool := b.spool
+	if spool == "" && b.perBatch {
+		spool = b.tmp + "-spool"
+	}
+	for _, dir := range []struct{ flag, path string }{
+		{"-tmp", b.tmp},
+		{"-spool", spool},
+		{"-cache", cacheDir(b.cache)},
+	} {
+		if dir.path != "" && within(resolvePath(dir.path), in) && !within(resolvePath(dir.path), own) {
+			return fmt.Errorf("%s %s is inside -in %s, dbatch would basecall its own copies of the inputs", dir.flag, dir.path, b.in)
+		}
+	}
+
+	outputs := []struct{ flag, path string }{{"-out", b.out}}
+	if b.decontam != nil && b.decontam.keep != "" {
+		outputs = append(outputs, struct{ flag, path string }{"-decontam-keep", b.decontam.keep})
+	}
+	if b.readOnlyIn {
+		audit := b.auditPath
+		if audit == "" {
+			audit = auditPath(b.out)
+		}
+		outputs = append(outputs, struct{ flag, path string }{"-audit", audit})
+		for _, out := range outputs {
+			if within(resolvePath(out.path), in) {
+				return fmt.Errorf("%s %s is inside the read-only -in %s, write it elsewhere", out.flag, out.path, b.in)
+			}
+		}
+		return nil
+	}
+	for _, out := range outputs {
+		if !within(resolvePath(out.path), in) {
+			continue
+		}
+		// a bam run writes a directory of batch_NNNNN.bam
+		if slices.Contains(b.exts, filepath.Ext(out.path)) || (b.perBatch && b.format == formatBAM && slices.Contains(b.exts, ".bam")) {
+			return fmt.Errorf("%s %s is inside -in %s and would be picked up as input, write it elsewhere", out.flag, out.path, b.in)
+		}
+	}
+	return nil
+}
+
+func cacheDir(c *pod5Cache) string {
+	if c == nil {
+		return ""
+	}
+	return c.dir
+}
+
+// Absolute path with symlinks resolved as far as the path exists, so a tmp
+// directory that is yet to be made is compared by its parent
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	var rest []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{real}, rest...)...)
+		}
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			return abs
+		}
+		rest = append([]string{filepath.Base(dir)}, rest...)
+	}
+}
+
+// whether path is dir or below it
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
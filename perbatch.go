@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compressPool compresses spooled per-batch files with several compressor
+// processes in parallel, decoupled from the basecalling loop, so the GPU can
+// move on to the next chunk while earlier ones are still being compressed
+type compressPool struct {
+	spool    string
+	dir      string
+	throttle *throttle
+	check    float64
+	bam      bool // bam batches are moved into place as they are
+
+	jobs    chan compressJob
+	results chan compressResult
+	wg      sync.WaitGroup
+	pending int
+}
+
+type compressJob struct {
+	index int
+	raw   string
+	reads int64 // counted while basecalling, -1 if not
+	hash  string
+}
+
+type compressResult struct {
+	index   int
+	output  string
+	length  int64
+	checked int
+	sha256  string
+	err     error
+
+	// background compression and spot check, in seconds
+	compress, verify float64
+}
+
+// Start the compression pool for a -per-batch run, b.out is the output directory
+func (b *batch) startPool() error {
+	if !b.perBatch {
+		return nil
+	}
+	spool := b.spool
+	if spool == "" {
+		spool = b.tmp + "-spool"
+	}
+	if err := os.MkdirAll(spool, 0750); err != nil {
+		return fmt.Errorf("error making spool directory %w", err)
+	}
+	if err := os.MkdirAll(b.out, 0755); err != nil {
+		return fmt.Errorf("error making output directory %w", err)
+	}
+	perms.setDir(b.out)
+
+	metrics.describe("dbatch_compress_queue", "gauge", "Spooled batches waiting to be compressed")
+
+	p := &compressPool{
+		spool:    spool,
+		dir:      b.out,
+		throttle: b.throttle,
+		check:    b.spotCheck,
+		bam:      b.format == formatBAM,
+		jobs:     make(chan compressJob, 1024),
+		results:  make(chan compressResult, 1024),
+	}
+	for range b.compressWorkers {
+		p.wg.Add(1)
+		go p.work()
+	}
+	b.pool = p
+	return nil
+}
+
+func (p *compressPool) spoolPath(index int) string {
+	if p.bam {
+		return filepath.Join(p.spool, fmt.Sprintf("batch_%05d.bam", index))
+	}
+	return filepath.Join(p.spool, fmt.Sprintf("batch_%05d.fastq", index))
+}
+
+// batch_00001.fastq.zst, or with -hash-names batch_<hash>.fastq.zst
+func (p *compressPool) outputPath(index int, hash string) string {
+	name := fmt.Sprintf("batch_%05d", index)
+	if hash != "" {
+		name = "batch_" + hash
+	}
+	if p.bam {
+		return filepath.Join(p.dir, name+".bam")
+	}
+	return filepath.Join(p.dir, name+".fastq.zst")
+}
+
+func (p *compressPool) submit(index int, raw string, reads int64, hash string) {
+	p.pending++
+	metrics.set("dbatch_compress_queue", float64(p.pending))
+	p.jobs <- compressJob{index, raw, reads, hash}
+}
+
+func (p *compressPool) work() {
+	defer p.wg.Done()
+	for j := range p.jobs {
+		p.results <- p.compress(j)
+	}
+}
+
+// compress one spooled batch into place, removing the spool file on success
+func (p *compressPool) compress(j compressJob) compressResult {
+	r := compressResult{index: j.index, output: p.outputPath(j.index, j.hash)}
+
+	in, err := os.Open(j.raw)
+	if err != nil {
+		r.err = fmt.Errorf("error opening spooled batch %w", err)
+		return r
+	}
+	defer in.Close()
+
+	// write next to the final name so a half written file is never mistaken for a batch
+	tmp := r.output + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		r.err = fmt.Errorf("error creating batch output %w", err)
+		return r
+	}
+	perms.set(tmp)
+	defer out.Close()
+
+	started := time.Now()
+	var dst io.Writer = out
+	if p.throttle != nil {
+		dst = p.throttle.writer(out)
+	}
+	if p.bam {
+		if _, err := io.Copy(dst, in); err != nil {
+			os.Remove(tmp)
+			r.err = fmt.Errorf("error writing batch output %w", err)
+			return r
+		}
+	} else {
+		zstd := command(compressors[0][0], compressors[0][1:]...)
+		zstd.Stdin = in
+		zstd.Stderr = os.Stderr
+		zstd.Stdout = dst
+		release := slots.hold(1)
+		err := zstd.Run()
+		release()
+		if err != nil {
+			os.Remove(tmp)
+			r.err = fmt.Errorf("zstd error: %w", err)
+			return r
+		}
+	}
+	info, err := out.Stat()
+	if err != nil {
+		r.err = fmt.Errorf("error writing batch output %w", err)
+		return r
+	}
+	r.length = info.Size()
+	if err := os.Rename(tmp, r.output); err != nil {
+		r.err = fmt.Errorf("error writing batch output %w", err)
+		return r
+	}
+
+	r.compress = time.Since(started).Seconds()
+
+	if p.check > 0 {
+		verify := time.Now()
+		var res spotResult
+		res, r.err = spotCheck(r.output, 0, r.length, p.check, j.reads)
+		r.checked, r.sha256 = res.sampled, res.sha256
+		r.verify = time.Since(verify).Seconds()
+		if r.err != nil {
+			return r
+		}
+	}
+	os.Remove(j.raw)
+	return r
+}
+
+// Record batches the pool has finished. With wait set, shut the pool down and
+// wait for every outstanding batch.
+func (b *batch) collectCompressed(wait bool) {
+	p := b.pool
+	if p == nil {
+		return
+	}
+	if wait {
+		close(p.jobs)
+		go func() {
+			p.wg.Wait()
+			close(p.results)
+		}()
+	}
+
+	for p.pending > 0 {
+		var r compressResult
+		if wait {
+			r = <-p.results
+		} else {
+			select {
+			case r = <-p.results:
+			default:
+				return
+			}
+		}
+		p.pending--
+		metrics.set("dbatch_compress_queue", float64(p.pending))
+
+		rec, ok := b.state.findBatch(r.index)
+		if !ok {
+			continue
+		}
+		if r.err != nil {
+			fmt.Printf("batch %d could not be compressed: %s\n", r.index, r.err)
+			rec.Error = r.err.Error()
+			metrics.add("dbatch_batches_failed_total", 1)
+			b.audit.record(b.out, "batch_failed", map[string]any{"batch": r.index, "error": rec.Error})
+		} else {
+			rec.Output, rec.Offset, rec.Length = r.output, 0, r.length
+			rec.SHA256 = r.sha256
+			rec.Done = true
+			if rec.Timings != nil {
+				rec.Timings.Tail += r.compress
+				rec.Timings.Verify = r.verify
+			}
+			metrics.add("dbatch_batches_done_total", 1)
+			metrics.add("dbatch_spot_check_records_total", float64(r.checked))
+			b.audit.record(b.out, "batch_done", map[string]any{"batch": rec.Index, "output": rec.Output, "length": rec.Length, "reads": rec.Reads})
+			b.publishBatch(rec)
+			b.recordHistory(rec)
+		}
+		if err := b.state.save(); err != nil {
+			fmt.Println(err)
+		}
+		if err := newManifest(b.state).write(b.manifestPath()); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// only batches that failed to compress are left behind in the spool
+	if wait {
+		os.Remove(p.spool)
+	}
+}
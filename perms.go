@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// -file-mode, -dir-mode and -group set what the outputs of a run are created
+// with, regardless of the umask of the account writing them, so what a
+// service account basecalls is readable by the lab group straight away. With
+// -group directories are made setgid, files created in them later by anyone
+// get the group too.
+type permissions struct {
+	file, dir os.FileMode // 0 leaves what the umask gives
+	gid       int         // -1 leaves the group
+	warned    *sync.Once
+}
+
+var perms = permissions{gid: -1}
+
+func parsePermissions(fileMode, dirMode, group string) (permissions, error) {
+	p := permissions{gid: -1, warned: new(sync.Once)}
+	var err error
+	if p.file, err = parseMode(fileMode, "-file-mode"); err != nil {
+		return p, err
+	}
+	if p.dir, err = parseMode(dirMode, "-dir-mode"); err != nil {
+		return p, err
+	}
+	if group == "" {
+		return p, nil
+	}
+	if runtime.GOOS == "windows" {
+		return p, fmt.Errorf("-group isn't supported on windows, set the group with the acls of the output directory")
+	}
+	if p.gid, err = strconv.Atoi(group); err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return p, fmt.Errorf("error in -group %w", err)
+		}
+		p.gid, _ = strconv.Atoi(g.Gid)
+	}
+	if p.dir == 0 {
+		p.dir = 0o775
+	}
+	p.dir |= os.ModeSetgid
+	return p, nil
+}
+
+// an octal mode like 0640 or 2775, the setgid bit as 2000
+func parseMode(s, flag string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o7777 {
+		return 0, fmt.Errorf("invalid %s %q, give an octal mode like 0640", flag, s)
+	}
+	mode := os.FileMode(n) & os.ModePerm
+	if n&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if n&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if n&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+func (p permissions) active() bool {
+	return p.file != 0 || p.dir != 0 || p.gid >= 0
+}
+
+// Give a file just created its mode and group
+func (p permissions) set(path string) {
+	p.apply(path, p.file)
+}
+
+// Give a directory just created its mode and group
+func (p permissions) setDir(path string) {
+	p.apply(path, p.dir)
+}
+
+func (p permissions) apply(path string, mode os.FileMode) {
+	if !p.active() {
+		return
+	}
+	var err error
+	if p.gid >= 0 {
+		err = os.Lchown(path, -1, p.gid)
+	}
+	// after chown, which clears setgid on some systems
+	if mode != 0 && err == nil {
+		err = os.Chmod(path, mode)
+	}
+	if err != nil {
+		// once, not for every batch
+		p.warned.Do(func() { fmt.Printf("warning: can't set the permissions of the outputs: %s\n", err) })
+	}
+}
+
+// Set the permissions of everything under root, for the files the run made
+// that weren't set as they were created
+func (p permissions) tree(root string) {
+	if !p.active() {
+		return
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+		case d.IsDir():
+			p.setDir(path)
+		case d.Type().IsRegular():
+			p.set(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Debugging runs of a single chunk: -only-files basecalls the files listed in
+// a file as one chunk, -only-batch n the n-th chunk of the usual plan, through
+// the same pipeline as a full run. dorado runs at its most verbose with its
+// stderr kept in the batch log, and the staged inputs and the commands are
+// printed, so a dorado crash or a storage problem can be reproduced on its own.
+func (b *batch) pinned() bool {
+	return b.onlyFiles != "" || b.onlyBatch > 0
+}
+
+// Check the pinning flags against the rest of the run
+func (b *batch) checkPinned() error {
+	if !b.pinned() {
+		return nil
+	}
+	switch {
+	case b.onlyFiles != "" && b.onlyBatch > 0:
+		return fmt.Errorf("-only-files and -only-batch can't be combined")
+	case b.shards > 1 || len(b.devices) > 1 || b.rescan:
+		return fmt.Errorf("-only-files and -only-batch run one chunk, drop -shard, -devices and -rescan")
+	case b.onlyFiles != "" && len(b.priorityBarcodes) > 0:
+		return fmt.Errorf("-only-files can't be combined with -priority-barcodes")
+	}
+	// a debugging run must not append to a real output
+	if _, err := os.Stat(b.out); err == nil {
+		return fmt.Errorf("-out %s exists, give a debugging run an output of its own", b.out)
+	}
+	b.batchLogs = true
+	return nil
+}
+
+// Read -only-files, one path per line, blank lines and # comments skipped
+func readFileList(path string) ([]pod5, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading -only-files %w", err)
+	}
+	defer f.Close()
+	var files []pod5
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := os.Stat(line); err != nil && !isURL(line) {
+			return nil, fmt.Errorf("error in -only-files %w", err)
+		}
+		files = append(files, pod5{path: line, name: filepath.Base(line)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading -only-files %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files listed in %s", path)
+	}
+	return files, nil
+}
+
+// Print what a pinned chunk is about to run on, the staged inputs with what
+// they point to and their sizes
+func (b *batch) printStaged() {
+	entries, err := os.ReadDir(b.work.stage)
+	if err != nil {
+		fmt.Printf("error listing %s %s\n", b.work.stage, err)
+		return
+	}
+	fmt.Printf("staged in %s:\n", b.work.stage)
+	for _, e := range entries {
+		path := filepath.Join(b.work.stage, e.Name())
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			fmt.Printf("  %s: %s\n", e.Name(), err)
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			fmt.Printf("  %s -> %s: %s\n", e.Name(), target, err)
+			continue
+		}
+		fmt.Printf("  %s -> %s, %s\n", e.Name(), target, bytesIEC(info.Size()))
+	}
+	if len(b.env) > 0 {
+		fmt.Printf("env: %s\n", strings.Join(b.env, " "))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// a chunk of the plan, files b.pod5s start to end
+type span struct {
+	start, end int
+}
+
+// Read the read counts of files from on from the pod5 footers. Files that
+// can't be read keep reads -1 and weigh as an average file when balancing.
+func countReads(files *fileList, from int) (total int64, unknown int, err error) {
+	err = files.each(from, files.len(), func(i int, f pod5) error {
+		if f.reads == 0 && filepath.Ext(f.path) != ".pod5" {
+			// only pod5 files carry a count
+			f.reads = -1
+			files.setReads(i, -1)
+		}
+		if f.reads != 0 {
+			if f.reads < 0 {
+				unknown++
+			} else {
+				total += f.reads
+			}
+			return nil
+		}
+		n, err := pod5ReadCount(f.path)
+		if err != nil {
+			fmt.Printf("can't read count from %s, counting it as an average file\n", err)
+			files.setReads(i, -1)
+			unknown++
+			return nil
+		}
+		files.setReads(i, n)
+		total += n
+		return nil
+	})
+	return total, unknown, err
+}
+
+// Split files from to end into chunks. Plain chunks are -chunk files each;
+// balanced chunks keep the same number of chunks but cut them at equal read
+// counts so a few large files don't make one batch much longer than the rest.
+func planChunks(files *fileList, from, end, chunk int, balance bool) []span {
+	var plan []span
+	n := end - from
+	if !balance || n <= chunk {
+		for i := from; i < end; i += chunk {
+			plan = append(plan, span{i, min(i+chunk, end)})
+		}
+		return plan
+	}
+
+	// files without a count weigh as much as the average file
+	var total, known int64
+	for i := from; i < end; i++ {
+		if reads := files.readCount(i); reads > 0 {
+			total += reads
+			known++
+		}
+	}
+	if known == 0 {
+		return planChunks(files, from, end, chunk, false)
+	}
+	avg := total / known
+	weight := func(i int) int64 {
+		if reads := files.readCount(i); reads >= 0 {
+			return reads
+		}
+		return avg
+	}
+	total += avg * (int64(n) - known)
+
+	chunks := (n + chunk - 1) / chunk
+	start := from
+	var sum int64
+	for i := from; i < end; i++ {
+		sum += weight(i)
+		// cut once this chunk has its share, never more than twice -chunk
+		target := total * int64(len(plan)+1) / int64(chunks)
+		if sum >= target || i+1-start >= 2*chunk {
+			plan = append(plan, span{start, i + 1})
+			start = i + 1
+		}
+	}
+	if start < end {
+		plan = append(plan, span{start, end})
+	}
+	return plan
+}
+
+// Plan the chunks of the run and report what to expect from it
+func (b *batch) planRun() error {
+	if b.countReads {
+		total, unknown, err := countReads(b.pod5s, 0)
+		if err != nil {
+			return err
+		}
+		// nothing to report when none of the inputs are pod5
+		switch files := b.pod5s.len(); {
+		case unknown == 0:
+			fmt.Printf("%s reads expected from %s files\n", thousands(total), thousands(int64(files)))
+		case unknown < files:
+			fmt.Printf("%s reads expected from %s files, %s files without a read count\n", thousands(total), thousands(int64(files-unknown)), thousands(int64(unknown)))
+		}
+	}
+	if b.planner != "" {
+		if err := b.externalPlan(); err != nil {
+			return err
+		}
+	} else {
+		// priority files get chunks of their own, none shared with the rest
+		b.plan = append(planChunks(b.pod5s, 0, b.priorityFiles, b.chunk, b.balance), planChunks(b.pod5s, b.priorityFiles, b.pod5s.len(), b.chunk, b.balance)...)
+	}
+	if err := b.skipBatches(); err != nil {
+		return err
+	}
+	b.expectReads()
+	b.reportSkipped()
+	fmt.Printf("planned %d batches\n", len(b.plan))
+	b.started = time.Now()
+	return nil
+}
+
+// Re-plan everything after the batches already basecalled
+func (b *batch) replanChunks() {
+	if b.countReads {
+		if _, _, err := countReads(b.pod5s, b.next); err != nil {
+			fmt.Println(err)
+		}
+	}
+	b.plan = append(b.plan[:b.nextChunk], planChunks(b.pod5s, b.next, b.pod5s.len(), b.chunk, b.balance)...)
+	if err := b.skipBatches(); err != nil {
+		fmt.Println(err)
+	}
+	b.expectReads()
+}
+
+// with -shard only every n-th chunk belongs to this instance, with
+// -only-batch only the one, and none on the -skip-list
+func (b *batch) owns(c int) bool {
+	if b.onlyBatch > 0 {
+		return c == b.onlyBatch-1
+	}
+	if b.skipsBatch(c) {
+		return false
+	}
+	return b.shards <= 1 || c%b.shards == b.shard-1
+}
+
+// expected reads and files left for this instance, for the eta
+func (b *batch) expectReads() {
+	b.expectedReads, b.expectedFiles, b.uncounted = 0, 0, false
+	for c, sp := range b.plan {
+		if !b.owns(c) {
+			continue
+		}
+		b.expectedFiles += sp.end - sp.start
+		for i := sp.start; i < sp.end; i++ {
+			reads := b.pod5s.readCount(i)
+			if reads < 0 {
+				b.uncounted = true
+			}
+			b.expectedReads += max(reads, 0)
+		}
+	}
+}
+
+// Estimate the time left from reads basecalled so far, or from files when the
+// read counts aren't known
+func (b *batch) eta() string {
+	elapsed := time.Since(b.started)
+	var done float64
+	if b.countReads && !b.uncounted && b.expectedReads > 0 && b.qc != nil {
+		done = float64(b.readsDone) / float64(b.expectedReads)
+	} else if b.expectedFiles > 0 {
+		done = float64(b.filesDone) / float64(b.expectedFiles)
+	}
+	if done <= 0 || done >= 1 {
+		return ""
+	}
+	left := time.Duration(float64(elapsed) * (1 - done) / done)
+	return fmt.Sprintf("%.0f%% done, eta %s", done*100, humanDuration(left))
+}
+
+// Compare the reads dorado emitted for a batch, host reads removed included,
+// with the read counts of its pod5s. Dorado skipping reads it can't basecall
+// is otherwise silent. More reads than expected is fine, split reads do that.
+func (b *batch) crossCheck(rec *batchRecord, files []pod5, emitted int64) {
+	if !b.countReads {
+		return
+	}
+	var expected int64
+	for _, f := range files {
+		if f.reads < 0 {
+			return
+		}
+		expected += f.reads
+	}
+	rec.ExpectedReads = expected
+	rec.MissingReads = max(expected-emitted, 0)
+	if rec.MissingReads == 0 {
+		return
+	}
+	fmt.Printf("warning: batch %d: dorado emitted %s of the %s reads in its pod5s, %s missing\n", rec.Index, thousands(emitted), thousands(expected), thousands(rec.MissingReads))
+	metrics.add("dbatch_reads_missing_total", float64(rec.MissingReads))
+	b.audit.record(b.out, "reads_missing", map[string]any{"batch": rec.Index, "expected": expected, "emitted": emitted})
+}
+
+// list the batches dorado didn't emit every read of
+func printShortfalls(batches []batchRecord) {
+	var total, expected int64
+	var short []batchRecord
+	for _, rec := range batches {
+		expected += rec.ExpectedReads
+		if rec.MissingReads > 0 {
+			total += rec.MissingReads
+			short = append(short, rec)
+		}
+	}
+	if len(short) == 0 {
+		return
+	}
+	fmt.Println("=============================================")
+	fmt.Printf("%s of %s reads in the pod5 metadata were not emitted by dorado:\n", thousands(total), thousands(expected))
+	for _, rec := range short {
+		fmt.Printf("  batch %d: %s of %s missing\n", rec.Index, thousands(rec.MissingReads), thousands(rec.ExpectedReads))
+	}
+}
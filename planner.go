@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// -planner hands the chunking of a run to a site's own policy, by sample, by
+// tape locality or anything else, without forking dbatch. The command gets
+// the inputs as json on stdin,
+//
+//	{"in": "/data/run1", "out": "run1.fastq.zst", "chunk": 50,
+//	 "files": [{"index": 0, "path": "/data/run1/a.pod5", "name": "a.pod5", "reads": 4000}, ...]}
+//
+// with reads from the pod5 footers, -1 or 0 where not known, and prints the
+// chunks to basecall in order, as the indexes of their files, on stdout:
+//
+//	{"chunks": [[0, 3, 4], [1, 2]],
+//	 "skipped": [{"files": [5], "reason": "tape offline"}]}
+//
+// Every file goes in one chunk or is skipped, which is recorded like the
+// -skip-list. Shards and devices each run the planner, so it must give every
+// one of them the same plan.
+type plannerInput struct {
+	Index int    `json:"index"`
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Reads int64  `json:"reads"`
+}
+
+type plannerOutput struct {
+	Chunks  [][]int `json:"chunks"`
+	Skipped []struct {
+		Files  []int  `json:"files"`
+		Reason string `json:"reason"`
+	} `json:"skipped"`
+}
+
+// Plan the run with -planner, reordering the inputs so its chunks are spans
+func (b *batch) externalPlan() error {
+	cmd := shellCommand(b.planner)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("could not get planner stdin %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("could not get planner stdout %w", err)
+	}
+	fmt.Printf("planning with %s\n", b.planner)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting -planner %w", err)
+	}
+
+	// written while the planner reads, an archive's list doesn't fit a pipe
+	written := make(chan error, 1)
+	go func() {
+		written <- b.writePlannerInput(stdin)
+		stdin.Close()
+	}()
+	var out plannerOutput
+	decodeErr := json.NewDecoder(bufio.NewReader(stdout)).Decode(&out)
+	writeErr := <-written
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("-planner error %w", err)
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("error parsing -planner output %w", decodeErr)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("error writing the inputs to -planner %w", writeErr)
+	}
+
+	n := b.pod5s.len()
+	seen := make([]bool, n)
+	var assigned int
+	take := func(i int) error {
+		switch {
+		case i < 0 || i >= n:
+			return fmt.Errorf("-planner named file %d of %d", i, n)
+		case seen[i]:
+			return fmt.Errorf("-planner named file %d more than once", i)
+		}
+		seen[i] = true
+		assigned++
+		return nil
+	}
+	for _, chunk := range out.Chunks {
+		for _, i := range chunk {
+			if err := take(i); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range out.Skipped {
+		for _, i := range s.Files {
+			if err := take(i); err != nil {
+				return err
+			}
+		}
+	}
+	if assigned < n {
+		return fmt.Errorf("-planner left %d of the %d files out of its chunks, list them under skipped to leave them out", n-assigned, n)
+	}
+
+	// the files in the order of the chunks
+	plan := b.pod5s.derive()
+	var spans []span
+	for _, chunk := range out.Chunks {
+		if len(chunk) == 0 {
+			continue
+		}
+		start := plan.len()
+		for _, i := range chunk {
+			files, err := b.pod5s.files(i, i+1)
+			if err == nil {
+				err = plan.add(files[0])
+			}
+			if err != nil {
+				plan.close()
+				return err
+			}
+		}
+		spans = append(spans, span{start, plan.len()})
+	}
+	for _, s := range out.Skipped {
+		rec := skipRecord{Entry: "planner", Reason: s.Reason}
+		for _, i := range s.Files {
+			files, err := b.pod5s.files(i, i+1)
+			if err != nil {
+				plan.close()
+				return err
+			}
+			rec.Files = append(rec.Files, absPath(files[0].path))
+		}
+		if len(rec.Files) > 0 {
+			fmt.Printf("the planner skipped %s files: %s\n", thousands(int64(len(rec.Files))), cmp.Or(rec.Reason, "no reason given"))
+			b.skippedFiles = append(b.skippedFiles, rec)
+		}
+	}
+	if err := b.pod5s.replace(plan); err != nil {
+		return err
+	}
+	b.plan = spans
+	if b.pod5s.len() == 0 {
+		return fmt.Errorf("-planner skipped every file")
+	}
+	return nil
+}
+
+func (b *batch) writePlannerInput(to io.Writer) error {
+	w := bufio.NewWriterSize(to, 1<<20)
+	head, err := json.Marshal(map[string]any{"in": b.in, "out": b.outName(), "chunk": b.chunk})
+	if err != nil {
+		return err
+	}
+	// the files are streamed into the object rather than marshaled at once
+	w.Write(head[:len(head)-1])
+	w.WriteString(`,"files":[`)
+	err = b.pod5s.each(0, b.pod5s.len(), func(i int, p pod5) error {
+		data, err := json.Marshal(plannerInput{Index: i, Path: absPath(p.path), Name: p.name, Reads: p.reads})
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteString("]}\n")
+	return w.Flush()
+}
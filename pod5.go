@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// pod5 files are a set of arrow IPC files embedded in a container with a
+// flatbuffer footer listing them. Mostly we only need the number of rows in the
+// reads table, which the arrow footer and record batch headers give us without
+// touching the data itself, dbatch audit reads its read_id column too.
+
+var (
+	pod5Signature   = []byte("\x8bPOD\r\n\x1a\n")
+	pod5FooterMagic = []byte("FOOTER\x00\x00")
+	arrowMagic      = []byte("ARROW1")
+)
+
+const (
+	pod5SectionMarker = 16
+	pod5ReadsTable    = 0 // ContentType of the reads table in the footer
+)
+
+var errNotPod5 = errors.New("not a pod5 file")
+
+// Count the reads in a pod5 file from its metadata
+func pod5ReadCount(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	offset, length, err := pod5ReadsTableSpan(f, info.Size())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	n, err := arrowRowCount(io.NewSectionReader(f, offset, length), length)
+	if err != nil {
+		return 0, fmt.Errorf("%s: reads table: %w", path, err)
+	}
+	return n, nil
+}
+
+// Find the embedded reads table from the pod5 footer
+func pod5ReadsTableSpan(f io.ReaderAt, size int64) (int64, int64, error) {
+	footer, err := pod5Footer(f, size)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// table Footer { file_identifier, software, pod5_version, contents:[EmbeddedFile] }
+	contents, err := footer.vector(3)
+	if err != nil {
+		return 0, 0, err
+	}
+	for n := range contents.len {
+		// table EmbeddedFile { offset:int64, length:int64, format:short, content_type:short }
+		ef, err := contents.table(n)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ef.int16(3) != pod5ReadsTable {
+			continue
+		}
+		return ef.int64(0), ef.int64(1), nil
+	}
+	return 0, 0, fmt.Errorf("pod5 has no reads table")
+}
+
+// The file identifier of a pod5, a uuid MinKNOW gives every file it writes
+func pod5FileID(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	footer, err := pod5Footer(f, info.Size())
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	if id := footer.string(0); id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("%s: pod5 has no file identifier", path)
+}
+
+// the flatbuffer footer of a pod5
+func pod5Footer(f io.ReaderAt, size int64) (flatbuf, error) {
+	// ... footer, footer length, section marker, signature
+	trailer := int64(8 + pod5SectionMarker + len(pod5Signature))
+	if size < int64(len(pod5Signature))+trailer {
+		return flatbuf{}, errNotPod5
+	}
+	head := make([]byte, len(pod5Signature))
+	tail := make([]byte, trailer)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return flatbuf{}, err
+	}
+	if _, err := f.ReadAt(tail, size-trailer); err != nil {
+		return flatbuf{}, err
+	}
+	if !bytes.Equal(head, pod5Signature) || !bytes.Equal(tail[trailer-int64(len(pod5Signature)):], pod5Signature) {
+		return flatbuf{}, errNotPod5
+	}
+
+	footerLen := int64(binary.LittleEndian.Uint64(tail[:8]))
+	footerEnd := size - trailer
+	if footerLen <= 0 || footerLen > footerEnd {
+		return flatbuf{}, fmt.Errorf("bad pod5 footer length %d", footerLen)
+	}
+	// read the footer with the magic in front of it, which tells us exactly
+	// where the flatbuffer starts whether or not the length includes padding
+	start := max(footerEnd-footerLen-int64(len(pod5FooterMagic))-8, 0)
+	buf := make([]byte, footerEnd-start)
+	if _, err := f.ReadAt(buf, start); err != nil {
+		return flatbuf{}, err
+	}
+	i := bytes.LastIndex(buf, pod5FooterMagic)
+	if i < 0 {
+		return flatbuf{}, fmt.Errorf("pod5 footer magic not found")
+	}
+	return flatTable(buf[i+len(pod5FooterMagic):]), nil
+}
+
+// Sum the row counts of the record batches in an arrow IPC file
+func arrowRowCount(r io.ReaderAt, size int64) (int64, error) {
+	var rows int64
+	_, err := arrowBatches(r, size, func(rb flatbuf, body int64) error {
+		rows += rb.int64(0)
+		return nil
+	})
+	return rows, err
+}
+
+// Call fn with the header of every record batch in an arrow IPC file and
+// where its body starts, returning the footer
+func arrowBatches(r io.ReaderAt, size int64, fn func(rb flatbuf, body int64) error) (flatbuf, error) {
+	tail := make([]byte, 4+len(arrowMagic))
+	if size < int64(len(tail)) {
+		return flatbuf{}, fmt.Errorf("truncated arrow file")
+	}
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return flatbuf{}, err
+	}
+	if !bytes.Equal(tail[4:], arrowMagic) {
+		return flatbuf{}, fmt.Errorf("not an arrow file")
+	}
+	footerLen := int64(binary.LittleEndian.Uint32(tail[:4]))
+	footerStart := size - int64(len(tail)) - footerLen
+	if footerLen <= 0 || footerStart < 0 {
+		return flatbuf{}, fmt.Errorf("bad arrow footer length %d", footerLen)
+	}
+	buf := make([]byte, footerLen)
+	if _, err := r.ReadAt(buf, footerStart); err != nil {
+		return flatbuf{}, err
+	}
+
+	// table Footer { version, schema, dictionaries:[Block], recordBatches:[Block] }
+	footer := flatTable(buf)
+	batches, err := footer.vector(3)
+	if err != nil {
+		return footer, err
+	}
+	for n := range batches.len {
+		// struct Block { offset:long, metaDataLength:int, (pad), bodyLength:long }
+		block, err := batches.structAt(n, 24)
+		if err != nil {
+			return footer, err
+		}
+		offset := int64(binary.LittleEndian.Uint64(block[0:]))
+		metaLen := int64(int32(binary.LittleEndian.Uint32(block[8:])))
+		if offset < 0 || metaLen < 8 || offset+metaLen > size {
+			return footer, fmt.Errorf("bad record batch block")
+		}
+		meta := make([]byte, metaLen)
+		if _, err := r.ReadAt(meta, offset); err != nil {
+			return footer, err
+		}
+		// messages start with a continuation marker and their length, older
+		// writers only wrote the length
+		msg := meta[4:]
+		if binary.LittleEndian.Uint32(meta) == 0xffffffff {
+			msg = meta[8:]
+		}
+
+		// table Message { version, header_type, header, bodyLength }
+		// table RecordBatch { length:long, nodes, buffers, compression }
+		rb, err := flatTable(msg).table(2)
+		if err != nil {
+			return footer, err
+		}
+		if err := fn(rb, offset+metaLen); err != nil {
+			return footer, err
+		}
+	}
+	return footer, nil
+}
+
+var errCompressedIDs = errors.New("the read IDs of the reads table are compressed")
+
+// The read IDs of a pod5 file, the uuids of the read_id column of its reads
+// table. Unlike the count this reads data, 16 bytes a read.
+func pod5ReadIDs(path string) ([][16]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset, length, err := pod5ReadsTableSpan(f, info.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	table := io.NewSectionReader(f, offset, length)
+
+	var ids [][16]byte
+	footer, err := arrowBatches(table, length, func(rb flatbuf, body int64) error {
+		if rb.field(3) != 0 {
+			return errCompressedIDs
+		}
+		rows := rb.int64(0)
+		// struct Buffer { offset:long, length:long }, the validity and the
+		// values of the first column
+		buffers, err := rb.vector(2)
+		if err != nil {
+			return err
+		}
+		values, err := buffers.structAt(1, 16)
+		if err != nil {
+			return err
+		}
+		start := body + int64(binary.LittleEndian.Uint64(values[0:]))
+		n := int64(binary.LittleEndian.Uint64(values[8:]))
+		if rows < 0 || n < rows*16 || start < 0 || start+n > length {
+			return fmt.Errorf("bad read_id column")
+		}
+		data := make([]byte, rows*16)
+		if _, err := table.ReadAt(data, start); err != nil {
+			return err
+		}
+		for i := range rows {
+			ids = append(ids, [16]byte(data[16*i:]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: reads table: %w", path, err)
+	}
+	// table Schema { endianness, fields:[Field] }, table Field { name, ... }
+	schema, err := footer.table(1)
+	if err == nil {
+		var fields flatVector
+		if fields, err = schema.vector(1); err == nil && fields.len > 0 {
+			var first flatbuf
+			if first, err = fields.table(0); err == nil && first.string(0) != "read_id" {
+				err = fmt.Errorf("the first column is %q, not read_id", first.string(0))
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: reads table: %w", path, err)
+	}
+	return ids, nil
+}
+
+// a uuid as dorado writes it in read IDs
+func uuidString(id [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// flatbuf is a minimal flatbuffers reader, enough for the footers above
+type flatbuf struct {
+	buf []byte
+	pos int // position of the table
+}
+
+var errFlatbuffer = errors.New("malformed flatbuffer")
+
+// the root table of a flatbuffer
+func flatTable(buf []byte) flatbuf {
+	if len(buf) < 4 {
+		return flatbuf{buf: buf, pos: -1}
+	}
+	return flatbuf{buf: buf, pos: int(binary.LittleEndian.Uint32(buf))}
+}
+
+func (t flatbuf) ok(pos, n int) bool {
+	return pos >= 0 && n >= 0 && pos+n <= len(t.buf)
+}
+
+// position of field i, or 0 if not present
+func (t flatbuf) field(i int) int {
+	if !t.ok(t.pos, 4) {
+		return 0
+	}
+	vt := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	if !t.ok(vt, 4) {
+		return 0
+	}
+	vtLen := int(binary.LittleEndian.Uint16(t.buf[vt:]))
+	entry := vt + 4 + 2*i
+	if 4+2*i+2 > vtLen || !t.ok(entry, 2) {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(t.buf[entry:]))
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+func (t flatbuf) int64(i int) int64 {
+	p := t.field(i)
+	if p == 0 || !t.ok(p, 8) {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(t.buf[p:]))
+}
+
+func (t flatbuf) string(i int) string {
+	p, err := t.deref(i)
+	if err != nil {
+		return ""
+	}
+	n := int(binary.LittleEndian.Uint32(t.buf[p:]))
+	if !t.ok(p+4, n) {
+		return ""
+	}
+	return string(t.buf[p+4 : p+4+n])
+}
+
+func (t flatbuf) int16(i int) int16 {
+	p := t.field(i)
+	if p == 0 || !t.ok(p, 2) {
+		return 0
+	}
+	return int16(binary.LittleEndian.Uint16(t.buf[p:]))
+}
+
+// follow the offset stored in field i
+func (t flatbuf) deref(i int) (int, error) {
+	p := t.field(i)
+	if p == 0 || !t.ok(p, 4) {
+		return 0, errFlatbuffer
+	}
+	target := p + int(binary.LittleEndian.Uint32(t.buf[p:]))
+	if !t.ok(target, 4) {
+		return 0, errFlatbuffer
+	}
+	return target, nil
+}
+
+func (t flatbuf) table(i int) (flatbuf, error) {
+	p, err := t.deref(i)
+	if err != nil {
+		return flatbuf{}, err
+	}
+	return flatbuf{buf: t.buf, pos: p}, nil
+}
+
+type flatVector struct {
+	buf []byte
+	pos int // first element
+	len int
+}
+
+func (t flatbuf) vector(i int) (flatVector, error) {
+	p, err := t.deref(i)
+	if err != nil {
+		return flatVector{}, err
+	}
+	return flatVector{buf: t.buf, pos: p + 4, len: int(binary.LittleEndian.Uint32(t.buf[p:]))}, nil
+}
+
+// element n of a vector of tables
+func (v flatVector) table(n int) (flatbuf, error) {
+	p := v.pos + 4*n
+	if p+4 > len(v.buf) {
+		return flatbuf{}, errFlatbuffer
+	}
+	target := p + int(binary.LittleEndian.Uint32(v.buf[p:]))
+	if target+4 > len(v.buf) {
+		return flatbuf{}, errFlatbuffer
+	}
+	return flatbuf{buf: v.buf, pos: target}, nil
+}
+
+// element n of a vector of structs of the given size
+func (v flatVector) structAt(n, size int) ([]byte, error) {
+	p := v.pos + size*n
+	if p < 0 || p+size > len(v.buf) {
+		return nil, errFlatbuffer
+	}
+	return v.buf[p : p+size], nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Move the inputs holding reads of the priority barcodes to the front of the
+// run so those samples are basecalled first. Which files hold them comes from
+// dbatch demux of an earlier, quick pass with the fast model: the barcodes it
+// found in each of its batches and the files of those batches. Files are
+// ordered by how many priority reads their batch had, the rest keep their order.
+func (b *batch) prioritize() error {
+	m, err := readManifest(manifestPath(b.priorityFrom))
+	if err != nil {
+		return err
+	}
+	d, err := loadDemuxManifest(filepath.Join(b.priorityFrom+".demux", "demux.json"), b.priorityFrom, "")
+	if err != nil {
+		return err
+	}
+	if len(d.Batches) == 0 {
+		return fmt.Errorf("%s hasn't been demultiplexed, run dbatch demux -out %s first", b.priorityFrom, b.priorityFrom)
+	}
+
+	perBatch := map[int]int64{}
+	for _, name := range b.priorityBarcodes {
+		bc, ok := d.Barcodes[name]
+		if !ok {
+			fmt.Printf("warning: no reads of %s in %s\n", name, b.priorityFrom)
+			continue
+		}
+		for _, e := range bc.Batches {
+			perBatch[e.Batch] += e.Reads
+		}
+	}
+	// the earlier pass may have run from another mount, match files by name
+	score := map[string]int64{}
+	for _, e := range m.Batches {
+		for _, f := range e.Files {
+			score[filepath.Base(f)] += perBatch[e.Batch]
+		}
+	}
+
+	// the priority files by score, then the rest in their order
+	type scored struct {
+		i     int
+		score int64
+	}
+	var first []scored
+	err = b.pod5s.each(0, b.pod5s.len(), func(i int, f pod5) error {
+		if s := score[f.name]; s > 0 {
+			first = append(first, scored{i, s})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(first, func(x, y scored) int { return cmp.Compare(y.score, x.score) })
+	b.priorityFiles = len(first)
+
+	total := b.pod5s.len()
+	if b.priorityOnly {
+		if b.priorityFiles == 0 {
+			return fmt.Errorf("no files hold reads of %s", strings.Join(b.priorityBarcodes, ", "))
+		}
+		fmt.Printf("%d of %d files hold reads of %s, basecalling only those\n", b.priorityFiles, total, strings.Join(b.priorityBarcodes, ", "))
+	} else {
+		fmt.Printf("%d of %d files hold reads of %s, basecalling them first\n", b.priorityFiles, total, strings.Join(b.priorityBarcodes, ", "))
+	}
+	ordered := b.pod5s.derive()
+	for _, s := range first {
+		files, err := b.pod5s.files(s.i, s.i+1)
+		if err != nil {
+			return err
+		}
+		if err := ordered.add(files[0]); err != nil {
+			return err
+		}
+	}
+	if !b.priorityOnly {
+		err := b.pod5s.each(0, total, func(_ int, f pod5) error {
+			if score[f.name] > 0 {
+				return nil
+			}
+			return ordered.add(f)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.pod5s.replace(ordered); err != nil {
+		return err
+	}
+	b.audit.record(b.out, "plan_prioritized", map[string]any{"barcodes": b.priorityBarcodes, "from": b.priorityFrom, "files": b.priorityFiles})
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Children get a process group of their own so an interrupt in the terminal
+// only reaches dbatch, which lets dorado finish the current batch. When they
+// have to go, the whole group is killed, hooks included.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// hooks run under sh
+func shellCommand(cmd string) *exec.Cmd {
+	return command("sh", "-c", cmd)
+}
+
+// soft limit on open files, Go raises it to the hard limit at startup
+func fdLimit() int64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	return int64(min(rl.Cur, 1<<31))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Children get a process group of their own so Ctrl-C in the console only
+// reaches dbatch, which lets dorado finish the current batch
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// hooks run under cmd.exe
+func shellCommand(cmd string) *exec.Cmd {
+	return command("cmd", "/C", cmd)
+}
+
+// handles aren't limited the way unix descriptors are
+func fdLimit() int64 {
+	return 0
+}
+
+func shellQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
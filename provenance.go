@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// -read-provenance lists every read written with the batch and the pod5 it
+// came from in <out>.dbatch/reads.tsv.gz, for audits and for pulling the raw
+// signal of interesting reads out of the inputs later, e.g. with pod5 filter.
+// The source is the fn:Z: tag dorado writes into the read header, or the only
+// file of a single file batch. Each batch is appended as a gzip member of its
+// own once it is kept, so a retried attempt never leaves rows behind.
+type provenance struct {
+	mu    sync.Mutex
+	path  string
+	reads int64
+}
+
+type provRead struct {
+	id, file []byte
+	parent   []byte // the pi:Z: tag of a read dorado split, for dbatch audit
+}
+
+// provWriter collects the reads of the batch a pipeline is writing, like dupWriter
+type provWriter struct {
+	prov    *provenance
+	pending []provRead
+	line    int
+	partial []byte
+}
+
+var (
+	fnTag = []byte("fn:Z:")
+	piTag = []byte("pi:Z:")
+)
+
+func provenancePath(out string) string {
+	return runFile(out, "reads.tsv.gz")
+}
+
+// Start the table of a run at path, replacing that of an earlier run
+func (p *provenance) start(path string) error {
+	p.path, p.reads = path, 0
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing read provenance %w", err)
+	}
+	return nil
+}
+
+func (p *provenance) writer() *provWriter {
+	return &provWriter{prov: p}
+}
+
+func (w *provWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			break
+		}
+		if w.line%4 == 0 {
+			line := p[:i]
+			if len(w.partial) > 0 {
+				line = append(w.partial, line...)
+			}
+			if len(line) > 1 && line[0] == '@' {
+				w.pending = append(w.pending, parseProvenance(line[1:]))
+			}
+		}
+		w.partial = w.partial[:0]
+		w.line++
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// the read ID and fn:Z: and pi:Z: tags of a header, without the @
+func parseProvenance(header []byte) provRead {
+	header = bytes.TrimSuffix(header, []byte{'\r'})
+	id, tags, _ := bytes.Cut(header, []byte{'\t'})
+	id, rest, _ := bytes.Cut(id, []byte{' '})
+	r := provRead{id: bytes.Clone(id)}
+	// dorado separates the tags by tabs, some tools by spaces
+	for _, part := range [][]byte{rest, tags} {
+		for _, tag := range bytes.FieldsFunc(part, func(c rune) bool { return c == '\t' || c == ' ' }) {
+			if file, ok := bytes.CutPrefix(tag, fnTag); ok {
+				r.file = bytes.Clone(file)
+			}
+			if parent, ok := bytes.CutPrefix(tag, piTag); ok {
+				r.parent = bytes.Clone(parent)
+			}
+		}
+	}
+	return r
+}
+
+// forget the batch, after a failed attempt
+func (w *provWriter) drop() {
+	w.pending, w.partial, w.line = nil, nil, 0
+}
+
+// Append the batch's reads to the table, files being the inputs of the batch
+func (w *provWriter) commit(batch int, files []string) error {
+	defer w.drop()
+	var only []byte
+	if len(files) == 1 {
+		only = []byte(filepath.Base(files[0]))
+	}
+
+	p := w.prov
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening read provenance %w", err)
+	}
+	perms.set(p.path)
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error writing read provenance %w", err)
+	}
+	zw := gzip.NewWriter(f)
+	bw := bufio.NewWriter(zw)
+	if info.Size() == 0 {
+		fmt.Fprintln(bw, "read_id\tbatch\tfile")
+	}
+	for _, r := range w.pending {
+		file := r.file
+		if file == nil {
+			file = only
+		}
+		fmt.Fprintf(bw, "%s\t%d\t%s\n", r.id, batch, file)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing read provenance %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("error writing read provenance %w", err)
+	}
+	p.reads += int64(len(w.pending))
+	return f.Close()
+}
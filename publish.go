@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publishes an event to a NATS subject for every batch as it is done, holding
+// the batch's manifest entry, and one when the run ends, so pipelines
+// downstream can align and call variants chunk by chunk instead of waiting for
+// the whole run. Kafka and AMQP consumers can take them from a NATS bridge.
+// Like traces, events that can't be delivered cost the events, never the run.
+type publisher struct {
+	mu      sync.Mutex
+	addr    string
+	subject string
+	connect map[string]any // CONNECT options, credentials from the url
+	conn    net.Conn
+	r       *bufio.Reader
+}
+
+const defaultSubject = "dbatch.batches"
+
+// what subscribers receive
+type batchEvent struct {
+	Event  string         `json:"event"` // batch_done or run_finished
+	Out    string         `json:"out"`
+	Model  string         `json:"model"`
+	Labels labels         `json:"labels,omitempty"`
+	Batch  *manifestEntry `json:"batch,omitempty"`
+	Done   int            `json:"done,omitempty"`
+	Failed int            `json:"failed,omitempty"`
+	Error  string         `json:"error,omitempty"`
+	Time   string         `json:"time"`
+}
+
+// Parse -publish, nats://[user:pass@ or token@]host[:port][/subject]
+func newPublisher(spec string) (*publisher, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing -publish %w", err)
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("-publish must be a nats:// url, got %s", spec)
+	}
+	p := &publisher{addr: u.Host, subject: strings.TrimPrefix(u.Path, "/"), connect: map[string]any{
+		"verbose": false, "pedantic": false, "name": "dbatch", "lang": "go", "version": "1",
+	}}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if p.subject == "" {
+		p.subject = defaultSubject
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			p.connect["user"], p.connect["pass"] = u.User.Username(), pass
+		} else {
+			p.connect["auth_token"] = u.User.Username()
+		}
+	}
+	return p, nil
+}
+
+// Publish a done batch, its manifest entry built from the run state
+func (b *batch) publishBatch(rec *batchRecord) {
+	if b.publisher == nil {
+		return
+	}
+	e := b.state.manifestEntryOf(*rec)
+	b.publishEvent(batchEvent{Event: "batch_done", Out: b.outName(), Model: b.model, Labels: b.labels, Batch: &e})
+}
+
+// Publish the end of the run, err being what it ended with
+func (b *batch) publishFinished(done, failed int, err error) {
+	if b.publisher == nil {
+		return
+	}
+	e := batchEvent{Event: "run_finished", Out: b.outName(), Model: b.model, Labels: b.labels, Done: done, Failed: failed}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.publishEvent(e)
+}
+
+// Publish e, keeping it for dbatch deliveries retry if it can't be delivered
+func (b *batch) publishEvent(e batchEvent) {
+	e.Out, e.Labels, e.Error = b.redact.path(e.Out), b.redact.labelSet(e.Labels), b.redactText(e.Error)
+	if e.Batch != nil {
+		entry := b.redactEntry(*e.Batch)
+		e.Batch = &entry
+	}
+	data, err := b.publisher.publish(e)
+	if err == nil || data == nil {
+		return
+	}
+	d := delivery{Kind: "nats", Event: e.Event, Payload: data, Error: err.Error()}
+	d.Target, d.Auth = b.publisher.target()
+	if e.Batch != nil {
+		d.Batch = e.Batch.Batch
+	}
+	b.failedDelivery(d)
+}
+
+// the output as the manifest names it, that of the whole run when sharded
+func (b *batch) outName() string {
+	if b.sharedOut != "" {
+		return b.sharedOut
+	}
+	return b.out
+}
+
+// Publish an event, returning what was sent and whether it got there
+func (p *publisher) publish(e batchEvent) ([]byte, error) {
+	e.Time = timestamp(time.Now())
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Printf("error encoding %s event %s\n", e.Event, err)
+		return nil, err
+	}
+	if err := p.publishData(data); err != nil {
+		fmt.Printf("error publishing %s event to nats://%s/%s: %s\n", e.Event, p.addr, p.subject, err)
+		return data, err
+	}
+	return data, nil
+}
+
+func (p *publisher) publishData(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// one reconnect, e.g. after the server restarted between batches
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = p.send(data); err == nil {
+			return nil
+		}
+		p.close()
+	}
+	return err
+}
+
+// the url published to, without credentials, and whether there were any
+func (p *publisher) target() (string, bool) {
+	_, auth := p.connect["auth_token"]
+	_, user := p.connect["user"]
+	return fmt.Sprintf("nats://%s/%s", p.addr, p.subject), auth || user
+}
+
+// Send one message and wait for the server to answer a ping after it, so a
+// message is only counted as published once the server has processed it
+func (p *publisher) send(data []byte) error {
+	if p.conn == nil {
+		if err := p.dial(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\nPING\r\n", p.subject, len(data), data); err != nil {
+		return fmt.Errorf("error sending %w", err)
+	}
+	return p.pong()
+}
+
+func (p *publisher) dial() error {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("error connecting %w", err)
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	// the server opens with INFO
+	line, err := p.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		p.close()
+		return fmt.Errorf("not a nats server: %q", strings.TrimSpace(line))
+	}
+	opts, err := json.Marshal(p.connect)
+	if err != nil {
+		p.close()
+		return fmt.Errorf("error encoding connect %w", err)
+	}
+	if _, err := fmt.Fprintf(p.conn, "CONNECT %s\r\nPING\r\n", opts); err != nil {
+		p.close()
+		return fmt.Errorf("error sending connect %w", err)
+	}
+	if err := p.pong(); err != nil {
+		p.close()
+		return err
+	}
+	return nil
+}
+
+// read until the PONG, answering the server's own pings on the way
+func (p *publisher) pong() error {
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("error reading from server %w", err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			fmt.Fprint(p.conn, "PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server replied %s", line)
+		}
+	}
+}
+
+func (p *publisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
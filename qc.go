@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// bin width of the read length histogram used for N50
+const qcBinWidth = 50
+
+// per base error probability for each phred+33 quality character
+var qualErr [256]float64
+
+func init() {
+	for i := range qualErr {
+		q := max(i-33, 0)
+		qualErr[i] = math.Pow(10, -float64(q)/10)
+	}
+}
+
+// qcStats accumulates read statistics for a set of reads
+type qcStats struct {
+	reads  int64
+	bases  int64
+	errSum float64 // sum of per read mean error probabilities
+
+	// read length histogram, reads and bases per bin
+	hist     []int64
+	histBase []int64
+}
+
+func (s *qcStats) add(length int, meanErr float64) {
+	s.reads++
+	s.bases += int64(length)
+	s.errSum += meanErr
+	bin := length / qcBinWidth
+	if bin >= len(s.hist) {
+		grow := bin - len(s.hist) + 1
+		s.hist = append(s.hist, make([]int64, grow)...)
+		s.histBase = append(s.histBase, make([]int64, grow)...)
+	}
+	s.hist[bin]++
+	s.histBase[bin] += int64(length)
+}
+
+func (s *qcStats) merge(o *qcStats) {
+	s.reads += o.reads
+	s.bases += o.bases
+	s.errSum += o.errSum
+	if len(o.hist) > len(s.hist) {
+		grow := len(o.hist) - len(s.hist)
+		s.hist = append(s.hist, make([]int64, grow)...)
+		s.histBase = append(s.histBase, make([]int64, grow)...)
+	}
+	for i := range o.hist {
+		s.hist[i] += o.hist[i]
+		s.histBase[i] += o.histBase[i]
+	}
+}
+
+// Read statistics as written to the qc report
+type qcSummary struct {
+	Reads      int64   `json:"reads"`
+	Bases      int64   `json:"bases"`
+	MeanLength float64 `json:"mean_length"`
+	N50        int     `json:"n50"`
+	MeanQ      float64 `json:"mean_qscore"`
+}
+
+func (s *qcStats) summary() qcSummary {
+	sum := qcSummary{Reads: s.reads, Bases: s.bases}
+	if s.reads == 0 {
+		return sum
+	}
+	sum.MeanLength = float64(s.bases) / float64(s.reads)
+	sum.MeanQ = -10 * math.Log10(s.errSum/float64(s.reads))
+
+	// walk down from the longest reads until half the bases are covered, the
+	// N50 is approximated by the mean length in that bin
+	var covered int64
+	for bin := len(s.hist) - 1; bin >= 0; bin-- {
+		covered += s.histBase[bin]
+		if covered*2 >= s.bases {
+			sum.N50 = int(s.histBase[bin] / s.hist[bin])
+			break
+		}
+	}
+	return sum
+}
+
+// qcWriter parses the fastq stream written through it
+type qcWriter struct {
+	partial []byte
+	line    int
+	seqLen  int
+
+	// adaptive sampling accounting, reads shorter than rejectLen count as rejected
+	rejectLen int
+
+	all      qcStats
+	onTarget qcStats
+	rejected qcStats
+
+	// -live-qc, nil if off
+	live *liveQC
+
+	// reset by the caller between batches
+	batchReads int64
+	batchBases int64
+}
+
+func newQCWriter(rejectLen int) *qcWriter {
+	return &qcWriter{rejectLen: rejectLen}
+}
+
+func (q *qcWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			q.partial = append(q.partial, p...)
+			break
+		}
+		line := p[:i]
+		if len(q.partial) > 0 {
+			q.partial = append(q.partial, line...)
+			line = q.partial
+		}
+		q.handle(bytes.TrimSuffix(line, []byte{'\r'}))
+		q.partial = q.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// handle one line of a four line fastq record
+func (q *qcWriter) handle(line []byte) {
+	switch q.line {
+	case 1:
+		q.seqLen = len(line)
+	case 3:
+		var errSum float64
+		for _, c := range line {
+			errSum += qualErr[c]
+		}
+		meanErr := 1.0
+		if len(line) > 0 {
+			meanErr = errSum / float64(len(line))
+		}
+		q.all.add(q.seqLen, meanErr)
+		if q.seqLen < q.rejectLen {
+			q.rejected.add(q.seqLen, meanErr)
+		} else {
+			q.onTarget.add(q.seqLen, meanErr)
+		}
+		q.batchReads++
+		q.batchBases += int64(q.seqLen)
+		if q.live != nil {
+			q.live.add(q.seqLen, meanErr)
+		}
+	}
+	q.line = (q.line + 1) % 4
+}
+
+// Add the reads seen by another writer, e.g. another device's pipeline
+func (q *qcWriter) merge(o *qcWriter) {
+	q.all.merge(&o.all)
+	q.onTarget.merge(&o.onTarget)
+	q.rejected.merge(&o.rejected)
+}
+
+// share of short reads above which a run is treated as adaptive sampling
+const adaptiveShare = 0.4
+
+// qcReport is written to <out>.qc.json at the end of a run
+type qcReport struct {
+	Labels           labels     `json:"labels,omitempty"`
+	All              qcSummary  `json:"all"`
+	AdaptiveSampling bool       `json:"adaptive_sampling"`
+	RejectLength     int        `json:"reject_length,omitempty"`
+	OnTarget         *qcSummary `json:"on_target,omitempty"`
+	Rejected         *qcSummary `json:"rejected,omitempty"`
+	HostReadsRemoved int64      `json:"host_reads_removed,omitempty"`
+	DuplicateReads   int64      `json:"duplicate_reads,omitempty"`
+}
+
+// Build the report. mode is auto, on or off; in auto the run is detected as
+// adaptive sampling from the share of reads rejected early.
+func (q *qcWriter) report(mode string) qcReport {
+	r := qcReport{All: q.all.summary()}
+	switch mode {
+	case "on":
+		r.AdaptiveSampling = true
+	case "auto":
+		r.AdaptiveSampling = q.all.reads > 0 && float64(q.rejected.reads)/float64(q.all.reads) >= adaptiveShare
+	}
+	if r.AdaptiveSampling {
+		onTarget, rejected := q.onTarget.summary(), q.rejected.summary()
+		r.RejectLength = q.rejectLen
+		r.OnTarget, r.Rejected = &onTarget, &rejected
+	}
+	return r
+}
+
+func qcPath(out string) string {
+	return runFile(out, "qc.json")
+}
+
+func writeQCReport(path string, r qcReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding qc report %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing qc report %w", err)
+	}
+	perms.set(path)
+	return nil
+}
+
+func printQCReport(r qcReport) {
+	fmt.Println("=============================================")
+	printQCSummary("all reads", r.All)
+	if r.AdaptiveSampling {
+		fmt.Printf("adaptive sampling run, reads under %s bases counted as rejected\n", thousands(int64(r.RejectLength)))
+		printQCSummary("on target", *r.OnTarget)
+		printQCSummary("rejected", *r.Rejected)
+	}
+	fmt.Println("=============================================")
+}
+
+func printQCSummary(name string, s qcSummary) {
+	fmt.Printf("%-10s reads %s, bases %s, mean length %s, N50 %s, mean qscore %.1f\n",
+		name, thousands(s.Reads), baseCount(s.Bases), thousands(int64(s.MeanLength)), thousands(int64(s.N50)), s.MeanQ)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Files of the batches skipped with -continue-on-error, each with why its
+// batch failed and the end of dorado's stderr that showed it, written to
+// <out>.dbatch/quarantine.json as they are skipped. Files dorado named in its
+// stderr are marked, the likely culprits of a batch, so they can be recovered
+// with dbatch redo or discarded.
+type quarantine struct {
+	Out   string            `json:"out"`
+	Files []quarantinedFile `json:"files"`
+}
+
+type quarantinedFile struct {
+	File     string `json:"file"`
+	Batch    int    `json:"batch"`
+	Reason   string `json:"reason"` // corrupt, oom, gpu, timeout or error
+	Named    bool   `json:"named_by_dorado,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+	Stderr   string `json:"stderr,omitempty"`
+	Time     string `json:"time"`
+}
+
+// lines of stderr kept with each file
+const quarantineStderrLines = 20
+
+// the first that matches the failure decides the reason
+var quarantineReasons = []struct {
+	reason  string
+	pattern *regexp.Regexp
+}{
+	{"oom", regexp.MustCompile(`(?i)out of memory|bad_alloc|oom|signal: killed`)},
+	{"gpu", deviceErrorPattern},
+	{"corrupt", regexp.MustCompile(`(?i)corrupt|invalid (file|signal|pod5|footer)|failed to (open|read)|unable to (open|read)|not a pod5|truncated|bad magic|arrow|flatbuffer`)},
+	{"timeout", regexp.MustCompile(`(?i)timed? ?out|deadline exceeded`)},
+}
+
+func quarantinePath(out string) string {
+	return runFile(out, "quarantine.json")
+}
+
+// why a batch failed, from its error and dorado's stderr
+func failureReason(err error, stderr string) string {
+	for _, r := range quarantineReasons {
+		if r.pattern.MatchString(err.Error()) || r.pattern.MatchString(stderr) {
+			return r.reason
+		}
+	}
+	return "error"
+}
+
+// whether stderr names the file, as a whole name not the end of another one
+func namedIn(stderr, name string) bool {
+	return regexp.MustCompile(`(^|[/\\\s'"])` + regexp.QuoteMeta(name)).MatchString(stderr)
+}
+
+// the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return strings.Join(lines[max(0, len(lines)-n):], "\n")
+}
+
+// Quarantine the files of a skipped batch and rewrite the report
+func (b *batch) quarantineBatch(rec *batchRecord, err error) string {
+	if b.quarantine == nil {
+		b.quarantine = &quarantine{Out: b.out}
+	}
+	reason := failureReason(err, b.lastStderr)
+	excerpt := lastLines(b.lastStderr, quarantineStderrLines)
+	now := timestamp(time.Now())
+	for _, file := range rec.Files {
+		b.quarantine.Files = append(b.quarantine.Files, quarantinedFile{
+			File: file, Batch: rec.Index, Reason: reason,
+			Named:    namedIn(b.lastStderr, filepath.Base(file)),
+			Attempts: b.retries + 1, Error: err.Error(), Stderr: excerpt, Time: now,
+		})
+	}
+	if err := b.quarantine.write(quarantinePath(b.out)); err != nil {
+		fmt.Println(err)
+	}
+	return reason
+}
+
+func (q *quarantine) write(path string) error {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding quarantine report %w", err)
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("error writing quarantine report %w", err)
+	}
+	perms.set(path + ".tmp")
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("error writing quarantine report %w", err)
+	}
+	return nil
+}
+
+// Print how many files were quarantined, at the end of the run
+func (b *batch) printQuarantine() {
+	if b.quarantine == nil {
+		return
+	}
+	reasons := map[string]int{}
+	for _, f := range b.quarantine.Files {
+		reasons[f.Reason]++
+	}
+	var parts []string
+	for _, r := range quarantineReasons {
+		if n := reasons[r.reason]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, r.reason))
+		}
+	}
+	if n := reasons["error"]; n > 0 {
+		parts = append(parts, fmt.Sprintf("%d other", n))
+	}
+	fmt.Printf("%d files quarantined (%s), listed in %s\n", len(b.quarantine.Files), strings.Join(parts, ", "), quarantinePath(b.out))
+}
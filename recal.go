@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A qscore recalibration applied to quality strings on their way to the
+// output, either a fixed offset or a table of observed -> corrected scores.
+// Recorded in the state db and manifest so outputs say how they were scored.
+type qscoreRecal struct {
+	Offset int    `json:"offset,omitempty"`
+	Table  string `json:"table,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // of the table
+
+	phred [256]byte // quality character -> recalibrated character
+}
+
+// highest phred score a fastq quality character can carry
+const maxPhred = 93
+
+// Parse -qscore-recal, an offset such as +2 or -1, or the path of a table with
+// one "observed corrected" pair of phred scores per line. Scores missing from
+// the table are left as they are.
+func parseQscoreRecal(spec string) (*qscoreRecal, error) {
+	r := new(qscoreRecal)
+	for i := range r.phred {
+		r.phred[i] = byte(i)
+	}
+
+	if n, err := strconv.Atoi(spec); err == nil {
+		r.Offset = n
+		for q := 0; q <= maxPhred; q++ {
+			r.phred[q+33] = byte(min(max(q+n, 0), maxPhred) + 33)
+		}
+		return r, nil
+	}
+
+	data, err := os.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error reading qscore recalibration table %w", err)
+	}
+	sum := sha256.Sum256(data)
+	r.Table, r.SHA256 = spec, hex.EncodeToString(sum[:])
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected observed and corrected qscore", spec, i+1)
+		}
+		from, err1 := strconv.Atoi(fields[0])
+		to, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil || from < 0 || from > maxPhred || to < 0 || to > maxPhred {
+			return nil, fmt.Errorf("%s:%d: qscores must be between 0 and %d", spec, i+1, maxPhred)
+		}
+		r.phred[from+33] = byte(to + 33)
+	}
+	return r, nil
+}
+
+func (r *qscoreRecal) String() string {
+	if r.Table != "" {
+		return "table " + r.Table
+	}
+	return fmt.Sprintf("offset %+d", r.Offset)
+}
+
+// recalWriter rewrites the quality line of every 4 line fastq record written
+// to it, one batch's worth
+type recalWriter struct {
+	r    *qscoreRecal
+	w    io.Writer
+	line int // line of the current record, quality is 3
+	buf  []byte
+}
+
+func (r *qscoreRecal) writer(w io.Writer) *recalWriter {
+	return &recalWriter{r: r, w: w}
+}
+
+func (rw *recalWriter) Write(p []byte) (int, error) {
+	rw.buf = append(rw.buf[:0], p...)
+	for i, c := range rw.buf {
+		if c == '\n' {
+			rw.line = (rw.line + 1) % 4
+		} else if rw.line == 3 {
+			rw.buf[i] = rw.r.phred[c]
+		}
+	}
+	if _, err := rw.w.Write(rw.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
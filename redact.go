@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// -redact keeps file paths and sample names out of what leaves the host:
+// metrics labels, -publish events, -alert-webhook alerts and traces. They are
+// replaced by a salted hash, the same for the same name, so events of one file
+// or sample can still be told apart and matched against the run's own state
+// db, manifest and audit log, which keep the real names.
+type redaction struct {
+	paths  bool
+	labels bool // label values, which usually name the sample
+	salt   string
+}
+
+func parseRedaction(spec, salt string) (redaction, error) {
+	r := redaction{salt: salt}
+	for _, what := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(what) {
+		case "":
+		case "paths":
+			r.paths = true
+		case "labels":
+			r.labels = true
+		case "all":
+			r.paths, r.labels = true, true
+		default:
+			return r, fmt.Errorf("unknown -redact %q, use paths, labels or all", what)
+		}
+	}
+	if (r.paths || r.labels) && salt == "" {
+		fmt.Println("warning: -redact without -redact-salt, hashes of names that can be guessed can be reversed")
+	}
+	return r, nil
+}
+
+func (r redaction) hash(v string) string {
+	h := sha256.Sum256([]byte(r.salt + v))
+	return "redacted:" + hex.EncodeToString(h[:8])
+}
+
+func (r redaction) path(p string) string {
+	if !r.paths || p == "" {
+		return p
+	}
+	return r.hash(p)
+}
+
+func (r redaction) labelSet(l labels) labels {
+	if !r.labels || len(l) == 0 {
+		return l
+	}
+	redacted := labels{}
+	for k, v := range l {
+		redacted[k] = r.hash(v)
+	}
+	return redacted
+}
+
+// Replace what looks like a path in free text such as errors and command
+// lines, every word holding a path separator
+func (b *batch) redactText(s string) string {
+	if !b.redact.paths || s == "" {
+		return s
+	}
+	words := strings.Fields(s)
+	for i, w := range words {
+		// punctuation of the message stays
+		core := strings.Trim(w, `"'(),:;`)
+		if strings.ContainsAny(core, `/\`) {
+			words[i] = strings.Replace(w, core, b.redact.hash(core), 1)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// A manifest entry as it may be sent out
+func (b *batch) redactEntry(e manifestEntry) manifestEntry {
+	if !b.redact.paths {
+		return e
+	}
+	e.Output = b.redact.path(e.Output)
+	files := make([]string, len(e.Files))
+	for i, f := range e.Files {
+		files[i] = b.redact.path(f)
+	}
+	e.Files = files
+	commands := make([]string, len(e.Commands))
+	for i, c := range e.Commands {
+		commands[i] = b.redactText(c)
+	}
+	e.Commands = commands
+	return e
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// dbatch redo re-stages a single chunk from the state db and basecalls it again,
+// optionally with different settings, into a supplementary output
+func redoMain(args []string) {
+	fs := flag.NewFlagSet("redo", flag.ExitOnError)
+	var o redoOptions
+	fs.StringVar(&o.out, "out", "", "Output file path of the original run")
+	fs.IntVar(&o.index, "batch", 0, "batch number to redo")
+	fs.StringVar(&o.model, "model", "", "dorado model, default is the model of the original run")
+	fs.StringVar(&o.dpath, "dorado", "", "Path to dorado, default is the dorado of the original run")
+	fs.StringVar(&o.sup, "o", "", "supplementary output path, default derived from -out")
+	fs.StringVar(&o.recal, "qscore-recal", "", "recalibrate quality strings of the redo, by an offset such as +2 or a table file")
+	fs.BoolVar(&o.mp, "monitor-pressure", false, "monitor pipe pressure between dorado and zstd, output to file")
+	fs.Parse(args)
+
+	if o.out == "" || o.index == 0 {
+		fs.PrintDefaults()
+		return
+	}
+	// exiting here, after redo has removed its working directory
+	if err := redo(o); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type redoOptions struct {
+	out   string
+	index int
+	model string
+	dpath string
+	sup   string
+	recal string
+	mp    bool
+}
+
+func redo(o redoOptions) error {
+	if err := migrateRunDir(o.out); err != nil {
+		return err
+	}
+	state, err := loadRunState(statePath(o.out))
+	if err != nil {
+		return err
+	}
+	rec, ok := state.findBatch(o.index)
+	if !ok {
+		return fmt.Errorf("batch %d not found in %s, run has %d batches", o.index, state.path, len(state.Batches))
+	}
+
+	b := new(batch)
+	b.dpath = state.Dorado
+	if o.dpath != "" {
+		b.dpath = o.dpath
+	} else if state.Dorado == simulatedDorado {
+		b.useSimulator(0, 8000, 6000)
+	}
+	b.model = state.Model
+	if o.model != "" {
+		b.model = o.model
+	}
+	b.in = state.In
+	b.format = state.Format
+	// the children run in the environment of the original run
+	b.env = state.Env
+	childEnv = b.env
+	b.out = o.sup
+	if b.out == "" {
+		b.out = labeledPath(o.out, "redo-batch"+strconv.Itoa(rec.Index)+"."+b.model)
+		if b.format == formatBAM {
+			// the output of a bam run is a directory of batches
+			b.out += ".bam"
+		}
+	}
+	b.mp = o.mp
+	if o.recal != "" {
+		if b.format == formatBAM {
+			return fmt.Errorf("-qscore-recal can't be used on a bam run")
+		}
+		if b.recal, err = parseQscoreRecal(o.recal); err != nil {
+			return err
+		}
+	}
+	b.monitorFormat = "csv"
+	b.auditPath = auditPath(o.out)
+
+	if b.out == o.out {
+		return fmt.Errorf("refusing to write redo output into the original output %s", o.out)
+	}
+
+	var files []pod5
+	for _, path := range rec.Files {
+		files = append(files, pod5{path: path, name: filepath.Base(path)})
+	}
+
+	// the working directory is in the run directory of the original run,
+	// pressure stats go to that of the redo output
+	b.tmp = runFile(o.out, fmt.Sprintf("tmp-redo%d", rec.Index))
+	if err := os.Mkdir(b.tmp, 0750); err != nil {
+		return fmt.Errorf("error making %s %w", b.tmp, err)
+	}
+	defer os.RemoveAll(b.tmp)
+	if b.mp {
+		if err := makeRunDir(b.out); err != nil {
+			return err
+		}
+	}
+
+	w, err := newWorkDir(b.tmp, rec.Index)
+	if err != nil {
+		return err
+	}
+	b.work = w
+	// a redo has no plan to report progress on
+	payload := b.hookPayload(rec.Index, files, "")
+	payload.In, payload.Stats = state.In, hookStats{}
+	if err := stage(w, files, state.Hooks, nil, payload); err != nil {
+		return err
+	}
+
+	if err := b.openAudit(); err != nil {
+		return err
+	}
+	b.audit.record(o.out, "redo_started", map[string]any{"batch": rec.Index, "model": b.model, "supplementary": b.out})
+
+	fmt.Println("=============================================")
+	fmt.Printf("redoing batch %d (%d files) with %s into %s\n", rec.Index, len(files), b.model, b.out)
+	fmt.Println("=============================================")
+
+	if err := b.call(); err != nil {
+		b.audit.record(o.out, "redo_failed", map[string]any{"batch": rec.Index, "error": err.Error()})
+		return fmt.Errorf("error basecalling: %w", err)
+	}
+	b.audit.record(o.out, "redo_done", map[string]any{"batch": rec.Index, "supplementary": b.out})
+
+	state.Redos = append(state.Redos, redoRecord{Batch: rec.Index, Model: b.model, Out: b.out, Recal: b.recal})
+	if err := state.save(); err != nil {
+		fmt.Println(err)
+	}
+	return nil
+}
+
+// Insert a label before the extensions of path, run.fastq.zst -> run.label.fastq.zst
+func labeledPath(path, label string) string {
+	dir, base := filepath.Split(path)
+	if i := strings.Index(base, "."); i > 0 {
+		return dir + base[:i] + "." + label + base[i:]
+	}
+	return path + "." + label
+}
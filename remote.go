@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+)
+
+// talks to a dbatch daemon over its http api
+type remoteClient struct {
+	server string
+	token  string
+}
+
+// dbatch remote is the client for a shared basecalling node running dbatch
+// daemon: it submits runs, lists the queue and fetches reports
+func remoteMain(args []string) {
+	fs := flag.NewFlagSet("remote", flag.ExitOnError)
+	server := fs.String("server", os.Getenv("DBATCH_SERVER"), "daemon to talk to, e.g. http://gpu1:8080, default $DBATCH_SERVER")
+	token := fs.String("token", os.Getenv("DBATCH_TOKEN"), "bearer token of the daemon, default $DBATCH_TOKEN")
+	localTimes := fs.Bool("local-time", false, "print times in the local zone")
+	fs.Parse(args)
+	setLocalTime(*localTimes)
+
+	if *server == "" || fs.NArg() == 0 {
+		fmt.Println("usage: dbatch remote -server http://host:8080 submit|list|status|report|cancel ...")
+		fs.PrintDefaults()
+		return
+	}
+	c := &remoteClient{server: strings.TrimSuffix(*server, "/"), token: *token}
+
+	var err error
+	switch cmd, rest := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "submit":
+		err = c.submit(rest)
+	case "list":
+		err = c.list()
+	case "status":
+		err = c.status(rest)
+	case "report":
+		err = c.report(rest)
+	case "cancel":
+		err = c.cancel(rest)
+	default:
+		err = fmt.Errorf("unknown remote command %s", cmd)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *remoteClient) submit(args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	in := fs.String("in", "", "input directory, as seen by the daemon")
+	out := fs.String("out", "", "output file, as seen by the daemon")
+	profile := fs.String("profile", "", "profile of the daemon to basecall with")
+	priority := fs.Bool("priority", false, "preempt the running job at its next batch boundary")
+	weight := fs.Int("weight", 0, "batches per turn when the daemon runs with -schedule fair")
+	runLabels := labels{}
+	fs.Var(runLabels, "label", "key=value label for the run, can be repeated")
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fs.PrintDefaults()
+		return fmt.Errorf("submit needs -in and -out")
+	}
+	req := jobRequest{In: *in, Out: *out, Profile: *profile, Priority: *priority, Weight: *weight, Labels: runLabels}
+	if u, err := user.Current(); err == nil {
+		req.User = u.Username
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("error encoding run %w", err)
+	}
+	var j job
+	if err := c.do("POST", "/runs", body, &j); err != nil {
+		return err
+	}
+	fmt.Printf("submitted %s, %s\n", j.ID, j.Status)
+	return nil
+}
+
+func (c *remoteClient) list() error {
+	var jobs []job
+	if err := c.do("GET", "/runs", nil, &jobs); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		fmt.Printf("%-8s %-10s %-10s %s %s -> %s\n", j.ID, j.Status, j.User, displayTime(j.Submitted), j.In, j.Out)
+	}
+	return nil
+}
+
+func (c *remoteClient) status(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dbatch remote status run-1")
+	}
+	var j job
+	if err := c.do("GET", "/runs/"+args[0], nil, &j); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s: %s -> %s\n", j.ID, j.Status, j.In, j.Out)
+	if j.Live != nil {
+		fmt.Printf("live qc: mean qscore %.1f, mean length %s over the last %s sampled reads\n", j.Live.MeanQ, thousands(int64(j.Live.MeanLength)), thousands(int64(j.Live.Sampled)))
+	}
+	if j.Error != "" {
+		fmt.Printf("error: %s\n", j.Error)
+	}
+	return nil
+}
+
+func (c *remoteClient) report(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dbatch remote report run-1")
+	}
+	var r runReport
+	if err := c.do("GET", "/runs/"+args[0]+"/report", nil, &r); err != nil {
+		return err
+	}
+	fmt.Println("=============================================")
+	fmt.Printf("%s %s: %s -> %s\n", r.Run.ID, r.Run.Status, r.Run.In, r.Run.Out)
+	fmt.Printf("%d of %d batches done\n", r.Done, r.Batches)
+	if len(r.Failed) > 0 {
+		fmt.Printf("failed batches: %v\n", r.Failed)
+	}
+	if r.QC != nil {
+		all := r.QC.All
+		fmt.Printf("reads %s, bases %s, mean length %s, n50 %s, mean qscore %.1f\n", thousands(all.Reads), baseCount(all.Bases), thousands(int64(all.MeanLength)), thousands(int64(all.N50)), all.MeanQ)
+	}
+	for _, n := range r.Notes {
+		fmt.Printf("note %s (after batch %d): %s\n", displayStamp(n.Time), n.AfterBatch, n.Text)
+	}
+	fmt.Println("=============================================")
+	return nil
+}
+
+// send a request and decode the json reply into v
+func (c *remoteClient) do(method, path string, body []byte, v any) error {
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error making request %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error contacting daemon %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("daemon replied %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error reading daemon reply %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// Re-scan the input and adjust the part of the plan not yet basecalled: files
+// that disappeared are dropped and new files are queued after the rest. A scan
+// that fails, such as a listing that can't be fetched, keeps the plan as it is.
+func (b *batch) replan() {
+	if err := b.rescanInputs(); err != nil {
+		fmt.Printf("rescan: %s, keeping the plan\n", err)
+	}
+}
+
+func (b *batch) rescanInputs() error {
+	// the skip list may have grown since
+	if b.skipListPath != "" {
+		if skips, err := loadSkipList(b.skipListPath); err != nil {
+			fmt.Printf("rescan: %s, keeping the skip list read before\n", err)
+		} else {
+			b.skips = skips
+		}
+	}
+	found, err := b.discoverInputs(false, indexPath(b.out)+".scan")
+	if err != nil {
+		return err
+	}
+	defer found.close()
+
+	present := make(map[uint64]bool, found.len())
+	found.each(0, found.len(), func(_ int, f pod5) error {
+		present[pathKey(f.path)] = true
+		return nil
+	})
+	known := make(map[uint64]bool, b.pod5s.len())
+	b.pod5s.each(0, b.pod5s.len(), func(_ int, f pod5) error {
+		known[pathKey(f.path)] = true
+		return nil
+	})
+
+	var removed, added []string
+	gone := map[uint64]bool{}
+	b.pod5s.each(b.next, b.pod5s.len(), func(_ int, f pod5) error {
+		if key := pathKey(f.path); !present[key] {
+			removed = append(removed, f.path)
+			gone[key] = true
+		}
+		return nil
+	})
+	found.each(0, found.len(), func(_ int, f pod5) error {
+		if !known[pathKey(f.path)] {
+			added = append(added, f.path)
+		}
+		return nil
+	})
+	if len(added) == 0 && len(removed) == 0 {
+		return b.skipBatches()
+	}
+
+	// only the files not yet basecalled can be gone
+	plan := b.pod5s.derive()
+	err = b.pod5s.each(0, b.pod5s.len(), func(i int, f pod5) error {
+		if i >= b.next && gone[pathKey(f.path)] {
+			return nil
+		}
+		return plan.add(f)
+	})
+	if err == nil {
+		err = found.each(0, found.len(), func(_ int, f pod5) error {
+			if known[pathKey(f.path)] {
+				return nil
+			}
+			return plan.add(f)
+		})
+	}
+	if err != nil {
+		plan.close()
+		return err
+	}
+	if err := b.pod5s.replace(plan); err != nil {
+		return err
+	}
+	b.replanChunks()
+	fmt.Printf("rescan: %d new files, %d removed, %d left to basecall\n", len(added), len(removed), b.pod5s.len()-b.next)
+	for _, path := range removed {
+		fmt.Printf("  removed %s\n", path)
+	}
+	for _, path := range added {
+		fmt.Printf("  added %s\n", path)
+	}
+	b.audit.record(b.out, "plan_changed", map[string]any{"added": added, "removed": removed, "remaining": b.pod5s.len() - b.next})
+	return nil
+}
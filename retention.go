@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How much of the per-batch logs and telemetry a long running deployment
+// keeps around. Zero keeps everything.
+type retention struct {
+	keepLogs     int   // newest batch logs and rotated stats files kept
+	statsMaxSize int64 // bytes before chan_stats is rotated
+}
+
+// set once the run flags are parsed, like childEnv
+var retain retention
+
+// where -batch-logs keeps dorado's stderr of each batch
+func batchLogDir(out string) string {
+	return runFile(out, "logs")
+}
+
+// Open the log of the batch being basecalled, retries append to it
+func (b *batch) openBatchLog() (*os.File, error) {
+	dir := batchLogDir(b.out)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error making batch log directory %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("batch_%05d.log", b.current)), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening batch log %w", err)
+	}
+	perms.set(f.Name())
+	return f, nil
+}
+
+// Remove all but the newest keep files matching pattern
+func prune(pattern string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	paths, _ := filepath.Glob(pattern)
+	if len(paths) <= keep {
+		return
+	}
+	type aged struct {
+		path string
+		mod  time.Time
+	}
+	files := make([]aged, 0, len(paths))
+	for _, p := range paths {
+		if info, err := os.Stat(p); err == nil {
+			files = append(files, aged{p, info.ModTime()})
+		}
+	}
+	slices.SortFunc(files, func(a, b aged) int { return b.mod.Compare(a.mod) })
+	for _, f := range files[min(keep, len(files)):] {
+		if err := os.Remove(f.path); err != nil {
+			fmt.Printf("error removing old log %s\n", err)
+		}
+	}
+}
+
+// Rotate a stats file that grew past the limit into a timestamped gzip
+// next to it, chan_stats.csv -> chan_stats-20240102T150405.000.csv.gz, keeping the
+// newest keep rotations
+func rotateStats(path string, r retention) {
+	if r.statsMaxSize <= 0 {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < r.statsMaxSize {
+		return
+	}
+	dir, name := filepath.Split(path)
+	base, ext, _ := strings.Cut(name, ".")
+	base = dir + base
+	rotated := base + "-" + time.Now().UTC().Format("20060102T150405.000Z") + "." + strings.TrimSuffix(ext, ".gz") + ".gz"
+	if strings.HasSuffix(path, ".gz") {
+		err = os.Rename(path, rotated)
+	} else {
+		err = gzipFile(path, rotated)
+	}
+	if err != nil {
+		fmt.Printf("error rotating %s: %s\n", path, err)
+		return
+	}
+	prune(base+"-*.gz", r.keepLogs)
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	perms.set(dst)
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// exit status of a run that completed with batches missing
+const exitPartial = 3
+
+var errPartial = errors.New("partial delivery")
+
+// Basecall the staged batch and spot check its output. Failed attempts are
+// retried up to b.retries times after cutting whatever they appended off the
+// output, so a retried batch never leaves a partial frame behind.
+func (b *batch) attempt(rec *batchRecord) error {
+	var snap *qcWriter
+	if b.qc != nil {
+		snap = b.qc.snapshot()
+	}
+	var removed int64
+	if b.decontam != nil {
+		removed = b.decontam.removed
+	}
+
+	for try := 0; ; try++ {
+		err := b.call()
+		if err == nil {
+			rec.Offset, rec.Length = b.lastOffset, b.lastLength
+			verify := time.Now()
+			err = b.checkOutput(rec)
+			staging := rec.Timings.Staging
+			*rec.Timings = b.lastTimes
+			rec.Timings.Staging = staging
+			rec.Timings.Verify = time.Since(verify).Seconds()
+		}
+		if err == nil {
+			b.cpu.failures = 0
+			if b.dupWriter != nil {
+				if n := b.dupWriter.commit(rec.Index); n > 0 {
+					fmt.Printf("batch %d: %d read IDs already written by earlier batches\n", rec.Index, n)
+				}
+			}
+			if b.provWriter != nil {
+				if err := b.provWriter.commit(rec.Index, rec.Files); err != nil {
+					fmt.Println(err)
+				}
+			}
+			return nil
+		}
+		if b.dupWriter != nil {
+			b.dupWriter.drop()
+		}
+		if b.provWriter != nil {
+			b.provWriter.drop()
+		}
+
+		if terr := os.Truncate(b.lastPath, b.lastOffset); terr != nil && !os.IsNotExist(terr) {
+			return fmt.Errorf("%w, and could not remove the partial output: %w", err, terr)
+		}
+		rec.Offset, rec.Length = 0, 0
+		if snap != nil {
+			b.qc.restore(snap)
+		}
+		if b.decontam != nil {
+			b.decontam.removed = removed
+		}
+
+		if b.gpuAttemptFailed(rec.Index, err) {
+			// not counted against -retries
+			try--
+			continue
+		}
+		if try == b.retries {
+			return err
+		}
+		fmt.Printf("batch %d attempt %d failed, retrying: %s\n", rec.Index, try+1, err)
+		metrics.add("dbatch_batch_retries_total", 1)
+		b.audit.record(b.out, "batch_retried", map[string]any{"batch": rec.Index, "attempt": try + 1, "error": err.Error()})
+	}
+}
+
+// verify what a batch wrote, if asked to
+func (b *batch) checkOutput(rec *batchRecord) error {
+	// per-batch files are checked by the pool once compressed, and with
+	// -verify-workers the check runs in the background
+	if b.spotCheck <= 0 || b.pool != nil || b.verifier != nil {
+		return nil
+	}
+	res, err := spotCheck(b.out, rec.Offset, rec.Length, b.spotCheck, b.basecalledReads())
+	if err != nil {
+		return err
+	}
+	rec.SHA256 = res.sha256
+	metrics.add("dbatch_spot_check_records_total", float64(res.sampled))
+	return nil
+}
+
+// reads the qc counted for the current batch, -1 without qc
+func (b *batch) basecalledReads() int64 {
+	if b.qc == nil {
+		return -1
+	}
+	return b.qc.batchReads
+}
+
+// Copy the accumulated statistics so a failed attempt can be rolled back
+func (q *qcWriter) snapshot() *qcWriter {
+	s := *q
+	s.partial = nil
+	for _, st := range []*qcStats{&s.all, &s.onTarget, &s.rejected} {
+		st.hist = slices.Clone(st.hist)
+		st.histBase = slices.Clone(st.histBase)
+	}
+	return &s
+}
+
+func (q *qcWriter) restore(s *qcWriter) {
+	*q = *s.snapshot()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Everything a run keeps besides its output lives in one directory next to
+// it, run.fastq.zst -> run.fastq.zst.dbatch/: the state db, audit log,
+// manifest, qc report, duplicate list, batch logs, pipe pressure stats and
+// the working directories under tmp. Discovery never descends into one.
+const runDirSuffix = ".dbatch"
+
+func runDir(out string) string {
+	return out + runDirSuffix
+}
+
+func runFile(out, name string) string {
+	return filepath.Join(runDir(out), name)
+}
+
+// files that older runs wrote next to the output, and where they live now
+var legacyRunFiles = []struct{ suffix, name string }{
+	{".state.json", "state.json"},
+	{".audit.log", "audit.log"},
+	{".manifest.json", "manifest.json"},
+	{".qc.json", "qc.json"},
+	{".duplicates.tsv", "duplicates.tsv"},
+	{".logs", "logs"},
+}
+
+// Make the run directory of out, moving in the files an older dbatch left
+// next to the output
+func makeRunDir(out string) error {
+	if err := os.MkdirAll(runDir(out), 0755); err != nil {
+		return fmt.Errorf("error making run directory %w", err)
+	}
+	perms.setDir(runDir(out))
+	return migrateRunDir(out)
+}
+
+// Move the files of an older run into its run directory, if there are any
+func migrateRunDir(out string) error {
+	for _, f := range legacyRunFiles {
+		old, moved := out+f.suffix, runFile(out, f.name)
+		if _, err := os.Lstat(old); err != nil {
+			continue
+		}
+		if _, err := os.Lstat(moved); err == nil {
+			fmt.Printf("warning: both %s and %s exist, using %s\n", old, moved, moved)
+			continue
+		}
+		if err := os.MkdirAll(runDir(out), 0755); err != nil {
+			return fmt.Errorf("error making run directory %w", err)
+		}
+		if err := os.Rename(old, moved); err != nil {
+			return fmt.Errorf("error moving %s into the run directory %w", old, err)
+		}
+		// lock files are recreated on the next update
+		os.Remove(old + ".lock")
+		fmt.Printf("moved %s to %s\n", old, moved)
+	}
+	return nil
+}
+
+// whether a directory found while discovering is the run directory of some output
+func isRunDir(name string) bool {
+	return strings.HasSuffix(name, runDirSuffix) && name != runDirSuffix
+}
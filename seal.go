@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Cooperating instances sharing one output, e.g. on two GPU nodes, never
+// append to the same file. With -journal every shard writes each of its
+// batches to a numbered part file of its own under <out>.dbatch/parts/ and
+// records it in the shared manifest, locked for the update. Once every shard
+// is done, dbatch seal joins the parts in batch order into the output,
+// checking each against the manifest, and marks the manifest sealed so no
+// writer adds to it afterwards.
+func sealMain(args []string) {
+	fs := flag.NewFlagSet("seal", flag.ExitOnError)
+	out := fs.String("out", "", "the shared output of a -journal run")
+	allowMissing := fs.Bool("allow-missing", false, "seal even though batches were skipped with -continue-on-error")
+	keepParts := fs.Bool("keep-parts", false, "keep the part files once they are joined")
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.PrintDefaults()
+		return
+	}
+	if err := seal(*out, *allowMissing, *keepParts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func seal(out string, allowMissing, keepParts bool) error {
+	path := manifestPath(out)
+	// writers take the same lock for every update
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case m.Sealed:
+		fmt.Printf("%s is already sealed\n", out)
+		return nil
+	case !m.Journal:
+		return fmt.Errorf("%s wasn't written with -journal, there is nothing to seal", out)
+	}
+
+	// every planned batch must be there, or skipped and allowed to be
+	done := map[int]bool{}
+	for _, e := range m.Batches {
+		done[e.Batch] = true
+	}
+	for _, e := range m.Missing {
+		if !allowMissing {
+			return fmt.Errorf("batch %d was skipped by %s, redo it or seal with -allow-missing", e.Batch, e.Output)
+		}
+		done[e.Batch] = true
+	}
+	for _, rec := range m.Skipped {
+		if rec.Batch > 0 {
+			done[rec.Batch] = true
+		}
+	}
+	var pending []string
+	for i := 1; i <= m.Planned; i++ {
+		if !done[i] {
+			pending = append(pending, fmt.Sprint(i))
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d of %d batches aren't done yet, %s, wait for every shard to finish", len(pending), m.Planned, strings.Join(pending, ", "))
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists, refusing to overwrite it", out)
+	}
+
+	fmt.Println("=============================================")
+	fmt.Printf("sealing %d batches of %d shards into %s\n", len(m.Batches), m.Shards, out)
+	fmt.Println("=============================================")
+
+	slices.SortFunc(m.Batches, func(a, b manifestEntry) int { return a.Batch - b.Batch })
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error creating %s %w", tmp, err)
+	}
+	perms.set(tmp)
+	defer os.Remove(tmp)
+	defer f.Close()
+	var parts []string
+	var offset int64
+	for i, e := range m.Batches {
+		if err := appendPart(f, e); err != nil {
+			return err
+		}
+		parts = append(parts, e.Output)
+		m.Batches[i].Output, m.Batches[i].Offset = "", offset
+		offset += e.Length
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error writing %s %w", out, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing %s %w", out, err)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return fmt.Errorf("error writing %s %w", out, err)
+	}
+
+	m.Output, m.Shards, m.Sealed = out, 0, true
+	if err := m.save(path); err != nil {
+		return err
+	}
+	if audit, err := openAudit(auditPath(out)); err == nil {
+		audit.record(out, "sealed", map[string]any{"batches": len(m.Batches), "missing": len(m.Missing), "length": offset})
+	}
+	fmt.Printf("sealed %s, %d batches, %s\n", out, len(m.Batches), bytesIEC(offset))
+
+	// the run directories of the shards with their state dbs stay
+	if !keepParts {
+		for _, part := range parts {
+			if err := os.Remove(part); err != nil {
+				fmt.Printf("error removing part %s\n", err)
+			}
+			os.Remove(filepath.Dir(part))
+		}
+	}
+	return nil
+}
+
+// Copy a part onto the end of the output, checking its length and, when the
+// manifest has one, its checksum
+func appendPart(dst io.Writer, e manifestEntry) error {
+	part, err := os.Open(e.Output)
+	if err != nil {
+		return fmt.Errorf("error opening part of batch %d %w", e.Batch, err)
+	}
+	defer part.Close()
+	sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, sum), part)
+	if err != nil {
+		return fmt.Errorf("error joining batch %d %w", e.Batch, err)
+	}
+	if n != e.Length {
+		return fmt.Errorf("part %s of batch %d holds %s, the manifest %s", e.Output, e.Batch, bytesIEC(n), bytesIEC(e.Length))
+	}
+	if e.SHA256 != "" && hex.EncodeToString(sum.Sum(nil)) != e.SHA256 {
+		return fmt.Errorf("part %s of batch %d doesn't match its checksum in the manifest", e.Output, e.Batch)
+	}
+	return nil
+}
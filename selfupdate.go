@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set at release builds, e.g.
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.updateKey=<base64 ed25519 public key>"
+//
+// updateKey is the key the SHA256SUMS of releases are signed with.
+var (
+	version   = "dev"
+	updateKey = ""
+)
+
+// where dbatch self-update looks for releases by default
+const updateRepo = "hofcake/dbatch"
+
+// dbatch version prints what this binary is and what it was built from
+func versionMain(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Printf("dbatch %s %s/%s %s\n", version, runtime.GOOS, runtime.GOARCH, runtime.Version())
+	if info, ok := debug.ReadBuildInfo(); ok {
+		settings := map[string]string{}
+		for _, s := range info.Settings {
+			settings[s.Key] = s.Value
+		}
+		if rev := settings["vcs.revision"]; rev != "" {
+			dirty := ""
+			if settings["vcs.modified"] == "true" {
+				dirty = ", modified"
+			}
+			fmt.Printf("commit %s, %s%s\n", rev, settings["vcs.time"], dirty)
+		}
+	}
+	if exe, err := os.Executable(); err == nil {
+		if sum, err := fileSHA256(exe); err == nil {
+			fmt.Printf("sha256 %s  %s\n", sum, exe)
+		}
+	}
+}
+
+// a GitHub release as the api returns it
+type release struct {
+	Tag    string         `json:"tag_name"`
+	Assets []releaseAsset `json:"assets"`
+}
+
+type releaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// dbatch self-update replaces the running binary with the latest release, once
+// its checksum and the signature of the checksums check out. It is never run
+// for you, -check only says whether there is a newer one.
+func selfUpdateMain(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", false, "only print whether a newer release is out")
+	repo := fs.String("repo", updateRepo, "github repository to take releases from")
+	api := fs.String("api", "https://api.github.com", "github api, for github enterprise or a mirror")
+	key := fs.String("key", cmp.Or(os.Getenv("DBATCH_UPDATE_KEY"), updateKey), "base64 ed25519 public key the SHA256SUMS of releases are signed with, default $DBATCH_UPDATE_KEY or the one built in")
+	unsigned := fs.Bool("checksum-only", false, "accept a release with a matching checksum but without a key to check its signature")
+	force := fs.Bool("force", false, "install the latest release even if it isn't newer")
+	fs.Parse(args)
+
+	if err := selfUpdate(*api, *repo, *key, *check, *unsigned, *force); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func selfUpdate(api, repo, key string, check, unsigned, force bool) error {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	var rel release
+	if err := getJSON(client, strings.TrimSuffix(api, "/")+"/repos/"+repo+"/releases/latest", &rel); err != nil {
+		return fmt.Errorf("error checking for releases %w", err)
+	}
+	newer := newerVersion(rel.Tag, version)
+	switch {
+	case check && newer:
+		fmt.Printf("dbatch %s is out, this is %s, update with dbatch self-update\n", rel.Tag, version)
+		return nil
+	case check || (!newer && !force):
+		fmt.Printf("dbatch %s is the latest release, this is %s\n", rel.Tag, version)
+		return nil
+	}
+	if key == "" && !unsigned {
+		return fmt.Errorf("no key to check the signature of %s with, give one with -key or accept the checksum alone with -checksum-only", rel.Tag)
+	}
+
+	name := fmt.Sprintf("dbatch_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	assets := map[string]string{}
+	for _, a := range rel.Assets {
+		assets[a.Name] = a.URL
+	}
+	if assets[name] == "" || assets["SHA256SUMS"] == "" {
+		return fmt.Errorf("release %s has no %s or no SHA256SUMS", rel.Tag, name)
+	}
+
+	fmt.Println("=============================================")
+	fmt.Printf("updating dbatch %s to %s\n", version, rel.Tag)
+	fmt.Println("=============================================")
+	sums, err := download(client, assets["SHA256SUMS"])
+	if err != nil {
+		return err
+	}
+	if key != "" {
+		if assets["SHA256SUMS.sig"] == "" {
+			return fmt.Errorf("release %s isn't signed, there is no SHA256SUMS.sig", rel.Tag)
+		}
+		sig, err := download(client, assets["SHA256SUMS.sig"])
+		if err != nil {
+			return err
+		}
+		if err := verifySignature(key, sums, sig); err != nil {
+			return err
+		}
+		fmt.Println("the signature of SHA256SUMS checks out")
+	} else {
+		fmt.Println("warning: not checking the signature of SHA256SUMS, the checksum only catches a corrupt download")
+	}
+	want, err := checksumOf(sums, name)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding the running binary %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("error finding the running binary %w", err)
+	}
+	// next to the binary so it can be renamed over it
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".dbatch-update-*")
+	if err != nil {
+		return fmt.Errorf("error writing the update %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	resp, err := client.Get(assets[name])
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("error downloading %s %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tmp.Close()
+		return fmt.Errorf("error downloading %s: %s", name, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error downloading %s %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing the update %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s, got %s, SHA256SUMS has %s", name, got, want)
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return fmt.Errorf("error writing the update %w", err)
+	}
+	// a binary that doesn't run here is never installed
+	if out, err := exec.Command(tmp.Name(), "version").CombinedOutput(); err != nil {
+		return fmt.Errorf("the %s binary doesn't run on this host: %s %w", rel.Tag, bytes.TrimSpace(out), err)
+	}
+
+	// windows can't replace a running binary but can rename it
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return fmt.Errorf("error replacing %s %w", exe, err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		os.Rename(old, exe)
+		return fmt.Errorf("error replacing %s %w", exe, err)
+	}
+	if runtime.GOOS != "windows" {
+		os.Remove(old)
+	}
+	fmt.Printf("updated %s to dbatch %s, sha256 %s\n", exe, rel.Tag, want)
+	return nil
+}
+
+func getJSON(client *http.Client, url string, v any) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s replied %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// a small release file, the checksums or their signature
+func download(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s %w", url, err)
+	}
+	return data, nil
+}
+
+// Check the ed25519 signature of the checksums, raw or base64 encoded
+func verifySignature(key string, sums, sig []byte) error {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid update key, it must be a base64 ed25519 public key")
+	}
+	if len(sig) != ed25519.SignatureSize {
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err == nil {
+			sig = decoded
+		}
+	}
+	if !ed25519.Verify(pub, sums, sig) {
+		return fmt.Errorf("the signature of SHA256SUMS doesn't check out, not updating")
+	}
+	return nil
+}
+
+// The checksum of name in a sha256sum listing
+func checksumOf(sums []byte, name string) (string, error) {
+	sc := bufio.NewScanner(bytes.NewReader(sums))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("SHA256SUMS has no checksum for %s", name)
+}
+
+// Whether release tag is newer than current, comparing v1.2.3 numerically. A
+// dev build is older than any release.
+func newerVersion(tag, current string) bool {
+	if current == "dev" {
+		return true
+	}
+	a, b := versionParts(tag), versionParts(current)
+	for i := range max(len(a), len(b)) {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	v, _, _ = strings.Cut(strings.TrimPrefix(v, "v"), "-")
+	var parts []int
+	for _, p := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(p)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
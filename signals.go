@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var errAborted = errors.New("aborted by operator")
+
+// set once the operator asks the run to stop, checked between batches
+var aborting atomic.Bool
+
+// The first interrupt stops the run at the next batch boundary, a second one
+// exits straight away
+func handleSignals(b *batch) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	s := <-sig
+	aborting.Store(true)
+	fmt.Printf("received %s, stopping after the current batch\n", s)
+	b.audit.record(b.out, "abort_requested", map[string]any{"signal": s.String()})
+
+	s = <-sig
+	b.audit.record(b.out, "abort_forced", map[string]any{"signal": s.String()})
+	killChildren()
+	// give exec a moment to deliver the kills before going
+	time.Sleep(100 * time.Millisecond)
+	os.RemoveAll(b.tmp)
+	os.Exit(1)
+}
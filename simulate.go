@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// recorded as the dorado of a simulated run
+const simulatedDorado = "simulate"
+
+// reads generated for a file whose read count can't be read from its footer
+const simulateReadsPerFile = 4000
+
+// Run dbatch itself as dorado. The generator takes the place of the
+// basecaller and everything downstream of it runs as usual.
+func (b *batch) useSimulator(rate, length, sd float64) {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	b.dpath = self
+	b.simulated = true
+	b.doradoArgs = []string{"simulate-dorado",
+		"-rate", strconv.FormatFloat(rate, 'f', -1, 64),
+		"-length", strconv.FormatFloat(length, 'f', -1, 64),
+		"-length-sd", strconv.FormatFloat(sd, 'f', -1, 64),
+		"--"}
+}
+
+// dorado as recorded in the state db
+func (b *batch) doradoPath() string {
+	if b.simulated {
+		return simulatedDorado
+	}
+	return b.dpath
+}
+
+// dbatch simulate-dorado [-rate r] [-length n] [-length-sd n] -- basecaller
+// model -r --emit-fastq dir, writes synthetic fastq for the pod5s in dir. As
+// many reads as the footers say are written, with log-normal lengths, at most
+// rate reads a second. Read IDs are seeded from the file names so reruns of a
+// chunk write the same reads.
+func simulateMain(args []string) {
+	fs := flag.NewFlagSet("simulate-dorado", flag.ExitOnError)
+	rate := fs.Float64("rate", 0, "reads per second, 0 for as fast as possible")
+	length := fs.Float64("length", 8000, "mean read length")
+	sd := fs.Float64("length-sd", 6000, "standard deviation of the read length")
+	fs.Parse(args)
+
+	if fs.NArg() < 2 || fs.Arg(0) != "basecaller" {
+		log.Fatal("the simulator only basecalls")
+	}
+	dir := fs.Arg(fs.NArg() - 1)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	slices.Sort(files)
+
+	// log-normal with the given mean and standard deviation
+	sigma := math.Sqrt(math.Log(1 + (*sd**sd)/(*length**length)))
+	mu := math.Log(*length) - sigma*sigma/2
+
+	out := bufio.NewWriterSize(os.Stdout, 1<<20)
+	start := time.Now()
+	var written int64
+	for _, path := range files {
+		n, err := pod5ReadCount(path)
+		if err != nil {
+			n = simulateReadsPerFile
+		}
+		h := fnv.New64a()
+		h.Write([]byte(filepath.Base(path)))
+		rng := rand.New(rand.NewPCG(h.Sum64(), 0))
+
+		for range n {
+			size := max(int(math.Exp(mu+sigma*rng.NormFloat64())), 1)
+			writeSimulatedRead(out, rng, size)
+			written++
+			if *rate > 0 {
+				due := start.Add(time.Duration(float64(written) / *rate * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					out.Flush()
+					time.Sleep(wait)
+				}
+			}
+		}
+	}
+	if err := out.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "simulated dorado: %s reads from %d files in %s\n", thousands(written), len(files), humanDuration(time.Since(start)))
+}
+
+// quality characters drawn from by a random byte, qscores around 20
+var simulatedQuals = func() [256]byte {
+	var q [256]byte
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range q {
+		q[i] = byte(33 + min(max(int(20+5*rng.NormFloat64()), 1), 50))
+	}
+	return q
+}()
+
+func writeSimulatedRead(w *bufio.Writer, rng *rand.Rand, size int) {
+	var id [16]byte
+	for i := range id {
+		id[i] = byte(rng.Uint32())
+	}
+	fmt.Fprintf(w, "@%x-%x-%x-%x-%x simulated\n", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	// 32 bases and 8 qualities from every random word
+	seq := make([]byte, size)
+	for i := 0; i < size; i += 32 {
+		r := rng.Uint64()
+		for j := i; j < min(i+32, size); j++ {
+			seq[j] = "ACGT"[r&3]
+			r >>= 2
+		}
+	}
+	w.Write(seq)
+	w.WriteString("\n+\n")
+	for i := 0; i < size; i += 8 {
+		r := rng.Uint64()
+		for j := i; j < min(i+8, size); j++ {
+			seq[j] = simulatedQuals[r&0xff]
+			r >>= 8
+		}
+	}
+	w.Write(seq)
+	w.WriteByte('\n')
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// -skip-list names inputs that are left out on purpose, known-bad flow cell
+// segments and the like, one per line with an optional reason after a #:
+//
+//	# pore blockage on the second half of the run
+//	/data/run1/pod5/PAO123_pass_17.pod5
+//	PAO123_pass_2?.pod5       # glob on the file name
+//	batch 12                  # a chunk of the plan, by its batch number
+//	batch 30-32
+//
+// Files are left out when the input is discovered, batches when their turn
+// comes. Both are recorded in the state db and the manifest as skipped, not
+// missing, with the entry that matched and its reason. The list is read again
+// on every -rescan, so entries can be added while the run goes on.
+type skipList struct {
+	patterns []skipPattern
+	batches  map[int]string // batch number to reason
+}
+
+type skipPattern struct {
+	entry, reason string
+	path          bool // matched against the absolute path, else the file name
+}
+
+// an entry of the skip list with what it left out
+type skipRecord struct {
+	Entry  string   `json:"entry"`
+	Batch  int      `json:"batch,omitempty"` // when a batch of the plan was skipped
+	Reason string   `json:"reason,omitempty"`
+	Files  []string `json:"files"`
+}
+
+var skipBatchPattern = regexp.MustCompile(`^batch\s+(\d+)(?:\s*-\s*(\d+))?$`)
+
+func loadSkipList(path string) (*skipList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading -skip-list %w", err)
+	}
+	defer f.Close()
+	l := &skipList{batches: map[int]string{}}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, reason, _ := strings.Cut(sc.Text(), "#")
+		line, reason = strings.TrimSpace(line), strings.TrimSpace(reason)
+		if line == "" {
+			continue
+		}
+		if m := skipBatchPattern.FindStringSubmatch(line); m != nil {
+			from, _ := strconv.Atoi(m[1])
+			to := from
+			if m[2] != "" {
+				to, _ = strconv.Atoi(m[2])
+			}
+			if from < 1 || to < from {
+				return nil, fmt.Errorf("error in -skip-list %s line %d: invalid batches %q", path, n, line)
+			}
+			for i := from; i <= to; i++ {
+				l.batches[i] = reason
+			}
+			continue
+		}
+		p := skipPattern{entry: line, reason: reason, path: strings.ContainsAny(line, `/\`)}
+		if p.path {
+			if abs, err := filepath.Abs(line); err == nil {
+				p.entry = abs
+			}
+		}
+		if _, err := filepath.Match(p.entry, ""); err != nil {
+			return nil, fmt.Errorf("error in -skip-list %s line %d: %w", path, n, err)
+		}
+		l.patterns = append(l.patterns, p)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading -skip-list %w", err)
+	}
+	return l, nil
+}
+
+// The entry that leaves out the file at abs, -1 for none
+func (l *skipList) matchFile(abs string) int {
+	for i, p := range l.patterns {
+		name := abs
+		if !p.path {
+			name = filepath.Base(abs)
+		}
+		if ok, _ := filepath.Match(p.entry, name); ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *skipList) skipsBatch(n int) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.batches[n]
+	return ok
+}
+
+// Record the batches of the plan on the skip list with their files
+func (b *batch) skipBatches() error {
+	b.skippedBatches = nil
+	if b.skips == nil {
+		return nil
+	}
+	for c, sp := range b.plan {
+		if !b.skipsBatch(c) {
+			continue
+		}
+		files, err := b.pod5s.files(sp.start, sp.end)
+		if err != nil {
+			return err
+		}
+		rec := skipRecord{Entry: fmt.Sprintf("batch %d", c+1), Batch: c + 1, Reason: b.skips.batches[c+1]}
+		for _, f := range files {
+			rec.Files = append(rec.Files, absPath(f.path))
+		}
+		b.skippedBatches = append(b.skippedBatches, rec)
+	}
+	if b.state != nil {
+		b.state.Skipped = b.skipped()
+	}
+	return nil
+}
+
+// whether chunk c is left out by the skip list, -only-batch overrides it
+func (b *batch) skipsBatch(c int) bool {
+	return b.onlyBatch == 0 && b.skips.skipsBatch(c+1)
+}
+
+// everything the skip list left out of the run
+func (b *batch) skipped() []skipRecord {
+	return append(append([]skipRecord(nil), b.skippedFiles...), b.skippedBatches...)
+}
+
+// Print what the skip list left out
+func (b *batch) reportSkipped() {
+	if b.skips == nil {
+		return
+	}
+	var files int
+	for _, rec := range b.skippedFiles {
+		files += len(rec.Files)
+	}
+	var batches []string
+	for _, rec := range b.skippedBatches {
+		batches = append(batches, strconv.Itoa(rec.Batch))
+	}
+	switch {
+	case len(batches) > 0:
+		fmt.Printf("skipping %s files and batches %s of the plan on the -skip-list\n", thousands(int64(files)), strings.Join(batches, ", "))
+	case files > 0:
+		fmt.Printf("skipping %s files on the -skip-list\n", thousands(int64(files)))
+	}
+	var past int
+	for n := range b.skips.batches {
+		if n > len(b.plan) {
+			past++
+		}
+	}
+	if past > 0 {
+		fmt.Printf("warning: %d batches on the -skip-list are past the %d planned\n", past, len(b.plan))
+	}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil && !isURL(path) {
+		return abs
+	}
+	return path
+}
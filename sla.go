@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// batches done before an sla derived from the run itself applies
+const slaHistory = 3
+
+// Alerts for a batch running longer than it should: -chunk-sla-factor times
+// -chunk-sla, or without one times the median of the batches done so far.
+// A chunk dragging on is the first sign of a degrading or throttling GPU or of
+// slow storage, and the alert goes out while it is still running.
+type chunkSLA struct {
+	expected time.Duration // 0 to derive from the run
+	factor   float64
+	webhook  string
+	client   *http.Client
+}
+
+// what the webhook receives
+type slaAlert struct {
+	Event   string  `json:"event"`
+	Out     string  `json:"out"`
+	Host    string  `json:"host"`
+	Labels  labels  `json:"labels,omitempty"`
+	Batch   int     `json:"batch"`
+	Files   int     `json:"files"`
+	Elapsed float64 `json:"elapsed_seconds"`
+	Limit   float64 `json:"limit_seconds"`
+	Time    string  `json:"time"`
+}
+
+func newChunkSLA(expected time.Duration, factor float64, webhook string) *chunkSLA {
+	return &chunkSLA{expected: expected, factor: factor, webhook: webhook, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// How long the next batch may take, 0 while there is nothing to go by
+func (b *batch) slaLimit() time.Duration {
+	if b.sla.expected > 0 {
+		return time.Duration(float64(b.sla.expected) * b.sla.factor)
+	}
+	var took []float64
+	for _, rec := range b.state.Batches {
+		if rec.Done && rec.Timings != nil && !rec.Reused {
+			took = append(took, rec.Timings.Startup+rec.Timings.Basecall+rec.Timings.Tail)
+		}
+	}
+	if len(took) < slaHistory {
+		return 0
+	}
+	slices.Sort(took)
+	return time.Duration(took[len(took)/2] * b.sla.factor * float64(time.Second))
+}
+
+// Start the clock on a batch. The returned function stops it once the batch
+// is done or failed.
+func (b *batch) watchSLA(index, files int) func() {
+	if b.sla == nil {
+		return func() {}
+	}
+	limit := b.slaLimit()
+	if limit <= 0 {
+		return func() {}
+	}
+	started := time.Now()
+	timer := time.AfterFunc(limit, func() {
+		b.slaBreached(index, files, time.Since(started), limit)
+	})
+	return func() { timer.Stop() }
+}
+
+func (b *batch) slaBreached(index, files int, elapsed, limit time.Duration) {
+	fmt.Printf("warning: batch %d has been running for %s, over its sla of %s\n", index, humanDuration(elapsed), humanDuration(limit))
+	metrics.add("dbatch_sla_breaches_total", 1)
+	b.audit.record(b.out, "batch_slow", map[string]any{"batch": index, "elapsed": elapsed.Seconds(), "limit": limit.Seconds()})
+	if b.sla.webhook == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	body, err := json.Marshal(slaAlert{
+		Event: "batch_slow", Out: b.redact.path(b.out), Host: host, Labels: b.redact.labelSet(b.labels),
+		Batch: index, Files: files, Elapsed: elapsed.Seconds(), Limit: limit.Seconds(),
+		Time: timestamp(time.Now()),
+	})
+	if err != nil {
+		fmt.Printf("error encoding sla alert %s\n", err)
+		return
+	}
+	if err := postWebhook(b.sla.client, b.sla.webhook, body); err != nil {
+		fmt.Printf("error sending sla alert %s\n", err)
+		d := delivery{Kind: "webhook", Event: "batch_slow", Batch: index, Payload: body, Error: err.Error()}
+		d.Target, d.Auth = stripCredentials(b.sla.webhook)
+		b.failedDelivery(d)
+	}
+}
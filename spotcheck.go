@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand/v2"
+	"os"
+)
+
+type spotResult struct {
+	sampled int
+	records int64
+	sha256  string // of the compressed range
+}
+
+// Decompress the bytes a batch appended to the output and re-parse them. A random
+// fraction of records is checked for well-formedness and every read ID must be
+// unique within the batch. With reads >= 0 the number of records must match the
+// reads counted while basecalling.
+func spotCheck(path string, offset, length int64, fraction float64, reads int64) (spotResult, error) {
+	var res spotResult
+	f, err := os.Open(path)
+	if err != nil {
+		return res, fmt.Errorf("spot check: error opening output %w", err)
+	}
+	defer f.Close()
+
+	// each batch is a separate zstd frame, so its range decompresses on its own
+	sum := sha256.New()
+	zstd := command("zstd", "-dc")
+	zstd.Stdin = io.TeeReader(io.NewSectionReader(f, offset, length), sum)
+	zstd.Stderr = os.Stderr
+	fastq, err := zstd.StdoutPipe()
+	if err != nil {
+		return res, fmt.Errorf("spot check: could not get zstd stdout %w", err)
+	}
+	defer slots.hold(1)()
+	if err := zstd.Start(); err != nil {
+		return res, fmt.Errorf("spot check: failed to start zstd: %w", err)
+	}
+
+	var checkErr error
+	res.sampled, res.records, checkErr = checkRecords(fastq, fraction)
+	if checkErr != nil {
+		io.Copy(io.Discard, fastq)
+	}
+	if err := zstd.Wait(); err != nil {
+		return res, fmt.Errorf("spot check: batch output does not decompress: %w", err)
+	}
+	if checkErr != nil {
+		return res, checkErr
+	}
+	if reads >= 0 && res.records != reads {
+		return res, fmt.Errorf("spot check: output has %d records but %d reads were basecalled", res.records, reads)
+	}
+	res.sha256 = hex.EncodeToString(sum.Sum(nil))
+	return res, nil
+}
+
+// check the records of r, returning how many were sampled out of how many
+func checkRecords(r io.Reader, fraction float64) (int, int64, error) {
+	rd := bufio.NewReaderSize(r, 1024*1024)
+	ids := make(map[uint64]struct{})
+	var lines [4][]byte
+	var sampled int
+
+	for n := 0; ; n++ {
+		for i := range lines {
+			line, err := rd.ReadBytes('\n')
+			if err == io.EOF && len(line) == 0 {
+				if i == 0 {
+					return sampled, int64(n), nil
+				}
+				return sampled, int64(n), fmt.Errorf("spot check: record %d is truncated", n)
+			}
+			if err != nil && err != io.EOF {
+				return sampled, int64(n), fmt.Errorf("spot check: error reading output %w", err)
+			}
+			lines[i] = bytes.TrimRight(line, "\r\n")
+		}
+
+		if len(lines[0]) < 2 || lines[0][0] != '@' {
+			return sampled, int64(n), fmt.Errorf("spot check: record %d has a bad header %.50q", n, lines[0])
+		}
+		id, _, _ := bytes.Cut(lines[0][1:], []byte{'\t'})
+		id, _, _ = bytes.Cut(id, []byte{' '})
+		h := fnv.New64a()
+		h.Write(id)
+		if _, dup := ids[h.Sum64()]; dup {
+			return sampled, int64(n), fmt.Errorf("spot check: read %s appears more than once", id)
+		}
+		ids[h.Sum64()] = struct{}{}
+
+		if rand.Float64() >= fraction {
+			continue
+		}
+		sampled++
+		if len(lines[2]) == 0 || lines[2][0] != '+' {
+			return sampled, int64(n), fmt.Errorf("spot check: read %s has no separator line", id)
+		}
+		if len(lines[1]) == 0 || len(lines[1]) != len(lines[3]) {
+			return sampled, int64(n), fmt.Errorf("spot check: read %s has %d bases but %d qualities", id, len(lines[1]), len(lines[3]))
+		}
+		for _, c := range lines[3] {
+			if c < '!' || c > '~' {
+				return sampled, int64(n), fmt.Errorf("spot check: read %s has invalid quality characters", id)
+			}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// runState records how a run was planned so individual chunks can be revisited
+type runState struct {
+	Dorado string       `json:"dorado"`
+	Model  string       `json:"model"`
+	Format string       `json:"format,omitempty"`
+	Hooks  extHooks     `json:"ext_hooks,omitempty"`
+	Recal  *qscoreRecal `json:"qscore_recal,omitempty"`
+	In     string       `json:"in"`
+	Out    string       `json:"out"`
+	Chunk  int          `json:"chunk"`
+
+	// with -hash-names, as the hashes depend on it
+	DoradoVersion string `json:"dorado_version,omitempty"`
+	// the -env overrides the children ran with, for dbatch redo
+	Env []string `json:"env,omitempty"`
+
+	// with -shard, Out is this instance's shard of SharedOut
+	Shard     int    `json:"shard,omitempty"`
+	Shards    int    `json:"shards,omitempty"`
+	SharedOut string `json:"shared_out,omitempty"`
+	// with -journal, the batches of the whole plan the shards join into SharedOut
+	Journal bool `json:"journal,omitempty"`
+	Planned int  `json:"planned,omitempty"`
+
+	Labels  labels        `json:"labels,omitempty"`
+	RunInfo *runInfo      `json:"run_info,omitempty"`
+	Batches []batchRecord `json:"batches"`
+	Skipped []skipRecord  `json:"skipped,omitempty"` // left out by -skip-list
+	Redos   []redoRecord  `json:"redos,omitempty"`
+	Notes   []note        `json:"notes,omitempty"` // added with dbatch note
+	// events and alerts that couldn't be sent, see deliveries.go
+	Deliveries []delivery `json:"failed_deliveries,omitempty"`
+
+	// held while the db is encoded, failed alerts are added from their own goroutine
+	mu sync.Mutex
+
+	path    string
+	created string // notes older than this belong to an earlier run
+}
+
+type batchRecord struct {
+	Index int      `json:"index"`
+	Files []string `json:"files"`
+	Done  bool     `json:"done"`
+	Error string   `json:"error,omitempty"` // why a skipped batch failed
+	// byte range of the output written by this batch, with -per-batch the
+	// whole of its own file
+	Output string `json:"output,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+
+	Reads int64 `json:"reads,omitempty"`
+	Bases int64 `json:"bases,omitempty"`
+	// reads in the pod5s of the batch and how many of them dorado didn't emit
+	ExpectedReads int64  `json:"expected_reads,omitempty"`
+	MissingReads  int64  `json:"missing_reads,omitempty"`
+	SHA256        string `json:"sha256,omitempty"` // of the output range, once verified
+	// with -hash-names, of the inputs and settings, and whether the output was
+	// already there from an identical batch
+	Hash   string `json:"hash,omitempty"`
+	Reused bool   `json:"reused,omitempty"`
+
+	Timings *stageTimes `json:"timings,omitempty"`
+	// of dorado and the compressors, as run by the last attempt
+	Commands []string `json:"commands,omitempty"`
+}
+
+// supplementary outputs written by dbatch redo
+type redoRecord struct {
+	Batch int          `json:"batch"`
+	Model string       `json:"model"`
+	Out   string       `json:"out"`
+	Recal *qscoreRecal `json:"qscore_recal,omitempty"`
+}
+
+// The state db lives in the run directory
+func statePath(out string) string {
+	return runFile(out, "state.json")
+}
+
+func newRunState(b *batch) *runState {
+	s := &runState{
+		Dorado:  b.doradoPath(),
+		Model:   b.model,
+		Format:  b.format,
+		Hooks:   b.hooks,
+		Recal:   b.recal,
+		In:      b.in,
+		Out:     b.out,
+		Chunk:   b.chunk,
+		Labels:  b.labels,
+		path:    statePath(b.out),
+		created: timestamp(b.started),
+		RunInfo: newRunInfo(b.started),
+		Skipped: b.skipped(),
+
+		DoradoVersion: b.doradoVersion,
+		Env:           b.env,
+
+		Shard:     b.shard,
+		Shards:    b.shards,
+		SharedOut: b.sharedOut,
+		Journal:   b.journal,
+	}
+	if b.journal {
+		s.Planned = len(b.plan)
+	}
+	return s
+}
+
+func loadRunState(path string) (*runState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state db %w", err)
+	}
+	s := new(runState)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("error parsing state db %s: %w", path, err)
+	}
+	s.path = path
+	return s, nil
+}
+
+// Record a new batch, numbered from 1 by its position in the plan
+func (s *runState) addBatch(index int, files []pod5) *batchRecord {
+	rec := batchRecord{Index: index}
+	for _, f := range files {
+		path, err := filepath.Abs(f.path)
+		if err != nil || isURL(f.path) {
+			path = f.path
+		}
+		rec.Files = append(rec.Files, path)
+	}
+	s.Batches = append(s.Batches, rec)
+	return &s.Batches[len(s.Batches)-1]
+}
+
+func (s *runState) findBatch(index int) (*batchRecord, bool) {
+	for i := range s.Batches {
+		if s.Batches[i].Index == index {
+			return &s.Batches[i], true
+		}
+	}
+	return nil, false
+}
+
+// write to a temporary file first so a crash never leaves a truncated db. The
+// db is locked for the write and notes added by dbatch note meanwhile are kept.
+func (s *runState) save() error {
+	unlock, err := lockFile(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.mu.Lock()
+	s.mergeNotes()
+	data, err := json.MarshalIndent(s, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding state db %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing state db %w", err)
+	}
+	perms.set(tmp)
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error writing state db %w", err)
+	}
+	return nil
+}
+
+// Batches that failed and were skipped
+func (s *runState) missing() []batchRecord {
+	var missing []batchRecord
+	for _, rec := range s.Batches {
+		if !rec.Done && rec.Error != "" {
+			missing = append(missing, rec)
+		}
+	}
+	return missing
+}
+
+// Forget a batch that was handed to another pipeline
+func (s *runState) drop(index int) {
+	s.Batches = slices.DeleteFunc(s.Batches, func(rec batchRecord) bool { return rec.Index == index })
+	if err := s.save(); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// one row of chan_stats.csv, see writeAnalysis
+type pipeSample struct {
+	readTime  time.Duration
+	writeTime time.Duration
+	size      int
+}
+
+// dbatch stats summarises pipe pressure data written by -monitor-pressure
+func statsMain(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	buckets := fs.Int("buckets", 20, "number of intervals to report throughput over")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Println("usage: dbatch stats [-buckets n] chan_stats.csv[.gz] ...")
+		fs.PrintDefaults()
+		return
+	}
+
+	var samples []pipeSample
+	batches := 0
+	for _, path := range fs.Args() {
+		s, n, err := readPipeStats(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		samples = append(samples, s...)
+		batches += n
+	}
+	if len(samples) == 0 {
+		log.Fatal("no pipe samples found")
+	}
+	printPipeStats(samples, batches, max(*buckets, 1))
+}
+
+// Parse a chan_stats.csv. Every batch appends its own header, so the number
+// of headers is the number of batches recorded.
+func readPipeStats(path string) ([]pipeSample, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening pipe stats %w", err)
+	}
+	defer f.Close()
+	if !strings.HasSuffix(path, ".gz") {
+		return parsePipeStats(f, path)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading %s %w", path, err)
+	}
+	return parsePipeStats(gz, path)
+}
+
+func parsePipeStats(r io.Reader, name string) ([]pipeSample, int, error) {
+	var samples []pipeSample
+	batches := 0
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "Read Time") {
+			batches++
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) != 3 {
+			return nil, 0, fmt.Errorf("%s:%d: expected 3 fields, got %d", name, line, len(fields))
+		}
+		var v [3]int64
+		for i, field := range fields {
+			n, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("%s:%d: %w", name, line, err)
+			}
+			v[i] = n
+		}
+		samples = append(samples, pipeSample{time.Duration(v[0]), time.Duration(v[1]), int(v[2])})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading %s %w", name, err)
+	}
+	return samples, batches, nil
+}
+
+func printPipeStats(samples []pipeSample, batches, buckets int) {
+	var readTotal, writeTotal time.Duration
+	var bytes int64
+	reads := make([]int64, len(samples))
+	writes := make([]int64, len(samples))
+	sizes := make([]int64, len(samples))
+	for i, s := range samples {
+		readTotal += s.readTime
+		writeTotal += s.writeTime
+		bytes += int64(s.size)
+		reads[i], writes[i], sizes[i] = int64(s.readTime), int64(s.writeTime), int64(s.size)
+	}
+	total := readTotal + writeTotal
+
+	fmt.Println("=============================================")
+	fmt.Printf("%s buffers over %d batches, %s moved in %s\n", thousands(int64(len(samples))), batches, bytesIEC(bytes), humanDuration(total))
+	fmt.Println("              p50        p90        p99        max")
+	for _, row := range []struct {
+		name   string
+		values []int64
+		format func(int64) string
+	}{
+		{"read wait", reads, roundDuration},
+		{"write wait", writes, roundDuration},
+		{"buffer", sizes, bytesIEC},
+	} {
+		slices.Sort(row.values)
+		fmt.Printf("%-12s", row.name)
+		for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+			fmt.Printf(" %10s", row.format(percentile(row.values, q)))
+		}
+		fmt.Println()
+	}
+
+	if total == 0 {
+		return
+	}
+
+	// the csv has no timestamps, the time spent in the pipe stands in for them
+	fmt.Println("=============================================")
+	fmt.Println("throughput over time:")
+	step := total / time.Duration(buckets)
+	var elapsed, bucketTime time.Duration
+	var bucketBytes int64
+	next := step
+	for i, s := range samples {
+		elapsed += s.readTime + s.writeTime
+		bucketTime += s.readTime + s.writeTime
+		bucketBytes += int64(s.size)
+		if elapsed >= next || i == len(samples)-1 {
+			rate := 0.0
+			if bucketTime > 0 {
+				rate = float64(bucketBytes) / (1 << 20) / bucketTime.Seconds()
+			}
+			fmt.Printf("  %10s  %8.1f MiB/s\n", humanDuration(elapsed), rate)
+			bucketTime, bucketBytes = 0, 0
+			next += step
+		}
+	}
+
+	fmt.Println("=============================================")
+	if writeTotal > readTotal {
+		fmt.Printf("writer-bound: %.0f%% of the time was spent waiting on the compressor, dorado is being held up\n", 100*writeTotal.Seconds()/total.Seconds())
+		fmt.Println("try -auto-compress, a faster compressor or a faster output filesystem")
+	} else {
+		fmt.Printf("reader-bound: %.0f%% of the time was spent waiting on dorado, compression keeps up\n", 100*readTotal.Seconds()/total.Seconds())
+	}
+}
+
+func percentile(sorted []int64, q float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+func roundDuration(ns int64) string {
+	return humanDuration(time.Duration(ns))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// what one model of a sweep produced
+type sweepResult struct {
+	Model   string     `json:"model"`
+	Output  string     `json:"output"`
+	Seconds float64    `json:"seconds"`
+	Error   string     `json:"error,omitempty"`
+	QC      *qcSummary `json:"qc,omitempty"`
+}
+
+// dbatch sweep basecalls the same input with each of -models in turn, into
+// outputs labeled by model, and compares yield, qscore and runtime. It takes
+// the usual run flags.
+func sweepMain(args []string) {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	models := fs.String("models", "", "comma separated dorado models to run the input through, e.g. fast,hac,sup")
+	build := runFlags(fs)
+	fs.Parse(args)
+
+	if *models == "" {
+		fmt.Println("usage: dbatch sweep -models fast,hac,sup -in pod5s -out run.fastq.zst -dorado dorado")
+		fs.PrintDefaults()
+		return
+	}
+
+	var results []sweepResult
+	var out string
+	for i, model := range strings.Split(*models, ",") {
+		b, err := build()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if b.in == "" || b.out == "" || b.dpath == "" {
+			fs.PrintDefaults()
+			return
+		}
+		out = b.out
+		b.model = strings.TrimSpace(model)
+		// a model given as a path is labeled by its directory name
+		b.out = labeledPath(out, filepath.Base(b.model))
+		if i == 0 {
+			go handleSignals(b)
+		}
+
+		fmt.Println("=============================================")
+		fmt.Printf("sweep: basecalling %s with %s into %s\n", b.in, b.model, b.out)
+		fmt.Println("=============================================")
+
+		r := sweepResult{Model: b.model, Output: b.out}
+		started := time.Now()
+		err = b.run()
+		r.Seconds = time.Since(started).Seconds()
+		if err != nil {
+			fmt.Println(err)
+			r.Error = err.Error()
+		}
+		if data, err := os.ReadFile(qcPath(b.out)); err == nil {
+			var qc qcReport
+			if json.Unmarshal(data, &qc) == nil {
+				r.QC = &qc.All
+			}
+		}
+		results = append(results, r)
+		if errors.Is(err, errAborted) {
+			break
+		}
+	}
+
+	printSweep(results)
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		log.Fatalf("error encoding sweep report %s", err)
+	}
+	if err := os.WriteFile(out+".sweep.json", data, 0644); err != nil {
+		log.Fatalf("error writing sweep report %s", err)
+	}
+	perms.set(out + ".sweep.json")
+	fmt.Printf("sweep report written to %s\n", out+".sweep.json")
+	for _, r := range results {
+		if r.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
+
+func printSweep(results []sweepResult) {
+	fmt.Println("=============================================")
+	fmt.Printf("%-40s %10s %12s %8s %8s %10s\n", "model", "reads", "bases", "n50", "mean q", "runtime")
+	for _, r := range results {
+		if r.QC == nil {
+			fmt.Printf("%-40s %10s %12s %8s %8s %10s %s\n", r.Model, "-", "-", "-", "-", seconds(r.Seconds), r.Error)
+			continue
+		}
+		fmt.Printf("%-40s %10s %12s %8s %8.1f %10s %s\n", r.Model, thousands(r.QC.Reads), baseCount(r.QC.Bases), thousands(int64(r.QC.N50)), r.QC.MeanQ, seconds(r.Seconds), r.Error)
+	}
+	fmt.Println("=============================================")
+}
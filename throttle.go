@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttle is a token bucket limiting the rate data is written to the
+// destination filesystem. It is kept across batches so the limit holds for the
+// whole run, bursting at most one second's worth after an idle period.
+type throttle struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func newThrottle(mbps float64) *throttle {
+	rate := mbps * 1e6
+	t := &throttle{rate: rate, burst: max(int(rate), 1), last: time.Now()}
+	t.tokens = float64(t.burst)
+
+	metrics.describe("dbatch_write_throttle_limit_bytes_per_second", "gauge", "Configured write rate limit")
+	metrics.describe("dbatch_write_throttle_active", "gauge", "1 while writes are being held back by the rate limit")
+	metrics.describe("dbatch_write_throttled_seconds_total", "counter", "Time spent holding back writes")
+	metrics.set("dbatch_write_throttle_limit_bytes_per_second", rate)
+	return t
+}
+
+// block until n bytes may be written
+func (t *throttle) wait(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.tokens = min(float64(t.burst), t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+
+	if t.tokens < float64(n) {
+		d := time.Duration((float64(n) - t.tokens) / t.rate * float64(time.Second))
+		metrics.set("dbatch_write_throttle_active", 1)
+		time.Sleep(d)
+		metrics.set("dbatch_write_throttle_active", 0)
+		metrics.add("dbatch_write_throttled_seconds_total", d.Seconds())
+		t.tokens = float64(n)
+		t.last = time.Now()
+	}
+	t.tokens -= float64(n)
+}
+
+// Returns a writer to w limited by t
+func (t *throttle) writer(w io.Writer) io.Writer {
+	return &throttledWriter{w: w, t: t}
+}
+
+type throttledWriter struct {
+	w io.Writer
+	t *throttle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), tw.t.burst)
+		tw.t.wait(n)
+		nw, err := tw.w.Write(p[:n])
+		written += nw
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every timestamp dbatch writes, in the state db, manifest, audit log,
+// reports, events and rotated file names, is RFC3339 in UTC, so runs of sites
+// in different zones line up. -local-time only changes what is printed.
+var localTime bool
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// for the audit log, whose entries follow each other within a second
+func timestampNano(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// A time as printed, in the local zone with -local-time
+func displayTime(t time.Time) string {
+	if localTime {
+		return t.Local().Format("2006-01-02 15:04:05 MST")
+	}
+	return timestamp(t)
+}
+
+// A timestamp read back from a db or report, as printed
+func displayStamp(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return displayTime(t)
+}
+
+// Switch -local-time, log lines included
+func setLocalTime(on bool) {
+	localTime = on
+	if on {
+		log.SetFlags(log.LstdFlags)
+	} else {
+		log.SetFlags(log.LstdFlags | log.LUTC)
+	}
+}
+
+// where and when a run started, with the zone of its host
+type runInfo struct {
+	Started  string `json:"started"`
+	Host     string `json:"host"`
+	Timezone string `json:"timezone"` // e.g. Europe/Berlin, or the abbreviation if the name isn't known
+	Offset   string `json:"utc_offset"`
+}
+
+func newRunInfo(started time.Time) *runInfo {
+	host, _ := os.Hostname()
+	local := started.Local()
+	return &runInfo{Started: timestamp(started), Host: host, Timezone: zoneName(local), Offset: local.Format("-07:00")}
+}
+
+// The name of the local zone, from TZ or the /etc/localtime link
+func zoneName(t time.Time) string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	if link, err := os.Readlink("/etc/localtime"); err == nil {
+		if _, name, ok := strings.Cut(filepath.ToSlash(link), "zoneinfo/"); ok {
+			return name
+		}
+	}
+	abbrev, _ := t.Zone()
+	return abbrev
+}
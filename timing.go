@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// where the time of a batch went, in seconds
+type stageTimes struct {
+	Staging  float64 `json:"staging"`
+	Startup  float64 `json:"startup"` // dorado start to first read, mostly model load
+	Basecall float64 `json:"basecall"`
+	Tail     float64 `json:"tail"` // draining and compressing after dorado is done
+	Verify   float64 `json:"verify"`
+	// model loading a -warm-worker spared the batch, its load less the startup
+	Saved float64 `json:"startup_saved,omitempty"`
+}
+
+func (t stageTimes) String() string {
+	s := fmt.Sprintf("staging %s, startup %s, basecalling %s, tail %s, verify %s",
+		seconds(t.Staging), seconds(t.Startup), seconds(t.Basecall), seconds(t.Tail), seconds(t.Verify))
+	if t.Saved > 0 {
+		s += fmt.Sprintf(", %s of startup saved", seconds(t.Saved))
+	}
+	return s
+}
+
+// seconds in dorado, from its start to the output being compressed
+func (t stageTimes) took() float64 {
+	return t.Startup + t.Basecall + t.Tail
+}
+
+func seconds(s float64) string {
+	return humanDuration(time.Duration(s * float64(time.Second)))
+}
+
+// Print the average breakdown over the batches that finished, and how much
+// of each batch is fixed overhead that a bigger -chunk would amortise
+func printTimings(batches []batchRecord) {
+	var sum stageTimes
+	n := 0
+	for _, rec := range batches {
+		if rec.Timings == nil || rec.Error != "" {
+			continue
+		}
+		sum.Staging += rec.Timings.Staging
+		sum.Startup += rec.Timings.Startup
+		sum.Basecall += rec.Timings.Basecall
+		sum.Tail += rec.Timings.Tail
+		sum.Verify += rec.Timings.Verify
+		sum.Saved += rec.Timings.Saved
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	avg := stageTimes{sum.Staging / float64(n), sum.Startup / float64(n), sum.Basecall / float64(n), sum.Tail / float64(n), sum.Verify / float64(n), sum.Saved / float64(n)}
+	total := avg.Staging + avg.Startup + avg.Basecall + avg.Tail + avg.Verify
+	overhead := avg.Staging + avg.Startup + avg.Tail
+
+	fmt.Println("=============================================")
+	fmt.Printf("average of %d batches: %s\n", n, avg)
+	if total > 0 {
+		fmt.Printf("per batch overhead %s of %s (%.0f%%)\n", seconds(overhead), seconds(total), 100*overhead/total)
+	}
+	if sum.Saved > 0 {
+		fmt.Printf("the warm worker spared the batches %s of model loading in all\n", seconds(sum.Saved))
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exports OpenTelemetry spans over OTLP/HTTP in its json encoding: a span for
+// the run, one per batch under it and one per stage of the batch. Batch spans
+// are sent once the batch is done or failed, the run span when it ends.
+type tracer struct {
+	mu       sync.Mutex
+	endpoint string // e.g. http://collector:4318, /v1/traces is appended
+	headers  map[string]string
+	service  string
+	trace    string
+	run      string // span id of the run
+	started  time.Time
+	batches  map[int]time.Time // start of the batches not exported yet
+	exported map[int]bool
+	client   *http.Client
+	redact   func(string) string // of the errors, with -redact paths
+}
+
+const otlpError = 2
+
+type otlpSpan struct {
+	TraceID string      `json:"traceId"`
+	SpanID  string      `json:"spanId"`
+	Parent  string      `json:"parentSpanId,omitempty"`
+	Name    string      `json:"name"`
+	Kind    int         `json:"kind"`
+	Start   string      `json:"startTimeUnixNano"`
+	End     string      `json:"endTimeUnixNano"`
+	Attrs   []otlpAttr  `json:"attributes,omitempty"`
+	Status  *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newTracer(endpoint string) *tracer {
+	t := &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		headers:  map[string]string{},
+		service:  "dbatch",
+		trace:    randomID(16),
+		run:      randomID(8),
+		started:  time.Now(),
+		batches:  map[int]time.Time{},
+		exported: map[int]bool{},
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		t.service = name
+	}
+	// same format as the otel sdks, key=value pairs separated by commas
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			t.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return t
+}
+
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (t *tracer) batchStarted(index int) {
+	t.mu.Lock()
+	t.batches[index] = time.Now()
+	t.mu.Unlock()
+}
+
+// Export the batches of state that finished since the last call. Stage spans
+// are laid end to end from the start of the batch, with -per-batch the
+// compression actually runs in the background while later batches basecall.
+func (t *tracer) flush(state *runState) {
+	t.mu.Lock()
+	var spans []otlpSpan
+	for _, rec := range state.Batches {
+		start, ok := t.batches[rec.Index]
+		if !ok || t.exported[rec.Index] || (!rec.Done && rec.Error == "") {
+			continue
+		}
+		t.exported[rec.Index] = true
+		delete(t.batches, rec.Index)
+		spans = append(spans, t.batchSpans(rec, start)...)
+	}
+	t.mu.Unlock()
+	t.send(spans)
+}
+
+func (t *tracer) batchSpans(rec batchRecord, start time.Time) []otlpSpan {
+	id := randomID(8)
+	end := time.Now()
+	var spans []otlpSpan
+	if rec.Timings != nil {
+		at := start
+		for _, stage := range []struct {
+			name    string
+			seconds float64
+		}{
+			{"staging", rec.Timings.Staging},
+			{"startup", rec.Timings.Startup},
+			{"basecall", rec.Timings.Basecall},
+			{"compress", rec.Timings.Tail},
+			{"verify", rec.Timings.Verify},
+		} {
+			next := at.Add(time.Duration(stage.seconds * float64(time.Second)))
+			spans = append(spans, t.span(stage.name, id, at, next, nil, ""))
+			at = next
+		}
+		end = at
+	}
+	attrs := []otlpAttr{
+		intAttr("dbatch.batch", int64(rec.Index)),
+		intAttr("dbatch.files", int64(len(rec.Files))),
+		intAttr("dbatch.reads", rec.Reads),
+		intAttr("dbatch.bases", rec.Bases),
+	}
+	batch := t.span("batch", t.run, start, end, attrs, t.redact(rec.Error))
+	batch.SpanID = id
+	return append(spans, batch)
+}
+
+// Export the run span, err being what the run ended with
+func (t *tracer) finish(b *batch, err error) {
+	attrs := []otlpAttr{
+		stringAttr("dbatch.in", b.redact.path(b.in)),
+		stringAttr("dbatch.out", b.redact.path(b.out)),
+		stringAttr("dbatch.model", b.model),
+	}
+	l := b.redact.labelSet(b.labels)
+	for _, k := range l.keys() {
+		attrs = append(attrs, stringAttr("dbatch.label."+k, l[k]))
+	}
+	msg := ""
+	if err != nil {
+		msg = b.redactText(err.Error())
+	}
+	run := t.span("run", "", t.started, time.Now(), attrs, msg)
+	run.SpanID = t.run
+	t.send([]otlpSpan{run})
+}
+
+func (t *tracer) span(name, parent string, start, end time.Time, attrs []otlpAttr, errMsg string) otlpSpan {
+	s := otlpSpan{
+		TraceID: t.trace,
+		SpanID:  randomID(8),
+		Parent:  parent,
+		Name:    name,
+		Kind:    1, // internal
+		Start:   strconv.FormatInt(start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+		Attrs:   attrs,
+	}
+	if errMsg != "" {
+		s.Status = &otlpStatus{Code: otlpError, Message: errMsg}
+	}
+	return s
+}
+
+func stringAttr(k, v string) otlpAttr {
+	return otlpAttr{k, map[string]any{"stringValue": v}}
+}
+
+// int values are strings in the json encoding of otlp
+func intAttr(k string, v int64) otlpAttr {
+	return otlpAttr{k, map[string]any{"intValue": strconv.FormatInt(v, 10)}}
+}
+
+// Post spans to the collector. A collector that is down only costs the spans,
+// never the run.
+func (t *tracer) send(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   map[string]any{"attributes": []otlpAttr{stringAttr("service.name", t.service)}},
+			"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "dbatch"}, "spans": spans}},
+		}},
+	})
+	if err != nil {
+		fmt.Printf("error encoding spans %s\n", err)
+		return
+	}
+	req, err := http.NewRequest("POST", t.endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("error exporting spans %s\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		fmt.Printf("error exporting spans %s\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("error exporting spans: collector replied %s\n", resp.Status)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// what a triage produced, written to <out>.triage.json
+type triageReport struct {
+	Kit      string          `json:"kit"`
+	Rule     string          `json:"rule"`
+	Fast     triagePass      `json:"fast"`
+	Sup      *triagePass     `json:"sup,omitempty"`
+	Barcodes []triageBarcode `json:"barcodes"`
+}
+
+type triagePass struct {
+	Model   string     `json:"model"`
+	Output  string     `json:"output"`
+	Demux   string     `json:"demux"`
+	Files   int        `json:"files"`
+	Seconds float64    `json:"seconds"`
+	Error   string     `json:"error,omitempty"`
+	QC      *qcSummary `json:"qc,omitempty"`
+}
+
+type triageBarcode struct {
+	Name      string `json:"name"`
+	FastReads int64  `json:"fast_reads"`
+	FastBases int64  `json:"fast_bases"`
+	Selected  bool   `json:"selected"`
+	SupReads  int64  `json:"sup_reads,omitempty"`
+	SupBases  int64  `json:"sup_bases,omitempty"`
+	SupOutput string `json:"sup_output,omitempty"`
+}
+
+// dbatch triage basecalls everything with the fast model and demultiplexes
+// it, then picks barcodes by rule, or asks with -confirm, and basecalls only
+// the files holding their reads again with sup and -mods. Both passes take the
+// usual run flags and are linked in one report.
+func triageMain(args []string) {
+	fs := flag.NewFlagSet("triage", flag.ExitOnError)
+	kit := fs.String("kit", "", "barcoding kit passed to dorado demux, e.g. SQK-RBK114-24")
+	fastModel := fs.String("fast-model", "fast", "model of the first pass")
+	supModel := fs.String("sup-model", "sup", "model the selected barcodes are basecalled again with")
+	mods := fs.String("mods", "", "modified bases for the second pass, e.g. 5mCG_5hmCG")
+	barcodes := fs.String("barcodes", "", "comma separated barcodes to basecall again, default every barcode with -min-reads")
+	minReads := fs.Int64("min-reads", 1000, "select the barcodes with at least this many reads in the fast pass")
+	confirm := fs.Bool("confirm", false, "show the selection and ask before the second pass, the barcodes can be changed there")
+	build := runFlags(fs)
+	fs.Parse(args)
+
+	if *kit == "" {
+		fmt.Println("usage: dbatch triage -kit SQK-RBK114-24 -mods 5mCG_5hmCG -in pod5s -out run.fastq.zst -dorado dorado")
+		fs.PrintDefaults()
+		return
+	}
+
+	b, err := build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if b.in == "" || b.out == "" || b.dpath == "" {
+		fs.PrintDefaults()
+		return
+	}
+	out := b.out
+	b.model = *fastModel
+	b.out = labeledPath(out, filepath.Base(b.model))
+	go handleSignals(b)
+
+	fmt.Println("=============================================")
+	fmt.Printf("triage: basecalling %s with %s into %s\n", b.in, b.model, b.out)
+	fmt.Println("=============================================")
+
+	r := triageReport{Kit: *kit}
+	r.Fast, err = triageRun(b, *kit)
+	if err != nil {
+		writeTriage(out, r)
+		log.Fatal(err)
+	}
+	fast, err := loadDemuxManifest(filepath.Join(r.Fast.Demux, "demux.json"), r.Fast.Output, *kit)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var selected []string
+	if *barcodes != "" {
+		for _, name := range strings.Split(*barcodes, ",") {
+			selected = append(selected, strings.TrimSpace(name))
+		}
+		r.Rule = "barcodes " + strings.Join(selected, ",")
+	} else {
+		selected = selectBarcodes(fast, *minReads)
+		r.Rule = fmt.Sprintf("at least %s reads", thousands(*minReads))
+	}
+	with := *supModel
+	if *mods != "" {
+		with += "," + *mods
+	}
+	printSelection(fast, selected)
+	if *confirm {
+		selected = confirmSelection(selected, with)
+		r.Rule += ", confirmed"
+	}
+	for _, name := range selected {
+		if _, ok := fast.Barcodes[name]; !ok {
+			fmt.Printf("warning: no reads of %s in %s\n", name, r.Fast.Output)
+		}
+	}
+	r.Barcodes = triageBarcodes(fast, selected)
+	if len(selected) == 0 {
+		fmt.Println("no barcodes selected, skipping the second pass")
+		writeTriage(out, r)
+		return
+	}
+
+	sup, err := build()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sup.model = with
+	sup.out = labeledPath(out, filepath.Base(*supModel))
+	sup.priorityBarcodes, sup.priorityFrom, sup.priorityOnly = selected, r.Fast.Output, true
+	if audit, err := openAudit(auditPath(r.Fast.Output)); err == nil {
+		audit.record(r.Fast.Output, "triage_selected", map[string]any{"barcodes": selected, "rule": r.Rule, "sup": sup.out})
+	}
+
+	fmt.Println("=============================================")
+	fmt.Printf("triage: basecalling %s again with %s into %s\n", strings.Join(selected, ", "), sup.model, sup.out)
+	fmt.Println("=============================================")
+
+	pass, err := triageRun(sup, *kit)
+	r.Sup = &pass
+	if err == nil {
+		var d *demuxManifest
+		if d, err = loadDemuxManifest(filepath.Join(pass.Demux, "demux.json"), pass.Output, *kit); err == nil {
+			for i := range r.Barcodes {
+				if bc, ok := d.Barcodes[r.Barcodes[i].Name]; ok {
+					r.Barcodes[i].SupReads, r.Barcodes[i].SupBases, r.Barcodes[i].SupOutput = bc.Reads, bc.Bases, bc.Output
+				}
+			}
+		}
+	}
+	printTriage(r)
+	writeTriage(out, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Run one pass and demultiplex it. A run that skipped batches is still split,
+// its error is kept in the report.
+func triageRun(b *batch, kit string) (triagePass, error) {
+	p := triagePass{Model: b.model, Output: b.out, Demux: b.out + ".demux"}
+	started := time.Now()
+	err := b.run()
+	p.Seconds = time.Since(started).Seconds()
+	p.Files = b.pod5s.len()
+	if data, err := os.ReadFile(qcPath(b.out)); err == nil {
+		var qc qcReport
+		if json.Unmarshal(data, &qc) == nil {
+			p.QC = &qc.All
+		}
+	}
+	if err != nil {
+		p.Error = err.Error()
+		if !errors.Is(err, errPartial) {
+			return p, err
+		}
+		fmt.Println(err)
+	}
+	if _, err := runDemux(b.out, kit, b.dpath, p.Demux, ""); err != nil {
+		p.Error = err.Error()
+		return p, err
+	}
+	return p, nil
+}
+
+// the classified barcodes with at least minReads reads
+func selectBarcodes(d *demuxManifest, minReads int64) []string {
+	var selected []string
+	for name, bc := range d.Barcodes {
+		if name != "unclassified" && bc.Reads >= minReads {
+			selected = append(selected, name)
+		}
+	}
+	slices.Sort(selected)
+	return selected
+}
+
+func printSelection(d *demuxManifest, selected []string) {
+	var total int64
+	names := make([]string, 0, len(d.Barcodes))
+	for name, bc := range d.Barcodes {
+		names = append(names, name)
+		total += bc.Reads
+	}
+	slices.Sort(names)
+
+	fmt.Println("=============================================")
+	for _, name := range names {
+		bc := d.Barcodes[name]
+		mark := " "
+		if slices.Contains(selected, name) {
+			mark = "*"
+		}
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(bc.Reads) / float64(total)
+		}
+		fmt.Printf("%s %-14s reads %s (%.1f%%), bases %s\n", mark, name, thousands(bc.Reads), share, baseCount(bc.Bases))
+	}
+	fmt.Printf("selected %d of %d barcodes for the second pass\n", len(selected), len(names))
+	fmt.Println("=============================================")
+}
+
+// Ask whether to go on with selected. Enter or y keeps it, n drops the second
+// pass and anything else is taken as the barcodes to use instead.
+func confirmSelection(selected []string, with string) []string {
+	fmt.Printf("basecall %s again with %s? [Y/n or barcodes] ", strings.Join(selected, ", "), with)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Println()
+		return nil
+	}
+	switch answer := strings.TrimSpace(line); strings.ToLower(answer) {
+	case "", "y", "yes":
+		return selected
+	case "n", "no":
+		return nil
+	default:
+		return strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+}
+
+func triageBarcodes(d *demuxManifest, selected []string) []triageBarcode {
+	var list []triageBarcode
+	for name, bc := range d.Barcodes {
+		list = append(list, triageBarcode{Name: name, FastReads: bc.Reads, FastBases: bc.Bases, Selected: slices.Contains(selected, name)})
+	}
+	slices.SortFunc(list, func(x, y triageBarcode) int { return strings.Compare(x.Name, y.Name) })
+	return list
+}
+
+func printTriage(r triageReport) {
+	fmt.Println("=============================================")
+	fmt.Printf("%-14s %12s %12s  %s\n", "barcode", r.Fast.Model, r.Sup.Model, "output")
+	for _, bc := range r.Barcodes {
+		if !bc.Selected {
+			continue
+		}
+		fmt.Printf("%-14s %12s %12s  %s\n", bc.Name, thousands(bc.FastReads), thousands(bc.SupReads), bc.SupOutput)
+	}
+	fmt.Printf("second pass basecalled %d files in %s\n", r.Sup.Files, seconds(r.Sup.Seconds))
+	fmt.Println("=============================================")
+}
+
+func writeTriage(out string, r triageReport) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		fmt.Printf("error encoding triage report %s\n", err)
+		return
+	}
+	if err := os.WriteFile(out+".triage.json", data, 0644); err != nil {
+		fmt.Printf("error writing triage report %s\n", err)
+		return
+	}
+	perms.set(out + ".triage.json")
+	fmt.Printf("triage report written to %s\n", out+".triage.json")
+}
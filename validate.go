@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// dorado model names, an alias such as sup or hac@v5.0.0 with optional
+// modified base models, or a complete name like dna_r10.4.1_e8.2_400bps_sup@v5.0.0
+var (
+	modelAlias = regexp.MustCompile(`^(fast|hac|sup)(@(v[0-9.]+|latest))?(,[A-Za-z0-9_]+)*$`)
+	modelName  = regexp.MustCompile(`^(dna|rna[0-9]*)_[A-Za-z0-9_.-]+@v[0-9.]+$`)
+)
+
+// dbatch config validate run.yaml checks a config file the way a run would
+// read it, merged with any flags given after it, then checks the paths,
+// binaries and model it refers to and prints the resulting configuration,
+// without basecalling anything
+func configMain(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Println("usage: dbatch config validate run.yaml [flags]")
+		return
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	build := runFlags(fs)
+	args = args[1:]
+	var path string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		path, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if path == "" && fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if path != "" {
+		fs.Set("config", path)
+	}
+	path = fs.Lookup("config").Value.String()
+	if path == "" {
+		fmt.Println("usage: dbatch config validate run.yaml [flags]")
+		fs.PrintDefaults()
+		return
+	}
+
+	b, err := build()
+	if err != nil {
+		fmt.Printf("%s is invalid: %s\n", path, err)
+		os.Exit(1)
+	}
+	printEffectiveConfig(fs, given, path)
+
+	errs, warnings := b.validate()
+	fmt.Println("=============================================")
+	for _, w := range warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	for _, e := range errs {
+		fmt.Printf("error: %s\n", e)
+	}
+	if len(errs) > 0 {
+		fmt.Printf("%s is invalid, %d errors\n", path, len(errs))
+		fmt.Println("=============================================")
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", path)
+	fmt.Println("=============================================")
+}
+
+// Print every run flag as a config file would hold it, each noting whether it
+// came from the command line, the config or is the default
+func printEffectiveConfig(fs *flag.FlagSet, given map[string]bool, path string) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	origin := func(name string) string {
+		switch {
+		case given[name]:
+			return "command line"
+		case set[name]:
+			return path
+		}
+		return "default"
+	}
+
+	fmt.Println("# effective configuration")
+	var env []string
+	fs.VisitAll(func(f *flag.Flag) {
+		switch v := f.Value.(type) {
+		case envVars:
+			env = v.list()
+		case labels:
+			for _, k := range v.keys() {
+				fmt.Printf("%s: %s=%s # %s\n", f.Name, k, v[k], origin(f.Name))
+			}
+		case extHooks:
+			for _, ext := range slices.Sorted(maps.Keys(v)) {
+				fmt.Printf("%s: %s=%s # %s\n", f.Name, ext, v[ext], origin(f.Name))
+			}
+		default:
+			if f.Name != "config" {
+				fmt.Printf("%s: %s # %s\n", f.Name, f.Value, origin(f.Name))
+			}
+		}
+	})
+	if len(env) > 0 {
+		fmt.Printf("env: # %s\n", origin("env"))
+		for _, kv := range env {
+			k, v, _ := strings.Cut(kv, "=")
+			fmt.Printf("  %s: %s\n", k, v)
+		}
+	}
+}
+
+// Check what a run would only find out once started: that the input, the
+// output directory, dorado, the model and the tools of the hooks exist
+func (b *batch) validate() (errs, warnings []string) {
+	if b.in == "" {
+		errs = append(errs, "-in is not set")
+	} else if isURL(b.in) {
+		if files, err := listRemote(b.in, b.exts); err != nil {
+			errs = append(errs, err.Error())
+		} else if len(files) == 0 {
+			warnings = append(warnings, fmt.Sprintf("no files listed at %s with %s extension", b.in, strings.Join(b.exts, ", ")))
+		} else {
+			fmt.Printf("%d input files at %s\n", len(files), b.in)
+		}
+	} else if info, err := os.Stat(b.in); err != nil {
+		errs = append(errs, fmt.Sprintf("-in %s", err))
+	} else if !info.IsDir() {
+		errs = append(errs, fmt.Sprintf("-in %s is not a directory", b.in))
+	} else if found, err := b.discoverInputs(true, filepath.Join(os.TempDir(), fmt.Sprintf("dbatch-validate-%d.idx", os.Getpid()))); err != nil {
+		errs = append(errs, err.Error())
+	} else if found.close(); found.len() == 0 {
+		warnings = append(warnings, fmt.Sprintf("no files found in %s with %s extension", b.in, strings.Join(b.exts, ", ")))
+	} else {
+		fmt.Printf("%d input files in %s\n", found.len(), b.in)
+	}
+
+	if b.out == "" {
+		errs = append(errs, "-out is not set")
+	} else if _, err := os.Stat(filepath.Dir(b.out)); err != nil {
+		errs = append(errs, fmt.Sprintf("directory of -out %s", err))
+	}
+	if err := b.checkPaths(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if !b.simulated {
+		if b.dpath == "" {
+			errs = append(errs, "-dorado is not set")
+		} else if _, err := exec.LookPath(b.dpath); err != nil {
+			errs = append(errs, fmt.Sprintf("-dorado %s", err))
+		}
+	}
+	switch _, err := os.Stat(b.model); {
+	case err == nil:
+		// a model directory
+	case strings.ContainsRune(b.model, filepath.Separator) || strings.Contains(b.model, "/"):
+		errs = append(errs, fmt.Sprintf("-model %s", err))
+	case !modelAlias.MatchString(b.model) && !modelName.MatchString(b.model):
+		warnings = append(warnings, fmt.Sprintf("-model %s doesn't look like a dorado model name", b.model))
+	}
+
+	for _, ext := range slices.Sorted(maps.Keys(b.hooks)) {
+		if fields := strings.Fields(b.hooks[ext]); len(fields) > 0 {
+			if _, err := exec.LookPath(fields[0]); err != nil {
+				errs = append(errs, fmt.Sprintf("-ext-hook %s: %s", ext, err))
+			}
+		}
+	}
+	if b.decontam != nil {
+		if _, err := os.Stat(b.decontam.ref); err != nil {
+			errs = append(errs, fmt.Sprintf("-decontam-ref %s", err))
+		}
+		if _, err := exec.LookPath("minimap2"); err != nil {
+			errs = append(errs, fmt.Sprintf("-decontam-ref needs minimap2: %s", err))
+		}
+	}
+	if b.priorityFrom != "" {
+		if _, err := os.Stat(manifestPath(b.priorityFrom)); err != nil {
+			errs = append(errs, fmt.Sprintf("-priority-from %s", err))
+		}
+	}
+	return errs, warnings
+}
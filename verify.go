@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// verifyPool runs the spot check of finished batches in the background. The
+// batches of a single output can't be cut out again once later ones follow, so a
+// batch failing verification here is recorded as missing rather than retried.
+type verifyPool struct {
+	check float64
+
+	jobs    chan verifyJob
+	results chan verifyResult
+	wg      sync.WaitGroup
+	pending int
+}
+
+type verifyJob struct {
+	index          int
+	path           string
+	offset, length int64
+	reads          int64
+}
+
+type verifyResult struct {
+	index   int
+	res     spotResult
+	seconds float64
+	err     error
+}
+
+// Start the verification workers when -verify-workers is set. Per-batch runs
+// already verify in their compression pool.
+func (b *batch) startVerifier() {
+	if b.verifyWorkers <= 0 || b.spotCheck <= 0 || b.pool != nil {
+		return
+	}
+	v := &verifyPool{
+		check:   b.spotCheck,
+		jobs:    make(chan verifyJob, 1024),
+		results: make(chan verifyResult, 1024),
+	}
+	metrics.describe("dbatch_verify_queue", "gauge", "Batches waiting to be verified")
+	for range b.verifyWorkers {
+		v.wg.Add(1)
+		go v.work()
+	}
+	b.verifier = v
+}
+
+func (v *verifyPool) submit(j verifyJob) {
+	v.pending++
+	metrics.set("dbatch_verify_queue", float64(v.pending))
+	v.jobs <- j
+}
+
+func (v *verifyPool) work() {
+	defer v.wg.Done()
+	for j := range v.jobs {
+		started := time.Now()
+		res, err := spotCheck(j.path, j.offset, j.length, v.check, j.reads)
+		v.results <- verifyResult{j.index, res, time.Since(started).Seconds(), err}
+	}
+}
+
+// Record batches that finished verification. With wait set, shut the workers
+// down and wait for every outstanding batch, so the run is only finalised once
+// all of them are verified.
+func (b *batch) collectVerified(wait bool) {
+	v := b.verifier
+	if v == nil {
+		return
+	}
+	if wait {
+		close(v.jobs)
+		go func() {
+			v.wg.Wait()
+			close(v.results)
+		}()
+		if v.pending > 0 {
+			fmt.Printf("waiting for %d batches to be verified\n", v.pending)
+		}
+	}
+
+	for v.pending > 0 {
+		var r verifyResult
+		if wait {
+			r = <-v.results
+		} else {
+			select {
+			case r = <-v.results:
+			default:
+				return
+			}
+		}
+		v.pending--
+		metrics.set("dbatch_verify_queue", float64(v.pending))
+
+		rec, ok := b.state.findBatch(r.index)
+		if !ok {
+			continue
+		}
+		if rec.Timings != nil {
+			rec.Timings.Verify = r.seconds
+		}
+		if r.err != nil {
+			fmt.Printf("batch %d failed verification: %s\n", r.index, r.err)
+			rec.Error = r.err.Error()
+			metrics.add("dbatch_batches_failed_total", 1)
+			b.audit.record(b.out, "batch_failed", map[string]any{"batch": r.index, "error": rec.Error})
+		} else {
+			rec.Done = true
+			rec.SHA256 = r.res.sha256
+			metrics.add("dbatch_batches_done_total", 1)
+			metrics.add("dbatch_spot_check_records_total", float64(r.res.sampled))
+			b.audit.record(b.out, "batch_done", map[string]any{"batch": rec.Index, "offset": rec.Offset, "length": rec.Length, "reads": rec.Reads, "sha256": rec.SHA256})
+			b.publishBatch(rec)
+			b.recordHistory(rec)
+		}
+		if err := b.state.save(); err != nil {
+			fmt.Println(err)
+		}
+		if err := newManifest(b.state).write(b.manifestPath()); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunks are symlinked into one stage so dorado loads its model once per chunk
+// rather than once per file. -warm-worker goes further for backends that can
+// keep a model resident, a basecall server client or a wrapper holding the
+// model open: the command is started once and basecalls every chunk of the run.
+// It gets DBATCH_MODEL, DBATCH_DEVICE and DBATCH_DORADO in its environment and
+// prints a line "ready" on stdout once the model is loaded. dbatch then writes
+// a json line on its stdin for each chunk,
+//
+//	{"batch": 3, "stage": "/out.dbatch/tmp/batch_00003/stage/", "model": "hac",
+//	 "device": "cuda:0", "args": ["basecaller", "hac", "-r", "--emit-fastq", ...]}
+//
+// with the dorado arguments the chunk would have been run with, and reads the
+// chunk's fastq from its stdout up to a line "#dbatch done", or
+// "#dbatch error <message>" if the chunk failed, in place of a record. The time
+// to ready is the model load each later chunk is spared, reported per batch as
+// the startup saved, the first chunk counts it in its startup. A worker that
+// exits is started again for the next chunk, and stdin is closed once the run
+// is done.
+type warmWorker struct {
+	command string
+	device  string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	out     *bufio.Reader
+	stderr  *switchWriter
+	load    float64 // seconds from the start to ready
+	chunks  int     // requested since it started
+	exited  chan struct{}
+}
+
+// the stderr of the worker, sent to the log of the chunk it is working on
+type switchWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+func (s *switchWriter) set(w io.Writer) {
+	s.mu.Lock()
+	s.w = w
+	s.mu.Unlock()
+}
+
+// The worker of this pipeline, started on the first chunk and again when it
+// exited or the device changed, on falling back to the cpu
+func (b *batch) warmWorker() (*warmWorker, error) {
+	if w := b.warm; w != nil {
+		select {
+		case <-w.exited:
+			fmt.Println("the warm worker exited, starting it again")
+		default:
+			if w.device == b.device {
+				return w, nil
+			}
+			w.stop()
+		}
+	}
+	w := &warmWorker{command: b.warmCmd, device: b.device, stderr: &switchWriter{w: os.Stderr}, exited: make(chan struct{})}
+	w.cmd = shellCommand(w.command)
+	if w.cmd.Env == nil {
+		w.cmd.Env = os.Environ()
+	}
+	w.cmd.Env = append(w.cmd.Env, "DBATCH_MODEL="+b.model, "DBATCH_DEVICE="+b.device, "DBATCH_DORADO="+b.dpath)
+	w.cmd.Stderr = w.stderr
+	var err error
+	if w.stdin, err = w.cmd.StdinPipe(); err != nil {
+		return nil, fmt.Errorf("could not get warm worker stdin %w", err)
+	}
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("could not get warm worker stdout %w", err)
+	}
+	w.out = bufio.NewReaderSize(stdout, 1<<20)
+
+	fmt.Printf("starting warm worker %s\n", w.command)
+	started := time.Now()
+	if err := w.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting -warm-worker %w", err)
+	}
+	go func() {
+		w.cmd.Wait()
+		close(w.exited)
+	}()
+	for {
+		line, err := w.out.ReadString('\n')
+		if strings.TrimSpace(line) == "ready" {
+			break
+		}
+		if err != nil {
+			w.stop()
+			return nil, fmt.Errorf("the warm worker exited before it was ready")
+		}
+		fmt.Print(line)
+	}
+	w.load = time.Since(started).Seconds()
+	fmt.Printf("warm worker ready in %s, loading %s once for every chunk\n", seconds(w.load), b.model)
+	b.warm = w
+	return w, nil
+}
+
+// the chunk request the worker reads
+type warmRequest struct {
+	Batch  int      `json:"batch"`
+	Stage  string   `json:"stage"`
+	Model  string   `json:"model"`
+	Device string   `json:"device,omitempty"`
+	Args   []string `json:"args"`
+}
+
+// Hand the worker the staged chunk, returning its fastq and a wait for the
+// worker to say how the chunk went
+func (w *warmWorker) request(r warmRequest, stderr io.Writer) (io.ReadCloser, func() error, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	w.stderr.set(stderr)
+	if _, err := w.stdin.Write(append(data, '\n')); err != nil {
+		w.stderr.set(os.Stderr)
+		return nil, nil, fmt.Errorf("error writing to the warm worker %w", err)
+	}
+	w.chunks++
+	c := &warmChunk{w: w, start: true}
+	wait := func() error {
+		// what the pipeline left, so the next chunk starts at its own
+		io.Copy(io.Discard, c)
+		w.stderr.set(os.Stderr)
+		return c.err
+	}
+	return c, wait, nil
+}
+
+// Stop the worker once the run is done, closing its stdin and killing it if
+// it doesn't exit in a while
+func (w *warmWorker) stop() {
+	if w == nil {
+		return
+	}
+	w.stdin.Close()
+	select {
+	case <-w.exited:
+	case <-time.After(30 * time.Second):
+		fmt.Println("the warm worker didn't exit, killing it")
+		w.cmd.Cancel()
+		<-w.exited
+	}
+}
+
+func (b *batch) stopWarm() {
+	b.warm.stop()
+	b.warm = nil
+}
+
+var warmStatus = []byte("#dbatch ")
+
+// warmChunk reads the fastq of one chunk from the worker, ending at the status
+// line. Records start with @, and the status is only looked for where a record
+// would start, so a quality line starting with # is never taken for it. A
+// worker exiting mid chunk ends it too, with an error for wait rather than for
+// the pipeline, which would give up on the run.
+type warmChunk struct {
+	w       *warmWorker
+	start   bool // at the start of a line
+	line    int
+	pending []byte
+	done    bool
+	err     error
+}
+
+func (c *warmChunk) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.start && c.line%4 == 0 {
+		if head, _ := c.w.out.Peek(len(warmStatus)); bytes.Equal(head, warmStatus) {
+			status, _ := c.w.out.ReadString('\n')
+			c.done = true
+			status = strings.TrimSpace(strings.TrimPrefix(status, string(warmStatus)))
+			if status != "done" {
+				c.err = fmt.Errorf("warm worker %s", status)
+			}
+			return 0, io.EOF
+		}
+	}
+	data, err := c.w.out.ReadSlice('\n')
+	if len(data) > 0 {
+		// a line longer than the buffer comes in pieces
+		c.start = data[len(data)-1] == '\n'
+		if c.start {
+			c.line++
+		}
+		n := copy(p, data)
+		c.pending = append(c.pending[:0], data[n:]...)
+		return n, nil
+	}
+	c.done = true
+	c.err = fmt.Errorf("the warm worker exited mid chunk %w", err)
+	return 0, io.EOF
+}
+
+func (c *warmChunk) Close() error {
+	return nil
+}
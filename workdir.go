@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Every chunk in flight gets its own directory under the run's tmp root: stage
+// holds the inputs dorado reads and scratch is for converters and other
+// intermediate files. Both live exactly as long as the chunk does, so
+// pipelines working on different chunks never see each other's files.
+type workDir struct {
+	root    string
+	stage   string
+	scratch string
+	cached  []string // held in the pod5 cache for the stage
+}
+
+func newWorkDir(tmp string, index int) (*workDir, error) {
+	root := filepath.Join(tmp, fmt.Sprintf("batch_%05d", index))
+	w := &workDir{root: root, stage: filepath.Join(root, "stage"), scratch: filepath.Join(root, "scratch")}
+	for _, dir := range []string{w.stage, w.scratch} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			os.RemoveAll(root)
+			return nil, fmt.Errorf("error making working directory %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w *workDir) remove() {
+	if err := os.RemoveAll(w.root); err != nil {
+		fmt.Printf("error removing working directory %s\n", err)
+	}
+}
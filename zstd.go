@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+)
+
+// Without a zstd binary, e.g. on a Windows workstation, dbatch runs itself as
+// the compressor. It writes valid zstd frames made of raw blocks, which any
+// zstd reads but which aren't compressed; recompress the output with zstd
+// later to save the space. Reading handles raw frames only.
+const (
+	zstdMagic      = 0xFD2FB528
+	zstdBlockSize  = 128 << 10
+	zstdWindowDesc = 7 << 3 // window log 17, the block size
+)
+
+var haveZstd = sync.OnceValue(func() bool {
+	_, err := exec.LookPath("zstd")
+	return err == nil
+})
+
+// dbatch builtin-zstd [-d] [-c] [level...], the part of the zstd command line
+// dbatch uses, stdin to stdout
+func builtinZstdMain(args []string) {
+	in := bufio.NewReaderSize(os.Stdin, zstdBlockSize)
+	out := bufio.NewWriterSize(os.Stdout, zstdBlockSize)
+	var err error
+	if slices.Contains(args, "-d") || slices.Contains(args, "-dc") {
+		err = zstdUnstore(out, in)
+	} else {
+		err = zstdStore(out, in)
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// write r as one frame of raw blocks
+func zstdStore(w io.Writer, r io.Reader) error {
+	header := binary.LittleEndian.AppendUint32(nil, zstdMagic)
+	header = append(header, 0, zstdWindowDesc)
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("error writing zstd frame %w", err)
+	}
+
+	buf := make([]byte, zstdBlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("error reading input %w", err)
+		}
+		block := uint32(n) << 3 // raw block type is 0
+		if last {
+			block |= 1
+		}
+		if _, err := w.Write([]byte{byte(block), byte(block >> 8), byte(block >> 16)}); err != nil {
+			return fmt.Errorf("error writing zstd frame %w", err)
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("error writing zstd frame %w", err)
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decode concatenated frames of raw and rle blocks
+func zstdUnstore(w *bufio.Writer, r *bufio.Reader) error {
+	var word [8]byte
+	for {
+		if _, err := io.ReadFull(r, word[:4]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading zstd frame %w", err)
+		}
+		magic := binary.LittleEndian.Uint32(word[:4])
+		// skippable frames carry metadata
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			if _, err := io.ReadFull(r, word[:4]); err != nil {
+				return fmt.Errorf("error reading zstd frame %w", err)
+			}
+			if _, err := r.Discard(int(binary.LittleEndian.Uint32(word[:4]))); err != nil {
+				return fmt.Errorf("error reading zstd frame %w", err)
+			}
+			continue
+		}
+		if magic != zstdMagic {
+			return errors.New("not zstd data")
+		}
+
+		desc, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("error reading zstd frame %w", err)
+		}
+		single := desc&0x20 != 0
+		skip := []int{0, 1, 2, 4}[desc&3] // dictionary id
+		switch fcs := desc >> 6; {
+		case fcs == 0 && single:
+			skip++
+		case fcs > 0:
+			skip += 1 << fcs
+		}
+		if !single {
+			skip++ // window descriptor
+		}
+		if _, err := r.Discard(skip); err != nil {
+			return fmt.Errorf("error reading zstd frame %w", err)
+		}
+
+		for last := false; !last; {
+			if _, err := io.ReadFull(r, word[:3]); err != nil {
+				return fmt.Errorf("error reading zstd block %w", err)
+			}
+			header := uint32(word[0]) | uint32(word[1])<<8 | uint32(word[2])<<16
+			last = header&1 != 0
+			size := int64(header >> 3)
+			switch (header >> 1) & 3 {
+			case 0:
+				if _, err := io.CopyN(w, r, size); err != nil {
+					return fmt.Errorf("error reading zstd block %w", err)
+				}
+			case 1:
+				c, err := r.ReadByte()
+				if err != nil {
+					return fmt.Errorf("error reading zstd block %w", err)
+				}
+				for range size {
+					if err := w.WriteByte(c); err != nil {
+						return err
+					}
+				}
+			default:
+				return errors.New("compressed zstd blocks need the zstd binary, install zstd to read this output")
+			}
+		}
+		if desc&0x04 != 0 {
+			if _, err := r.Discard(4); err != nil {
+				return fmt.Errorf("error reading zstd checksum %w", err)
+			}
+		}
+	}
+}